@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultCompressSize is the number of bytes a body needs before
+// it's compressed by a server that uses compress
+var DefaultCompressSize = 1024
+
+// acceptsGzip returns true if the request Accept-Encoding header
+// allows gzip, a q value of 0 means that it is not allowed
+func acceptsGzip(r *http.Request) bool { return acceptsEncoding(r, "gzip") }
+
+// acceptsEncoding returns true if the request Accept-Encoding header
+// allows the encoding, a q value of 0 means that it is not allowed
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if name := strings.TrimSpace(parts[0]); name != encoding && name != "*" {
+			continue
+		}
+
+		accept := true
+		for _, param := range parts[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				q, err := strconv.ParseFloat(kv[1], 64)
+				accept = err == nil && q > 0
+			}
+		}
+		if accept {
+			return true
+		}
+	}
+	return false
+}
+
+// writeGzip writes the gzip compressed out string with the status, a
+// response that already has a Content-Encoding is written as-is
+func writeGzip(w http.ResponseWriter, status int, out string) {
+	hdr := w.Header()
+	if hdr.Get("Content-Encoding") != "" {
+		w.WriteHeader(status)
+		w.Write([]byte(out))
+		return
+	}
+
+	if hdr.Get("Content-Type") == "" {
+		hdr.Set("Content-Type", http.DetectContentType([]byte(out))) // before the body is compressed
+	}
+	hdr.Set("Content-Encoding", "gzip")
+	hdr.Add("Vary", "Accept-Encoding")
+	hdr.Del("Content-Length")
+	w.WriteHeader(status)
+
+	gz := gzip.NewWriter(w)
+	_, err := gz.Write([]byte(out))
+	log.OnErr(err).Printf("[http] writing the gzip body: %v", err)
+	err = gz.Close()
+	log.OnErr(err).Printf("[http] closing the gzip body: %v", err)
+}
+
+// compressWriter is the gzip or deflate writer
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressResponse is middleware that compresses the response bodies
+// with gzip or deflate, when the request accepts it
+func compressResponse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var encoding string
+		switch {
+		case acceptsEncoding(r, "gzip"):
+			encoding = "gzip"
+		case acceptsEncoding(r, "deflate"):
+			encoding = "deflate"
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding, status: http.StatusOK}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressResponseWriter holds the body until it has DefaultCompressSize
+// bytes, so small bodies and bodies that already have a Content-Encoding
+// are sent as-is
+type compressResponseWriter struct {
+	http.ResponseWriter
+
+	encoding string
+	status   int
+	buf      []byte
+	started  bool
+	cw       compressWriter
+}
+
+// WriteHeader holds the status until the body is started
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if !w.started {
+		w.status = status
+	}
+}
+
+// Write holds the bytes until it's known if they are compressed
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < DefaultCompressSize {
+			return len(b), nil
+		}
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if w.cw != nil {
+		return w.cw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// start writes the header and the held bytes, compressed if
+// the response doesn't already have a Content-Encoding and isn't
+// a partial response, since a Content-Range describes the bytes
+// before they are compressed
+func (w *compressResponseWriter) start(compress bool) (err error) {
+	w.started = true
+
+	hdr := w.Header()
+	partial := w.status == http.StatusPartialContent || hdr.Get("Content-Range") != ""
+	if compress && !partial && hdr.Get("Content-Encoding") == "" {
+		if hdr.Get("Content-Type") == "" {
+			hdr.Set("Content-Type", http.DetectContentType(w.buf)) // before the body is compressed
+		}
+		hdr.Set("Content-Encoding", w.encoding)
+		hdr.Add("Vary", "Accept-Encoding")
+		hdr.Del("Content-Length")
+
+		switch w.encoding {
+		case "gzip":
+			w.cw = gzip.NewWriter(w.ResponseWriter)
+		case "deflate":
+			w.cw, _ = flate.NewWriter(w.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.cw != nil {
+		_, err = w.cw.Write(buf)
+		return err
+	}
+	_, err = w.ResponseWriter.Write(buf)
+	return err
+}
+
+// Flush starts the body, so streamed bodies are compressed
+// as they are sent
+func (w *compressResponseWriter) Flush() {
+	if !w.started {
+		err := w.start(len(w.buf) > 0)
+		log.OnErr(err).Printf("[http] writing the %s body: %v", w.encoding, err)
+	}
+	if w.cw != nil {
+		err := w.cw.Flush()
+		log.OnErr(err).Printf("[http] flushing the %s body: %v", w.encoding, err)
+	}
+	if fl, ok := flusher(w.ResponseWriter); ok {
+		fl.Flush()
+	}
+}
+
+// Hijack hands over the connection, nothing is compressed after this
+func (w *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := hijacker(w.ResponseWriter)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.started = true
+	return hj.Hijack()
+}
+
+// close sends a small body as-is, or finishes the compressed body
+func (w *compressResponseWriter) close() {
+	if !w.started {
+		err := w.start(false)
+		log.OnErr(err).Printf("[http] writing the body: %v", err)
+		return
+	}
+	if w.cw != nil {
+		err := w.cw.Close()
+		log.OnErr(err).Printf("[http] closing the %s body: %v", w.encoding, err)
+	}
+}
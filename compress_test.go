@@ -0,0 +1,166 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	var tests = []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "", want: false},
+		{accept: "gzip", want: true},
+		{accept: "deflate, gzip;q=0.8", want: true},
+		{accept: "gzip;q=0", want: false},
+		{accept: "*", want: true},
+		{accept: "br, deflate", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.accept, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/test", nil)
+			r.Header.Set("Accept-Encoding", test.accept)
+			if have := acceptsGzip(r); have != test.want {
+				t.Errorf("have: %t want: %t", have, test.want)
+			}
+		})
+	}
+}
+
+func TestResponseMinCompressSize(t *testing.T) {
+	var min = 64
+	var tests = []struct {
+		name     string
+		body     string
+		encoding string
+	}{
+		{name: "small body", body: "tiny", encoding: ""},
+		{name: "large body", body: strings.Repeat("compress me ", 20), encoding: "gzip"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{
+				Method:   "get",
+				Response: []ResponseHTTP{{Status: "200", Body: attr(test.body), MinCompressSize: &min}},
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/test", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+			hdl.ServeHTTP(rec, r)
+
+			if have := rec.Header().Get("Content-Encoding"); have != test.encoding {
+				t.Fatalf("have: %q want: %q", have, test.encoding)
+			}
+
+			var body = rec.Body.String()
+			if test.encoding == "gzip" {
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := ioutil.ReadAll(gz)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(b)
+			}
+
+			if body != test.body {
+				t.Errorf("have: %q want: %q", body, test.body)
+			}
+		})
+	}
+}
+
+func TestServerCompress(t *testing.T) {
+	var big = strings.Repeat("compress me ", 200)
+	var tests = []struct {
+		name     string
+		accept   string
+		encoded  string
+		status   int
+		ranged   string
+		body     string
+		encoding string
+	}{
+		{name: "gzip", accept: "gzip", body: big, encoding: "gzip"},
+		{name: "deflate", accept: "deflate", body: big, encoding: "deflate"},
+		{name: "gzip preferred", accept: "deflate, gzip", body: big, encoding: "gzip"},
+		{name: "not accepted", accept: "br", body: big, encoding: ""},
+		{name: "small body", accept: "gzip", body: "tiny", encoding: ""},
+		{name: "already encoded", accept: "gzip", encoded: "identity", body: big, encoding: "identity"},
+		{name: "partial content", accept: "gzip", status: http.StatusPartialContent, ranged: "bytes 0-2399/4800", body: big, encoding: ""},
+		{name: "content range", accept: "gzip", ranged: "bytes 0-2399/4800", body: big, encoding: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.status == 0 {
+				test.status = http.StatusCreated
+			}
+
+			hdl := compressResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.encoded != "" {
+					w.Header().Set("Content-Encoding", test.encoded)
+				}
+				if test.ranged != "" {
+					w.Header().Set("Content-Range", test.ranged)
+				}
+				w.WriteHeader(test.status)
+				io.WriteString(w, test.body[:len(test.body)/2]) // in parts, so the body is held
+				io.WriteString(w, test.body[len(test.body)/2:])
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/test", nil)
+			r.Header.Set("Accept-Encoding", test.accept)
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r)
+
+			if rec.Code != test.status {
+				t.Errorf("have: %d want: %d", rec.Code, test.status)
+			}
+			if have := rec.Header().Get("Content-Range"); have != test.ranged {
+				t.Errorf("have: %q want: %q", have, test.ranged)
+			}
+			if have := rec.Header().Get("Content-Encoding"); have != test.encoding {
+				t.Fatalf("have: %q want: %q", have, test.encoding)
+			}
+
+			var rd io.Reader = rec.Body
+			switch test.encoding {
+			case "gzip":
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rd = gz
+			case "deflate":
+				rd = flate.NewReader(rec.Body)
+			}
+
+			b, err := ioutil.ReadAll(rd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have := string(b); have != test.body {
+				t.Errorf("have: %d bytes want: %d bytes", len(have), len(test.body))
+			}
+		})
+	}
+}
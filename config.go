@@ -1,14 +1,18 @@
 package main
 
 import (
+	"fmt"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/spf13/afero"
 	"github.com/zclconf/go-cty/cty"
+	ctyconvert "github.com/zclconf/go-cty/cty/convert"
 )
 
 // serviceControl controls stopping and starting HTTP services
@@ -37,6 +41,8 @@ type Config struct {
 		svrStart        time.Time
 		svrCfgLoad      time.Time
 		svrCfgLoadValid bool // says if the last reload was successful
+
+		noWatch bool // don't start the config file watcher
 	}
 	serviceControl
 
@@ -57,37 +63,231 @@ type Config struct {
 	Plugins hcl.Body `hcl:",remain"`
 }
 
+// validateConfig checks that the proxy and JWT names used in
+// the routes are configured in at least one of the servers, and
+// that the request and proxy header values can be evaluated
+func validateConfig(config Config) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	// only response headers can use the request variables
+	var checkHeaders = func(hdrs *headers) {
+		if hdrs != nil {
+			_, dia := hdrs.values(headerEvalCtx)
+			diags = append(diags, dia...)
+		}
+	}
+
+	proxies, jwts := make(map[string]struct{}), make(map[string]struct{})
+	for _, server := range config.Servers {
+		if server.Proxy != nil {
+			proxies[server.Proxy.Name] = struct{}{}
+			checkHeaders(server.Proxy.Headers)
+		}
+		if server.JWT != nil {
+			jwts[server.JWT.Name] = struct{}{}
+		}
+	}
+
+	var checkProxy = func(path, name string) {
+		if _, ok := proxies[name]; !ok {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unknown proxy",
+				Detail:   fmt.Sprintf("The path %q uses the proxy %q which is not configured in any server.", path, name),
+			})
+		}
+	}
+	var checkJWT = func(path, name string) {
+		if _, ok := jwts[name]; !ok {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unknown JWT",
+				Detail:   fmt.Sprintf("The path %q uses the JWT %q which is not configured in any server.", path, name),
+			})
+		}
+	}
+	var checkResponse = func(path string, res ResponseHTTP) {
+		_, isClass := statusClass(res.Status)
+		if _, err := strconv.Atoi(res.Status); err != nil && res.Status != "" && !isClass {
+			checkProxy(path, res.Status) // a status that is not a number is a proxy name
+		}
+		if res.JWT != nil {
+			checkJWT(path, res.JWT.Name)
+		}
+		if res.BodyFile != nil && (res.Reason != nil || len(res.RawHeaders) > 0) {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid body_file",
+				Detail:   fmt.Sprintf("The path %q streams the body file %q, which can't be sent with a reason or raw_headers.", path, *res.BodyFile),
+			})
+		}
+	}
+
+	for _, route := range config.Routes {
+		if route.Proxy != nil {
+			checkProxy(route.Path, route.Proxy.Name)
+			checkHeaders(route.Proxy.Headers)
+		}
+		if cors := route.CORS; cors != nil && cors.AllowOrigin == "*" && cors.AllowCredentials != nil && *cors.AllowCredentials {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid CORS",
+				Detail:   fmt.Sprintf("The path %q allows credentials with the %q origin, which browsers reject. Use a specific origin instead.", route.Path, "*"),
+			})
+		}
+		for _, req := range route.Request {
+			if req.JWT != nil {
+				checkJWT(route.Path, req.JWT.Name)
+			}
+			checkHeaders(req.Headers)
+			if req.MaxConcurrent != nil && *req.MaxConcurrent < 1 {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid max_concurrent",
+					Detail:   fmt.Sprintf("The path %q has a max_concurrent of %d, it must be at least 1.", route.Path, *req.MaxConcurrent),
+				})
+			}
+			for _, res := range req.Response {
+				checkResponse(route.Path, res)
+			}
+			if req.Fail != nil {
+				checkResponse(route.Path, *req.Fail)
+			}
+		}
+		for _, res := range route.OnNoMatch {
+			checkResponse(route.Path, res)
+		}
+	}
+
+	return diags
+}
+
 // system holds all of the internal system dependent configs
 type system struct {
-	LogDir *string `hcl:"log_dir"` // the name of the directory to save reload logs to
+	LogDir         *string        `hcl:"log_dir"`              // the name of the directory to save reload logs to
+	FixturesDir    *string        `hcl:"fixtures_dir"`         // the name of the directory to load JSON fixture routes from
+	Journal        *systemJournal `hcl:"journal,block"`        // records requests to /_internal/server/journal
+	NoWatch        bool           `hcl:"no_watch,optional"`    // don't reload when the config files change
+	ReloadDebounce *string        `hcl:"reload_debounce"`      // wait this long after the last file write to reload, i.e. "100ms"
+	StrictText     bool           `hcl:"strict_text,optional"` // error when the text(name) function has no matching text block
+}
+
+// systemJournal holds the request journal configs
+type systemJournal struct {
+	CaptureBody bool     `hcl:"capture_body,optional"`
+	Redact      []string `hcl:"redact,optional"` // JSON body paths to redact, i.e. "user.password"
+	Limit       *int     `hcl:"limit"`
 }
 
 // headerData is the type used for storing header KV data
 type headerData map[string][]cty.Value
 
-// headers holds all headers
+// headers holds all headers, the attributes are evaluated when they are
+// used so response headers can use the request variables. A list value
+// is sent as multiple values with the same header name.
 type headers struct {
-	Data headerData `hcl:",remain"`
+	Data  headerData     // the values that are set without HCL, i.e. by fixtures
+	Attrs hcl.Attributes `hcl:",remain"`
+}
+
+// headerEvalCtx is the context used for the header values
+// that are not in a response, the same as decoding the config
+var headerEvalCtx = _context()
+
+// values returns the header values, with the attributes evaluated
+// using the context
+func (h *headers) values(ctx *hcl.EvalContext) (headerData, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	var data = make(headerData, len(h.Data)+len(h.Attrs))
+	for k, vals := range h.Data {
+		data[k] = append(data[k], vals...)
+	}
+
+	for k, attr := range h.Attrs {
+		val, dia := attr.Expr.Value(ctx)
+		if diags = append(diags, dia...); dia.HasErrors() {
+			continue
+		}
+
+		var vals = []cty.Value{val}
+		if val.Type().IsTupleType() || val.Type().IsListType() {
+			vals = val.AsValueSlice()
+		}
+		for _, v := range vals {
+			str, err := ctyconvert.Convert(v, cty.String)
+			if err != nil || str.IsNull() {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid header value",
+					Detail:   fmt.Sprintf("The %q header value must be a string or a list of strings.", k),
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+				break
+			}
+			data[k] = append(data[k], str)
+		}
+	}
+	return data, diags
 }
 
 // ConfigHTTP hold configurations for HTTP services
 type ConfigHTTP struct {
 	Name      string       `hcl:"name,label"`
-	Host      string       `hcl:"host,optional"`
+	Host      cty.Value    `hcl:"host,optional"` // a single address or a list of addresses
 	HTTP2     bool         `hcl:"http2_only,optional"`
+	HTTP10    bool         `hcl:"http1_0,optional"`        // respond with HTTP/1.0 semantics, no keep-alives
+	NormPath  bool         `hcl:"normalize_path,optional"` // lowercase and clean request paths before routing
 	BasicAuth *configBA    `hcl:"basic_auth,block"`
 	JWT       *configJWT   `hcl:"jwt,block"`
 	SSL       *configSSL   `hcl:"ssl,block"`
 	Proxy     *configProxy `hcl:"proxy,block"`
 
+	OnInvalidJWT []ResponseHTTP `hcl:"on_invalid_jwt,block"` // used for any request with a JWT that can not be decoded
+
+	BasePath          *string `hcl:"base_path"`           // a prefix for all of the route paths, i.e. "/api"
+	ShutdownMessage   *string `hcl:"shutdown_message"`    // the body sent to new requests while shutting down
+	ReadHeaderTimeout *string `hcl:"read_header_timeout"` // the time allowed to read request headers, i.e. "10s"
+	ServerHeader      *string `hcl:"server_header"`       // the Server header sent with each response, i.e. "nginx/1.25.3"
+	CookieSecret      *string `hcl:"cookie_secret"`       // the HMAC secret used to sign and verify signed cookies
+	ReadyAfter        *string `hcl:"ready_after"`         // all requests get a 503 until this long after the start, i.e. "5s"
+	MaxBodyBytes      *int64  `hcl:"max_body_bytes"`      // request bodies over this many bytes get a 413, the default is 10MB
+
+	Compress bool `hcl:"compress,optional"` // gzip or deflate response bodies when the client accepts it
+
+	TraceContext bool `hcl:"trace_context,optional"` // create a W3C traceparent header for requests without one
+
 	Plugins hcl.Body `hcl:",remain"`
 }
 
+// hosts returns all of the addresses that the server should listen on
+func (c ConfigHTTP) hosts() ([]string, error) {
+	if c.Host == cty.NilVal || c.Host.IsNull() {
+		return []string{""}, nil
+	}
+
+	var vals = []cty.Value{c.Host}
+	if c.Host.CanIterateElements() {
+		vals = c.Host.AsValueSlice()
+	}
+
+	var hosts = make([]string, 0, len(vals))
+	for _, val := range vals {
+		host, err := ctyconvert.Convert(val, cty.String)
+		if err != nil || host.IsNull() {
+			return nil, ErrHostParse.F(c.Name, err)
+		}
+		hosts = append(hosts, host.AsString())
+	}
+	return hosts, nil
+}
+
 // configBA are basic auth config options
 type configBA struct {
 	User string `hcl:"username,optional"`
 	Pass string `hcl:"password,optional"`
 	Relm string `hcl:"relm,optional"`
+
+	ChallengeOnly bool `hcl:"challenge_only,optional"` // always send a 401 challenge without checking credentials
 }
 
 // configJWT are JWT config options
@@ -97,6 +297,8 @@ type configJWT struct {
 	Typ    *string        `hcl:"typ"`
 	Key    *hcl.Attribute `hcl:"private_key"`
 	Secret *hcl.Attribute `hcl:"secret"`
+
+	KeyID string `hcl:"kid,optional"` // the token header kid, defaults to a SHA-256 of the key
 }
 
 // configSSL are SSL config options
@@ -109,16 +311,41 @@ type configSSL struct {
 		Hosts []string       `hcl:"hosts"`
 		Email *hcl.Attribute `hcl:"email"`
 	} `hcl:"lets_encrypt,block"`
+
+	MinVersion   *string  `hcl:"min_tls_version"`        // i.e. "1.2"
+	CipherSuites []string `hcl:"cipher_suites,optional"` // the crypto/tls names, i.e. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+
+	MTLS *configMTLS `hcl:"mtls,block"` // verify the client certificates
+}
+
+// configMTLS are the mutual TLS options
+type configMTLS struct {
+	ClientCA string `hcl:"client_ca"`        // the path to the PEM bundle of the CAs that sign the client certs
+	Require  bool   `hcl:"require,optional"` // when false a client cert is only verified if it's sent
 }
 
 // configProxy are proxy config options
 type configProxy struct {
 	Name    string   `hcl:"name,label"`
 	URL     string   `hcl:"url"`
-	Mode    string   `hcl:"mode,optional"`
+	Mode    string   `hcl:"mode,optional"` // passthrough (the default), record, replay or contract
 	Headers *headers `hcl:"headers,block"`
 
-	_url *url.URL
+	Expect *proxyExpect `hcl:"expect,block"` // what the contract mode checks the upstream responses against
+
+	FixturesDir *string `hcl:"fixtures_dir"` // where the record mode saves responses for the replay mode
+
+	Timeout *string `hcl:"timeout"` // the time allowed to connect and get the upstream headers, i.e. "5s"
+	Retries *int    `hcl:"retries"` // the number of times a failed idempotent upstream request is tried again
+
+	StripPrefix *string        `hcl:"strip_prefix"` // removed from the start of the proxied path, i.e. "/api/v1"
+	Rewrite     *hcl.Attribute `hcl:"rewrite"`      // a template that replaces the proxied path, i.e. "/v2${url.path}"
+
+	RewriteRequest    *hcl.Attribute `hcl:"rewrite_request"`    // a body template that replaces the proxied request body
+	CorrelationHeader *string        `hcl:"correlation_header"` // a header with an ID that is set, or passed along, and logged, i.e. "X-Correlation-ID"
+
+	_url       *url.URL
+	_violation func(error) // saves the contract violations with the reload errors
 }
 
 // MiddlewareHTTP is the middleware type
@@ -130,6 +357,13 @@ type TextBlock struct {
 	Data *hcl.Attribute `hcl:"data"`
 }
 
+// FragmentBlock holds a named body that can be templated
+// with the request values and put together into a response
+type FragmentBlock struct {
+	Name string         `hcl:"name,label"`
+	Body *hcl.Attribute `hcl:"body"`
+}
+
 // Route holds configurations for each HTTP path
 type Route struct {
 	Path  string      `hcl:"path,label"`
@@ -137,7 +371,12 @@ type Route struct {
 	CORS  *routeCORS  `hcl:"cors,block"`
 	Proxy *routeProxy `hcl:"proxy,block"`
 
-	Request []RequestHTTP `hcl:"request,block"`
+	Static *routeStatic `hcl:"static,block"` // serve files from a directory under the path
+	Matrix *routeMatrix `hcl:"matrix,block"` // method and status bodies, i.e. get = { "200" = "ok" }
+
+	Request   []RequestHTTP   `hcl:"request,block"`
+	OnNoMatch []ResponseHTTP  `hcl:"on_no_match,block"` // used in order when no request matches
+	Fragments []FragmentBlock `hcl:"fragment,block"`    // named bodies used with ${fragment("name")}
 
 	Plugins hcl.Body `hcl:",remain"`
 }
@@ -154,32 +393,128 @@ type RequestHTTP struct {
 			Loops *int           `hcl:"loops,optional"`
 		} `hcl:"limit,block"`
 	} `hcl:"ticker,block"`
-	Order string `hcl:"order,optional"`
-	Delay string `hcl:"delay,optional"`
+	Order  string   `hcl:"order,optional"`
+	Delay  string   `hcl:"delay,optional"`
+	States []string `hcl:"states,optional"`
+	FailOn []int    `hcl:"fail_on,optional"` // 1-based request counts that use the fail response
+
+	OrderKey string `hcl:"order_key,optional"` // keeps a response order for each value, i.e. "header.x-session-id"
+
+	LatencyProfile *latencyProfile `hcl:"latency_profile,block"` // a random delay for each request
+	DelayRamp      *delayRamp      `hcl:"delay_ramp,block"`      // a delay that grows with each request
+
+	Idempotency    bool    `hcl:"idempotency,optional"` // repeats of an Idempotency-Key header get the saved response
+	IdempotencyTTL *string `hcl:"idempotency_ttl"`      // how long a saved response is used, i.e. "24h"
+	MaxConcurrent  *int    `hcl:"max_concurrent"`       // requests over this many at the same time get a 503
+	Seed           *int64  `hcl:"seed"`                 // makes random orders and resets repeatable
+
+	RequireContentType *string `hcl:"require_content_type"` // other content types get a 415, i.e. "application/json"
+	MaxBody            *int64  `hcl:"max_body"`             // bodies over this many bytes get a 413
+
+	Fail *ResponseHTTP `hcl:"fail,block"`
+
+	MaxUses *uint64       `hcl:"max_uses"`   // requests after this many get the gone response
+	Gone    *ResponseHTTP `hcl:"gone,block"` // the response after max_uses, or a 410
 
 	JWT     *requestJWT       `hcl:"jwt,block"`
 	Headers *headers          `hcl:"header,block"`
+	Cookies *requestCookie    `hcl:"cookie,block"`
 	Posted  map[string]string `hcl:"post_values,optional"`
+	Script  *requestScript    `hcl:"script,block"`
+
+	ExactURI *string           `hcl:"exact_uri"`          // the request URI, with the query, as sent, i.e. "/search?q=a&page=1"
+	BodyJSON map[string]string `hcl:"body_json,optional"` // dotted JSON body paths and values, i.e. { "user.role" = "admin" }
+
+	HTTPVersion *string `hcl:"http_version"` // the request protocol version, i.e. "1.1" or "2"
 
-	Response []ResponseHTTP `hcl:"response,block"`
+	SignedCookies []string `hcl:"signed_cookies,optional"` // cookies that must have a valid signature, others get a 401
+
+	JSONRPC *requestJSONRPC `hcl:"jsonrpc,block"` // matches a JSON-RPC 2.0 method, the response body is sent as the result
+
+	Response     []ResponseHTTP `hcl:"response,block"`
+	OnInvalidJWT []ResponseHTTP `hcl:"on_invalid_jwt,block"` // used in order when the JWT can not be decoded
 
 	Plugins hcl.Body `hcl:",remain"`
 
-	seed int64
-	rand *rand.Rand
+	seed   int64
+	rand   *rand.Rand
+	failOn map[uint64]struct{}
+	key    string // used to keep the response order across reloads
+
+	fragments    []FragmentBlock // from the route
+	onInvalidJWT http.Handler    // the on_invalid_jwt responses
+}
+
+// latencyProfile holds the percentile delays that
+// each request delay is randomly picked from
+type latencyProfile struct {
+	P50 string `hcl:"p50"`
+	P95 string `hcl:"p95"`
+	P99 string `hcl:"p99"`
+}
+
+// delayRamp holds how much the delay grows with each
+// request, the delay starts at 0 and stops at the cap
+type delayRamp struct {
+	Step string `hcl:"step"`
+	Cap  string `hcl:"cap"`
 }
 
 // ResponseHTTP holds HTTP response options
 type ResponseHTTP struct {
 	Status  string         `hcl:"status,label"`
+	State   string         `hcl:"state,optional"`
 	Headers *headers       `hcl:"header,block"`
 	JWT     *responseJWT   `hcl:"jwt,block"`
 	Body    *hcl.Attribute `hcl:"body"`
 	PubKey  *string        `hcl:"hpkp"`
 
+	MergePatch *hcl.Attribute `hcl:"merge_patch"` // the base JSON object the request body is merged into
+	Download   *hcl.Attribute `hcl:"download"`    // the filename used in the Content-Disposition header
+	Reset      *float64       `hcl:"reset"`       // the probability, 0 to 1, of closing the connection without a response
+
+	CorruptRate *float64 `hcl:"corrupt_rate"` // the probability, 0 to 1, of truncating the body to a random length
+
+	BodyYAML  *hcl.Attribute `hcl:"body_yaml"`           // a YAML body that is sent as JSON
+	ServeYAML bool           `hcl:"serve_yaml,optional"` // send the body_yaml as YAML instead of JSON
+
+	EchoHeaders bool    `hcl:"echo_headers,optional"` // the body is a JSON object of the request headers
+	Reason      *string `hcl:"reason"`                // a custom status reason phrase, i.e. "Enhance Your Calm"
+
+	RawHeaders []string `hcl:"raw_headers,optional"` // headers sent in order without changing the case, i.e. ["x-request-id: 1"]
+
+	CloseConnection bool `hcl:"close_connection,optional"` // send Connection: close and close the connection after the response
+
+	JSONRPCError *responseJSONRPCError `hcl:"jsonrpc_error,block"` // a JSON-RPC error envelope instead of the result
+
+	MinCompressSize *int `hcl:"min_compress_size"` // gzip bodies of at least this many bytes when the client accepts gzip
+	Chunked         bool `hcl:"chunked,optional"`  // send the body with chunked transfer encoding, without a Content-Length
+
+	ConnectDelay  *string `hcl:"connect_delay"`  // a delay before the response is started, i.e. "50ms"
+	TTFBDelay     *string `hcl:"ttfb_delay"`     // a delay before the first byte (the headers) is sent
+	TransferDelay *string `hcl:"transfer_delay"` // a delay that is spread across sending the body
+
+	SignedCookie []responseSignedCookie `hcl:"signed_cookie,block"` // cookies signed with the server cookie_secret
+
+	BodyFile *string `hcl:"body_file"` // a file in the runtime path that is streamed as the body, it can't have a reason or raw_headers
+
 	Plugins hcl.Body `hcl:",remain"`
 }
 
+// responseSignedCookie holds a cookie that is sent with
+// an HMAC signature so that it can be verified later
+type responseSignedCookie struct {
+	Name  string         `hcl:"name,label"`
+	Value *hcl.Attribute `hcl:"value"`
+}
+
+// responseJSONRPCError holds the error object of a JSON-RPC error response
+type responseJSONRPCError struct {
+	Code    int            `hcl:"code"`
+	Message string         `hcl:"message"`
+	Data    *hcl.Attribute `hcl:"data"`
+}
+
 // routeCORS holds options for CORS within a route (or path)
 type routeCORS struct {
 	AllowOrigin      string   `hcl:"allow_origin,label"`
@@ -199,9 +534,28 @@ type requestJWT struct {
 	Validate *bool  `hcl:"validate"`
 	Prefix   string `hcl:"prefix,optional"`
 
+	Contains *hcl.Attribute `hcl:"contains"` // claims (i.e. scope or roles) that must contain the values
+
 	KeyVals map[string]*hcl.Attribute `hcl:",remain"` // key value pairs to match on
 }
 
+// requestCookie holds the cookies, and values, that a
+// request must have, a "*" value matches any value
+type requestCookie struct {
+	Data map[string]string `hcl:",remain"`
+}
+
+// requestJSONRPC holds the JSON-RPC 2.0 method that the request body must call
+type requestJSONRPC struct {
+	Method string `hcl:"method"`
+}
+
+// requestScript holds the values that are evaluated, in the order
+// they are written, before the response is sent
+type requestScript struct {
+	Vars map[string]*hcl.Attribute `hcl:",remain"`
+}
+
 // responseJWT hold configurations for how JWTs can be used
 // during the HTTP response process
 type responseJWT struct {
@@ -225,7 +579,61 @@ type responseJWT struct {
 
 // routeProxy holds configurations for Proxy servers that
 // can be used during the routing process
+// routeStatic holds the directory that static
+// files are served from for a route
+type routeStatic struct {
+	Dir            string `hcl:"dir,label"`
+	DisableListing bool   `hcl:"disable_listing,optional"`
+}
+
+// routeMatrix holds a table of statuses and bodies for each method,
+// where each method is expanded into a request with a response for
+// each status, used in the order they are written
+type routeMatrix struct {
+	Methods hcl.Attributes `hcl:",remain"`
+}
+
+// requests expands the matrix into requests, sorted by method
+func (m routeMatrix) requests() ([]RequestHTTP, error) {
+	var methods []string
+	for method := range m.Methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	var reqs = make([]RequestHTTP, 0, len(methods))
+	for _, method := range methods {
+		pairs, dia := hcl.ExprMap(m.Methods[method].Expr)
+		if dia.HasErrors() {
+			return nil, ErrMatrixParse.F(method, dia)
+		}
+
+		req := RequestHTTP{Method: method, Plugins: hcl.EmptyBody()}
+		for _, pair := range pairs {
+			key, dia := pair.Key.Value(nil)
+			if dia.HasErrors() {
+				return nil, ErrMatrixParse.F(method, dia)
+			}
+			status, err := ctyconvert.Convert(key, cty.String)
+			if err != nil || status.IsNull() {
+				return nil, ErrMatrixParse.F(method, err)
+			}
+
+			req.Response = append(req.Response, ResponseHTTP{
+				Status:  status.AsString(),
+				Body:    &hcl.Attribute{Name: "body", Expr: pair.Value, Range: pair.Value.Range()},
+				Plugins: hcl.EmptyBody(),
+			})
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
 type routeProxy struct {
 	Name    string   `hcl:"name,label"`
 	Headers *headers `hcl:"headers,block"`
+
+	StripPrefix *string        `hcl:"strip_prefix"` // used instead of the server proxy strip_prefix
+	Rewrite     *hcl.Attribute `hcl:"rewrite"`      // used instead of the server proxy rewrite
 }
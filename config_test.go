@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	var tests = []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			name: "valid",
+			src: `
+http "test" {
+	proxy "upstream" { url = "http://localhost:8080" }
+	jwt "auth" { algo = "HS256" }
+}
+path "/proxy" {
+	request "get" {
+		response "upstream" {}
+	}
+}
+path "/jwt" {
+	request "get" {
+		jwt "auth" "header" "Authorization" {}
+		response "200" {
+			jwt "auth" "header" "X-Token" {}
+		}
+	}
+}`,
+		},
+		{
+			name: "dangling proxy",
+			src: `
+http "test" {
+	proxy "upstream" { url = "http://localhost:8080" }
+}
+path "/proxy" {
+	request "get" {
+		response "upstreem" {}
+	}
+}`,
+			want: []string{`Unknown proxy; The path "/proxy" uses the proxy "upstreem"`},
+		},
+		{
+			name: "dangling jwt",
+			src: `
+http "test" {
+	jwt "auth" { algo = "HS256" }
+}
+path "/jwt" {
+	request "get" {
+		response "200" {
+			jwt "other" "header" "X-Token" {}
+		}
+	}
+}`,
+			want: []string{`Unknown JWT; The path "/jwt" uses the JWT "other"`},
+		},
+		{
+			name: "request header variables",
+			src: `
+path "/headers" {
+	request "get" {
+		header { X-Id = "${query.id}" }
+		response "200" {
+			header { X-Id = "${query.id}" }
+		}
+	}
+}`,
+			want: []string{`Variables not allowed`},
+		},
+		{
+			name: "cors credentials with any origin",
+			src: `
+path "/cors" {
+	cors "*" { allow_credentials = true }
+	request "get" {
+		response "200" {}
+	}
+}`,
+			want: []string{`Invalid CORS; The path "/cors" allows credentials with the "*" origin`},
+		},
+		{
+			name: "body file with a reason",
+			src: `
+path "/file" {
+	request "get" {
+		response "200" {
+			body_file = "fixtures/big.json"
+			reason    = "Fine"
+		}
+	}
+}`,
+			want: []string{`Invalid body_file; The path "/file" streams the body file "fixtures/big.json"`},
+		},
+		{
+			name: "max concurrent below one",
+			src: `
+path "/zero" {
+	request "get" {
+		max_concurrent = 0
+		response "200" {}
+	}
+}
+path "/negative" {
+	request "get" {
+		max_concurrent = -1
+		response "200" {}
+	}
+}`,
+			want: []string{
+				`Invalid max_concurrent; The path "/zero" has a max_concurrent of 0`,
+				`Invalid max_concurrent; The path "/negative" has a max_concurrent of -1`,
+			},
+		},
+		{
+			name: "cors credentials with an origin",
+			src: `
+path "/cors" {
+	cors "https://app.example.com" { allow_credentials = true }
+	request "get" {
+		response "200" {}
+	}
+}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var config Config
+			if err := decode([]string{"test.hcl"}, [][]byte{[]byte(test.src)}, _context(), &config); err != nil {
+				t.Fatal(err)
+			}
+
+			diags := validateConfig(config)
+			if len(diags) != len(test.want) {
+				t.Fatalf("have: %v want: %v", diags, test.want)
+			}
+			for i, want := range test.want {
+				if have := diags[i].Error(); !strings.Contains(have, want) {
+					t.Errorf("\nhave: %s\nwant: %s", have, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/spf13/afero"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// RedactedValue replaces the secret values in the config source
+var RedactedValue = "REDACTED"
+
+// redactedAttrs are the attribute names that hold secrets, the
+// key attribute is only a secret in a ssl block
+var redactedAttrs = map[string]struct{}{
+	"secret":        {},
+	"password":      {},
+	"private_key":   {},
+	"cookie_secret": {},
+	"ca_key":        {},
+}
+
+// redactBody replaces the secret attribute values of the body and the
+// nested blocks, so the formatting and comments are kept
+func redactBody(blockType string, body *hclwrite.Body) {
+	for name := range body.Attributes() {
+		if _, ok := redactedAttrs[name]; ok || (blockType == "ssl" && name == "key") {
+			body.SetAttributeValue(name, cty.StringVal(RedactedValue))
+		}
+	}
+	for _, block := range body.Blocks() {
+		redactBody(block.Type(), block.Body())
+	}
+}
+
+// configSource returns the HCL source of all of the config files one
+// after the other with the secrets redacted. JSON config files are left
+// out, as they can't be added to HCL.
+func configSource(fs afero.Fs, files []string) ([]byte, error) {
+	filenames, err := configFilenames(files)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, filename := range filenames {
+		if strings.ToLower(filepath.Ext(filename)) != ".hcl" {
+			fmt.Fprintf(&buf, "# %s is not HCL and is left out\n\n", filename)
+			continue
+		}
+
+		src, err := afero.ReadFile(fs, filename)
+		if err != nil {
+			return nil, err
+		}
+
+		file, dia := hclwrite.ParseConfig(src, filename, hcl.Pos{Line: 1, Column: 1})
+		if dia.HasErrors() {
+			return nil, dia
+		}
+		redactBody("", file.Body())
+
+		fmt.Fprintf(&buf, "# %s\n", filename)
+		buf.Write(bytes.TrimSpace(file.Bytes()))
+		buf.WriteString("\n\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// configSourceHandler serves the loaded config files as HCL
+func configSourceHandler(fs afero.Fs, files []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		src, err := configSource(fs, files)
+		if log.OnErr(err).Printf("[config] reading the config source: %v", err).HasErr() {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(src)
+	}
+}
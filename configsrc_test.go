@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestConfigSource(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "server.hcl", []byte(`
+http "test" {
+    host = ":8080"
+    cookie_secret = "s3cr3t"  # signs the cookies
+    basic_auth {
+        username = "admin"
+        password = "hunter2"
+    }
+    ssl {
+        key = "ssl-key"
+    }
+    jwt "auth" {
+        algo   = "HS256"
+        secret = "jwt-secret"
+    }
+}
+`), 0644)
+	afero.WriteFile(fs, "routes.hcl", []byte(`
+path "/ping" {
+    request "get" {
+        response "200" { body = "pong" }
+    }
+}
+`), 0644)
+	afero.WriteFile(fs, "more.json", []byte(`{}`), 0644)
+
+	w := httptest.NewRecorder()
+	configSourceHandler(fs, []string{"server.hcl", "routes.hcl", "more.json"}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_internal/config.hcl", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("have: %d want: %d", w.Code, http.StatusOK)
+	}
+
+	src := w.Body.String()
+	for _, secret := range []string{"s3cr3t", "hunter2", "ssl-key", "jwt-secret"} {
+		if strings.Contains(src, secret) {
+			t.Errorf("have: %q in the source want: %q", secret, RedactedValue)
+		}
+	}
+	for _, want := range []string{`username = "admin"`, "# signs the cookies", `body = "pong"`, "# more.json"} {
+		if !strings.Contains(src, want) {
+			t.Errorf("have: %q want: %q", src, want)
+		}
+	}
+
+	var config Config
+	if err := decode([]string{"config.hcl"}, [][]byte{[]byte(src)}, _context(), &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Servers) != 1 || len(config.Routes) != 1 {
+		t.Fatalf("have: %d servers %d routes want: 1 server 1 route", len(config.Servers), len(config.Routes))
+	}
+	if have := *config.Servers[0].CookieSecret; have != RedactedValue {
+		t.Errorf("have: %q want: %q", have, RedactedValue)
+	}
+}
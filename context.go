@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	stdjson "encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,6 +24,17 @@ import (
 )
 
 func decodeFile(filenames []string, ctx *hcl.EvalContext, target interface{}) error {
+	filenames, err := configFilenames(filenames)
+	if err != nil {
+		return hcl.Diagnostics{
+			{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to read configuration directory",
+				Detail:   err.Error(),
+			},
+		}
+	}
+
 	var srcs = make([][]byte, len(filenames))
 
 	for i, filename := range filenames {
@@ -48,6 +63,40 @@ func decodeFile(filenames []string, ctx *hcl.EvalContext, target interface{}) er
 	return decode(filenames, srcs, ctx, target)
 }
 
+// isConfigFile returns true for the file types that can be decoded
+func isConfigFile(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".hcl", ".json":
+		return true
+	}
+	return false
+}
+
+// configFilenames returns the config files with any directory
+// replaced by the .hcl and .json files that are in it, sorted
+// by name so the files always merge in the same order
+func configFilenames(paths []string) ([]string, error) {
+	var filenames []string
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil || !fi.IsDir() {
+			filenames = append(filenames, path) // missing files are reported by the decode
+			continue
+		}
+
+		infos, err := ioutil.ReadDir(path) // sorted by filename
+		if err != nil {
+			return nil, fmt.Errorf("Can't read %s: %s.", path, err)
+		}
+		for _, info := range infos {
+			if !info.IsDir() && isConfigFile(info.Name()) {
+				filenames = append(filenames, filepath.Join(path, info.Name()))
+			}
+		}
+	}
+	return filenames, nil
+}
+
 func decode(filenames []string, srcs [][]byte, ctx *hcl.EvalContext, target interface{}) error {
 	var file *hcl.File
 	var files []*hcl.File
@@ -93,18 +142,8 @@ func _context() *hcl.EvalContext {
 
 	var ctx = &hcl.EvalContext{
 		Functions: map[string]function.Function{
-			"env": function.New(&function.Spec{
-				Params: []function.Parameter{
-					{
-						Name: "var",
-						Type: cty.String,
-					},
-				},
-				Type: function.StaticReturnType(cty.String),
-				Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
-					return cty.StringVal(os.Getenv(args[0].AsString())), nil
-				},
-			}),
+			"env":      EnvToStr,
+			"must_env": MustEnvToStr,
 			"param": function.New(&function.Spec{
 				Params: []function.Parameter{
 					{
@@ -150,7 +189,8 @@ var fileEvalCtx = hcl.EvalContext{
 var bodyEvalCtx = hcl.EvalContext{
 	Variables: map[string]cty.Value{},
 	Functions: map[string]function.Function{
-		"file": FileToStr("body", "ctx"),
+		"file":       FileToStr("body", "ctx"),
+		"file_lines": FileLinesToStr("body", "ctx"),
 	},
 }
 
@@ -176,8 +216,9 @@ func jwtEvalCtx(name, key string, vars map[string]map[string]cty.Value) *hcl.Eva
 }
 
 // TextBlockToStr takes in a textblock and return the
-// data with args filled in
-func TextBlockToStr(texts []TextBlock) function.Function {
+// data with args filled in. When strict is set a missing
+// text block is an error rather than an empty string.
+func TextBlockToStr(texts []TextBlock, strict bool) function.Function {
 	return function.New(&function.Spec{
 		Params: []function.Parameter{
 			{
@@ -218,11 +259,50 @@ func TextBlockToStr(texts []TextBlock) function.Function {
 					}
 				}
 			}
+			if strict {
+				return cty.StringVal(""), ErrTextBlockNotFound.F(args[0].AsString())
+			}
 			return cty.StringVal(""), nil
 		},
 	})
 }
 
+// FragmentToStr takes in the fragment blocks and returns a HCL function that
+// will return the named fragment body. The body uses the same variables and
+// functions as the response body, which are only known when it is called.
+func FragmentToStr(fragments []FragmentBlock, evalCtx func() *hcl.EvalContext) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{
+				Name: "name",
+				Type: cty.String,
+			},
+		},
+		Type: function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+			for _, frag := range fragments {
+				if frag.Name != args[0].AsString() || frag.Body == nil {
+					continue
+				}
+				if tmpl, ok := frag.Body.Expr.(*hclsyntax.TemplateExpr); ok {
+					templateIndexes(tmpl)
+				}
+
+				val, dia := frag.Body.Expr.Value(evalCtx())
+				if dia.HasErrors() {
+					return cty.StringVal(""), fmt.Errorf("fragment block: %v", dia)
+				}
+				if val.Type() == cty.String {
+					return val, nil
+				}
+				b, err := ctyjson.SimpleJSONValue{Value: val}.MarshalJSON()
+				return cty.StringVal(string(b)), err
+			}
+			return cty.StringVal(""), fmt.Errorf("fragment block: %q not found", args[0].AsString())
+		},
+	})
+}
+
 // DurToStr takes a tiem duration and returns a
 // unix timestamp of the duration from time.Now()
 var DurToStr = function.New(&function.Spec{
@@ -262,9 +342,7 @@ func FileToStr(name string, key string) function.Function {
 		},
 		Type: function.StaticReturnType(cty.String),
 		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
-			// trim leading dots and slashes so we can't do some bad things.
-			filepath := filepath.Join(_runtimePath, strings.TrimLeft(args[0].AsString(), `.`+string(filepath.Separator)))
-			f, err := fileToStrOpen(name, key, filepath)
+			f, err := fileToStrOpen(name, key, runtimeFilePath(args[0].AsString()))
 			if err != nil {
 				log.Fatal("expr file open:", err)
 			}
@@ -279,6 +357,107 @@ func FileToStr(name string, key string) function.Function {
 	})
 }
 
+// runtimeFilePath returns the filename within the runtime path
+func runtimeFilePath(filename string) string {
+	// trim leading dots and slashes so we can't do some bad things.
+	return filepath.Join(_runtimePath, strings.TrimLeft(filename, `.`+string(filepath.Separator)))
+}
+
+// FileLinesToStr takes in a name, key (used during testing) and returns a HCL
+// function that will return count lines of a file, from the 1-based start line
+func FileLinesToStr(name string, key string) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{
+				Name: "filename",
+				Type: cty.String,
+			},
+			{
+				Name: "start",
+				Type: cty.Number,
+			},
+			{
+				Name: "count",
+				Type: cty.Number,
+			},
+		},
+		Type: function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+			start, _ := args[1].AsBigFloat().Int64()
+			count, _ := args[2].AsBigFloat().Int64()
+			if start < 1 || count < 0 {
+				return cty.StringVal(""), fmt.Errorf("file lines: the start must be 1 or more, and count 0 or more")
+			}
+
+			f, err := fileToStrOpen(name, key, runtimeFilePath(args[0].AsString()))
+			if err != nil {
+				return cty.StringVal(""), fmt.Errorf("file lines open: %v", err)
+			}
+			defer f.Close()
+
+			var lines []string
+			scanner := bufio.NewScanner(f)
+			for n := int64(1); scanner.Scan() && n < start+count; n++ {
+				if n >= start {
+					lines = append(lines, scanner.Text())
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				return cty.StringVal(""), fmt.Errorf("file lines read: %v", err)
+			}
+
+			return cty.StringVal(strings.Join(lines, "\n")), nil
+		},
+	})
+}
+
+// EnvToStr takes in the name of an environment
+// variable and returns the value of it, or the
+// optional default when the variable is not set
+var EnvToStr = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{
+			Name: "var",
+			Type: cty.String,
+		},
+	},
+	VarParam: &function.Parameter{
+		Name: "default",
+		Type: cty.String,
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		if len(args) > 2 {
+			return cty.StringVal(""), fmt.Errorf("env takes one default, have %d", len(args)-1)
+		}
+		val, ok := os.LookupEnv(args[0].AsString())
+		if !ok && len(args) == 2 {
+			val = args[1].AsString()
+		}
+		return cty.StringVal(val), nil
+	},
+})
+
+// MustEnvToStr takes in the name of an environment variable
+// and returns the value of it, a variable that is not set or
+// is empty is an error, so a typo doesn't become an empty value
+var MustEnvToStr = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{
+			Name: "var",
+			Type: cty.String,
+		},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		name := args[0].AsString()
+		if val := os.Getenv(name); val != "" {
+			return cty.StringVal(val), nil
+		}
+		return cty.StringVal(""), fmt.Errorf("the %q environment variable is not set", name)
+	},
+})
+
 // NowToStr returns the current time as a int64 unix time
 var NowToStr = function.New(&function.Spec{
 	Params: []function.Parameter{},
@@ -310,3 +489,111 @@ var UnixTsToStr = function.New(&function.Spec{
 		return cty.StringVal(fmt.Sprintf("%d", a.Unix())), nil
 	},
 })
+
+// URLEncodeToStr takes in a string and returns it escaped
+// so it can be used as a URL query value
+var URLEncodeToStr = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{
+			Name: "str",
+			Type: cty.String,
+		},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		return cty.StringVal(url.QueryEscape(args[0].AsString())), nil
+	},
+})
+
+// URLDecodeToStr takes in an escaped URL query value
+// and returns the unescaped string
+var URLDecodeToStr = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{
+			Name: "str",
+			Type: cty.String,
+		},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		str, err := url.QueryUnescape(args[0].AsString())
+		if err != nil {
+			return cty.StringVal(""), ErrURLDecode.F(args[0].AsString(), err)
+		}
+		return cty.StringVal(str), nil
+	},
+})
+
+// JSONPointerToStr takes in a JSON string and a JSON Pointer (RFC 6901)
+// and returns the value that is pointed to. Strings are returned as-is
+// all other values are returned as a JSON string.
+var JSONPointerToStr = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{
+			Name: "json",
+			Type: cty.String,
+		},
+		{
+			Name: "pointer",
+			Type: cty.String,
+		},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		ptr := args[1].AsString()
+
+		var doc interface{}
+		dec := stdjson.NewDecoder(strings.NewReader(args[0].AsString()))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return cty.StringVal(""), ErrJSONPointer.F(ptr, err)
+		}
+
+		val, err := jsonPointer(doc, ptr)
+		if err != nil {
+			return cty.StringVal(""), ErrJSONPointer.F(ptr, err)
+		}
+
+		if str, ok := val.(string); ok {
+			return cty.StringVal(str), nil
+		}
+		b, err := stdjson.Marshal(val)
+		if err != nil {
+			return cty.StringVal(""), ErrJSONPointer.F(ptr, err)
+		}
+		return cty.StringVal(string(b)), nil
+	},
+})
+
+// jsonPointer walks the decoded JSON document using each
+// of the reference tokens in the pointer
+func jsonPointer(doc interface{}, ptr string) (interface{}, error) {
+	if ptr == "" {
+		return doc, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("must start with a /")
+	}
+
+	unescape := strings.NewReplacer("~1", "/", "~0", "~")
+	for _, token := range strings.Split(ptr[1:], "/") {
+		token = unescape.Replace(token)
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			val, ok := v[token]
+			if !ok {
+				return nil, fmt.Errorf("key %q not found", token)
+			}
+			doc = val
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(v) || (len(token) > 1 && token[0] == '0') {
+				return nil, fmt.Errorf("index %q not found", token)
+			}
+			doc = v[i]
+		default:
+			return nil, fmt.Errorf("token %q can not be used on a value", token)
+		}
+	}
+	return doc, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ProxyModeContract proxies to the upstream and checks that the
+// responses match the proxy expect block, the contract mode
+const ProxyModeContract = "contract"
+
+// proxyExpect is what the upstream responses are expected to look
+// like when the proxy is in the contract mode
+type proxyExpect struct {
+	Status      []int    `hcl:"status,optional"`   // the allowed status codes, i.e. [200, 201]
+	ContentType *string  `hcl:"content_type"`      // the media type without parameters, i.e. "application/json"
+	Required    []string `hcl:"required,optional"` // the fields that must be in the JSON object body
+}
+
+// decodeBody returns the body decoded with the content encoding, ok is false
+// when the encoding isn't one that can be decoded, i.e. "br"
+func decodeBody(encoding string, body []byte) (decoded []byte, ok bool, err error) {
+	var rd io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, true, nil
+	case "gzip", "x-gzip":
+		if rd, err = gzip.NewReader(bytes.NewReader(body)); err != nil {
+			return nil, true, err
+		}
+	case "deflate": // servers send zlib wrapped or raw deflate data
+		if rd, err = zlib.NewReader(bytes.NewReader(body)); err != nil {
+			rd, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return nil, false, nil
+	}
+	decoded, err = ioutil.ReadAll(rd)
+	return decoded, true, err
+}
+
+// contractViolations returns the ways the response doesn't match the expect
+// block. The body is read for the required fields and restored for the client,
+// a body with a content encoding that can't be decoded isn't checked for fields.
+func contractViolations(res *http.Response, expect *proxyExpect) ([]string, error) {
+	var violations []string
+	if expect == nil {
+		return violations, nil
+	}
+
+	if len(expect.Status) > 0 {
+		var found bool
+		for _, status := range expect.Status {
+			found = found || status == res.StatusCode
+		}
+		if !found {
+			violations = append(violations, fmt.Sprintf("status %d is not one of %v", res.StatusCode, expect.Status))
+		}
+	}
+
+	if expect.ContentType != nil {
+		mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if err != nil || !strings.EqualFold(mediaType, *expect.ContentType) {
+			violations = append(violations, fmt.Sprintf("content type %q is not %q", res.Header.Get("Content-Type"), *expect.ContentType))
+		}
+	}
+
+	if len(expect.Required) == 0 {
+		return violations, nil
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return violations, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	encoding := res.Header.Get("Content-Encoding")
+	body, ok, err := decodeBody(encoding, body)
+	if !ok {
+		log.Printf("[http] [proxy] [contract] skipping the required fields for the %q encoded body ...", encoding)
+		return violations, nil
+	}
+	if err != nil {
+		return append(violations, fmt.Sprintf("the %q encoded body can't be decoded", encoding)), nil
+	}
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(body, &object); err != nil {
+		return append(violations, "the body is not a JSON object"), nil
+	}
+	for _, field := range expect.Required {
+		if _, ok := object[field]; !ok {
+			violations = append(violations, "the body is missing the "+strconv.Quote(field)+" field")
+		}
+	}
+	return violations, nil
+}
+
+// contractProxy returns a ReverseProxy ModifyResponse func that checks the
+// upstream response against the proxy expect block. Violations are logged
+// and saved with the reload errors, the client still gets the response.
+func contractProxy(proxy *configProxy) func(*http.Response) error {
+	return func(res *http.Response) error {
+		violations, err := contractViolations(res, proxy.Expect)
+		if err != nil {
+			return err
+		}
+		if len(violations) == 0 {
+			return nil
+		}
+
+		err = ErrProxyContract.F(proxy.Name, res.Request.Method, res.Request.URL.Path, strings.Join(violations, "; "))
+		log.Printf("[http] [proxy] [contract] %v", err)
+		if proxy._violation != nil {
+			proxy._violation(err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// CtxKeyCookieSecret is the context key that holds the server secret used to sign cookies
+const CtxKeyCookieSecret ctxKey = "_cookie_secret_"
+
+// signCookie returns the cookie value with an HMAC signature of the
+// name and value appended, i.e. value.signature
+func signCookie(secret []byte, name, value string) string {
+	return value + "." + cookieSignature(secret, name, value)
+}
+
+// verifyCookie returns the value of a signed cookie, false is
+// returned when the value has been tampered with
+func verifyCookie(secret []byte, name, signed string) (string, bool) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+
+	value, sig := signed[:i], signed[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(cookieSignature(secret, name, value))) {
+		return "", false
+	}
+	return value, true
+}
+
+// cookieSignature signs the name with the value, so that a
+// signed value can't be moved to a different cookie
+func cookieSignature(secret []byte, name, value string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(name + "=" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
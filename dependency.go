@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+)
+
+// the dependency states, a dependency that has
+// not been set is always healthy
+const (
+	DependencyHealthy   = "healthy"
+	DependencyUnhealthy = "unhealthy"
+)
+
+// dependencies holds the state of each named dependency, it is
+// shared by all routes (and kept across reloads) so that one
+// failing dependency can be seen by every route that uses it
+var dependencies = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// dependencyState returns the state of the named dependency
+func dependencyState(name string) string {
+	dependencies.RLock()
+	defer dependencies.RUnlock()
+
+	if state, ok := dependencies.m[name]; ok {
+		return state
+	}
+	return DependencyHealthy
+}
+
+// setDependencyState sets the state of the named dependency
+func setDependencyState(name, state string) {
+	dependencies.Lock()
+	defer dependencies.Unlock()
+
+	dependencies.m[name] = state
+}
+
+// DependencyToStr returns the state of the named dependency,
+// i.e. %{ if dependency("db") == "unhealthy" }...%{ endif }
+var DependencyToStr = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{
+			Name: "name",
+			Type: cty.String,
+		},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		return cty.StringVal(dependencyState(args[0].AsString())), nil
+	},
+})
+
+// dependencyHandler sets the state of the named dependency from
+// the body of the request, which is "healthy" or "unhealthy"
+func dependencyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<10))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch state := strings.ToLower(strings.TrimSpace(string(b))); state {
+		case DependencyHealthy, DependencyUnhealthy:
+			log.Printf("[dependency] %s is %s ...", name, state)
+			setDependencyState(name, state)
+		default:
+			http.Error(w, `the state must be "healthy" or "unhealthy"`, http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// dependenciesHandler returns the state of all of the dependencies that have been set
+func dependenciesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dependencies.RLock()
+		b, err := json.Marshal(dependencies.m)
+		dependencies.RUnlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+func TestDependencyCascade(t *testing.T) {
+	defer setDependencyState("db", DependencyHealthy)
+
+	req := RequestHTTP{
+		Method: "get",
+		Response: []ResponseHTTP{
+			{Status: "200", Body: attr(`%{ if dependency("db") == "healthy" }ok%{ else }degraded%{ endif }`)},
+		},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+	hdl.Put("/_internal/dependency/{name}", dependencyHandler())
+
+	var tests = []struct {
+		name   string
+		state  string
+		status int
+		want   string
+	}{
+		{name: "not set", want: "ok"},
+		{name: "unhealthy", state: "unhealthy", status: http.StatusNoContent, want: "degraded"},
+		{name: "healthy again", state: "healthy", status: http.StatusNoContent, want: "ok"},
+		{name: "unknown state", state: "sideways", status: http.StatusBadRequest, want: "ok"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.state != "" {
+				rec := httptest.NewRecorder()
+				hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/_internal/dependency/db", strings.NewReader(test.state)))
+				if rec.Code != test.status {
+					t.Errorf("have: %d want: %d", rec.Code, test.status)
+				}
+			}
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/test", nil))
+			if have := rec.Body.String(); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
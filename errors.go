@@ -26,12 +26,34 @@ const (
 	ErrGenKey              StdError = "failed generating key: %v"
 	ErrCreateX590Cert      StdError = "failed creating a x509 certificate: %v"
 	ErrLoadX509            StdError = "failed loading a x509 ca key pair: %v"
+	ErrLoadClientCA        StdError = "failed loading the client ca %q: %v"
 	ErrCreateTLSCert       StdError = "failed creating tls cert: %v"
 	ErrMarshalPrivKey      StdError = "failed marshaling private key: %v"
 	ErrMarshalPubKey       StdError = "failed marshaling public key: %v"
 	ErrOrderIndexParse     StdError = "failed parsing the order index to a valid number: %v"
 	ErrReadRequestBody     StdError = "failed reading the request body: %v"
 	ErrMarshalJWT          StdError = "failed parsing the JWT: %v"
+	ErrAMQPConnect         StdError = "failed connecting to AMQP: %v"
+	ErrWebhookSend         StdError = "failed sending the webhook: %v"
+	ErrReadFixture         StdError = "failed reading the fixtures: %v"
+	ErrScriptStatusParse   StdError = "failed parsing the script status to a valid number: %v"
+	ErrGRPCProtoset        StdError = "failed loading the gRPC protoset: %v"
+	ErrGRPCListen          StdError = "failed listening for gRPC: %v"
+	ErrGRPCMethod          StdError = "failed finding the gRPC method %s in the protoset"
+	ErrGRPCTranscode       StdError = "failed transcoding the gRPC response: %v"
+	ErrGRPCStatus          StdError = "failed parsing the gRPC status %q: %v"
+	ErrMergePatch          StdError = "failed applying the merge patch: %v"
+	ErrJSONPointer         StdError = "failed resolving the JSON pointer %q: %v"
+	ErrHostParse           StdError = "failed parsing the %q server host: %v"
+	ErrYAMLBody            StdError = "failed parsing the YAML body: %v"
+	ErrTextBlockNotFound   StdError = "failed finding the text block %q"
+	ErrURLDecode           StdError = "failed URL decoding %q: %v"
+	ErrRequestBodyTooLarge StdError = "failed reading the request body: it is over %d bytes"
+	ErrMatrixParse         StdError = "failed parsing the %q matrix method: %v"
+	ErrBodyFile            StdError = "failed opening the body file %q: %v"
+	ErrProxyMode           StdError = "failed finding the %q proxy mode, use passthrough, record, replay or contract"
+	ErrProxyUpstream       StdError = "failed proxying to the %q upstream: %v"
+	ErrProxyContract       StdError = "failed the %q upstream contract for %s %s: %s"
 
 	ErrFilterFailed StdError = "failed filtering %s: %v"
 
@@ -39,6 +61,8 @@ const (
 	ErrInvalidJWTClaim          StdError = "invalid JWT claim"
 	ErrInvalidJWTLoc            StdError = "invalid JWT %s location"
 	ErrInvalidAuth              StdError = "invalid authorization"
+	ErrCookieSecretNotFound     StdError = "cookie secret not found in the context"
+	ErrInvalidSignedCookie      StdError = "invalid signed cookie %q"
 )
 
 // StdError is a standard error.
@@ -96,6 +120,24 @@ func (e StdError) F401(v ...interface{}) error {
 	return Ext401Error{e.F(v...).(ExtError)}
 }
 
+// F413 returns the formatted error with the
+// values filled in and wraped in a Ext413Error
+// that should be used to set the HTTP status
+// code (and standard display) for this type
+// of error
+func (e StdError) F413(v ...interface{}) error {
+	return Ext413Error{e.F(v...).(ExtError)}
+}
+
+// F502 returns the formatted error with the
+// values filled in and wraped in a Ext502Error
+// that should be used to set the HTTP status
+// code (and standard display) for this type
+// of error
+func (e StdError) F502(v ...interface{}) error {
+	return Ext502Error{e.F(v...).(ExtError)}
+}
+
 // F404 returns the formatted error with the
 // values filled in and wraped in a Ext404Error
 // that should be used to set the HTTP status
@@ -188,13 +230,41 @@ func (e Ext401Error) ErrorResponseWriter(w http.ResponseWriter, r *http.Request)
 	return true
 }
 
+// Ext413Error is a type to determine a 413 Request Entity Too Large error response
+type Ext413Error struct{ error }
+
+// ErrorResponseWriter satisfies the interface that lets this error return a
+// valid HTTP response for the error recieved
+func (e Ext413Error) ErrorResponseWriter(w http.ResponseWriter, r *http.Request) bool {
+	http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+	log.Error(e.error)
+	return true
+}
+
+// Ext502Error is a type to determine a 502 Bad Gateway error response
+type Ext502Error struct{ error }
+
+// ErrorResponseWriter satisfies the interface that lets this error return a
+// valid HTTP response for the error recieved
+func (e Ext502Error) ErrorResponseWriter(w http.ResponseWriter, r *http.Request) bool {
+	http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+	log.Error(e.error)
+	return true
+}
+
 // Ext404Error is a type to determine a 404 Not Found error response
 type Ext404Error struct{ error }
 
 // ErrorRetryRequestWriter satisfies the interface that lets this error check
-// for alternative responses that can be used in the presence of this error
+// for alternative responses that can be used in the presence of this error.
+// When there are no alternatives left the no match responses are used.
 func (e Ext404Error) ErrorRetryRequestWriter(w http.ResponseWriter, r *http.Request) bool {
-	if v, ok := r.Context().Value(CtxKeyRetries).(hfsmws); ok && len(v.mws) > 0 {
+	v, ok := r.Context().Value(CtxKeyRetries).(hfsmws)
+	if !ok {
+		return false
+	}
+
+	if len(v.mws) > 0 {
 		hf, mw := v.hfs[0], v.mws[0]
 		v.hfs, v.mws = v.hfs[1:], v.mws[1:]
 
@@ -202,6 +272,15 @@ func (e Ext404Error) ErrorRetryRequestWriter(w http.ResponseWriter, r *http.Requ
 		mw.HandlerFunc(hf).ServeHTTP(w, r.WithContext(ctx))
 		return true
 	}
+
+	if v.noMatch != nil {
+		hf := v.noMatch
+		v.noMatch = nil // only used once per request
+
+		ctx := context.WithValue(r.Context(), CtxKeyRetries, v)
+		hf.ServeHTTP(w, r.WithContext(ctx))
+		return true
+	}
 	return false
 }
 
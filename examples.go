@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// routeExample is a configured response for a route
+type routeExample struct {
+	Path   string          `json:"path"`
+	Method string          `json:"method"`
+	Status string          `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// routeExamples returns the response bodies of all of the routes. The bodies
+// are evaluated without a request, so bodies that use request variables
+// are left out. A body that is JSON is kept as JSON, otherwise it's a string.
+func routeExamples(routes []Route) []routeExample {
+	var examples = []routeExample{}
+	for _, route := range routes {
+		for _, req := range route.Request {
+			for _, res := range req.Response {
+				status := res.Status
+				if status == "" {
+					status = "200"
+				}
+
+				example := routeExample{
+					Path:   route.Path,
+					Method: strings.ToUpper(req.Method),
+					Status: status,
+				}
+
+				if res.Body != nil {
+					if val, dia := res.Body.Expr.Value(&bodyEvalCtx); !dia.HasErrors() {
+						example.Body = exampleBody(val)
+					}
+				}
+
+				examples = append(examples, example)
+			}
+		}
+	}
+	return examples
+}
+
+// exampleBody returns the body value as JSON
+func exampleBody(val cty.Value) json.RawMessage {
+	if val.Type() != cty.String {
+		b, err := ctyjson.SimpleJSONValue{Value: val}.MarshalJSON()
+		if err != nil {
+			return nil
+		}
+		return b
+	}
+
+	if s := val.AsString(); json.Valid([]byte(s)) {
+		return json.RawMessage(s)
+	}
+	b, _ := json.Marshal(val.AsString())
+	return b
+}
+
+// examplesHandler returns the response bodies of all of the routes as
+// examples, so that consumers can discover the shapes of the responses
+func examplesHandler(routes []Route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(routeExamples(routes))
+		log.OnErr(err).Printf("[examples] writing examples: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRouteExamples(t *testing.T) {
+	routes := []Route{
+		{
+			Path: "/users/{id}",
+			Request: []RequestHTTP{
+				{
+					Method: "get",
+					Response: []ResponseHTTP{
+						{Status: "200", Body: attr(`{"id": 1, "name": "Nika"}`)},
+						{Status: "404", Body: attr("Not Found")},
+					},
+				},
+				{
+					Method:   "post",
+					Response: []ResponseHTTP{{Status: "201", Body: attr("${request.body}")}},
+				},
+			},
+		},
+		{
+			Path: "/health",
+			Request: []RequestHTTP{
+				{Method: "get", Response: []ResponseHTTP{{Body: attrE(`{ ok = true }`)}}},
+			},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	examplesHandler(routes).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_internal/examples", nil))
+
+	var have []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &have); err != nil {
+		t.Fatal(err)
+	}
+
+	var want = []struct {
+		path, method, status string
+		body                 interface{}
+	}{
+		{path: "/users/{id}", method: "GET", status: "200", body: map[string]interface{}{"id": 1.0, "name": "Nika"}},
+		{path: "/users/{id}", method: "GET", status: "404", body: "Not Found"},
+		{path: "/users/{id}", method: "POST", status: "201"}, // needs a request
+		{path: "/health", method: "GET", status: "200", body: map[string]interface{}{"ok": true}},
+	}
+
+	if len(have) != len(want) {
+		t.Fatalf("have: %d want: %d", len(have), len(want))
+	}
+	for i, w := range want {
+		if have[i]["path"] != w.path || have[i]["method"] != w.method || have[i]["status"] != w.status {
+			t.Errorf("[%d] have: %v want: %s %s %s", i, have[i], w.method, w.path, w.status)
+		}
+		if !reflect.DeepEqual(have[i]["body"], w.body) {
+			t.Errorf("[%d] have: %v want: %v", i, have[i]["body"], w.body)
+		}
+	}
+}
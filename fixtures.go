@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/spf13/afero"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// fixtureMethods are the HTTP methods that can be used
+// as the prefix of a fixture file name
+var fixtureMethods = map[string]struct{}{
+	http.MethodGet:     {},
+	http.MethodHead:    {},
+	http.MethodPost:    {},
+	http.MethodPut:     {},
+	http.MethodPatch:   {},
+	http.MethodDelete:  {},
+	http.MethodOptions: {},
+}
+
+// loadFixtures walks the fixtures directory and returns routes for each
+// of the JSON files found. The file name determines the method and the
+// path, so `GET_users.json` is `GET /users` and `users/GET_{id}.json`
+// is `GET /users/{id}`. A file named only by the method, like
+// `users/POST.json` is `POST /users`.
+func loadFixtures(fs afero.Fs, dir string) ([]Route, error) {
+	var routes = make(map[string]*Route)
+
+	err := afero.Walk(fs, dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.ToLower(filepath.Ext(file)) != ".json" {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+
+		method, name := fixtureName(strings.TrimSuffix(filepath.Base(rel), filepath.Ext(rel)))
+		if method == "" {
+			log.Printf("[fixtures] skipping %s no method prefix ...", file)
+			return nil
+		}
+
+		b, err := afero.ReadFile(fs, file)
+		if err != nil {
+			return err
+		}
+
+		routePath := path.Join("/", filepath.ToSlash(filepath.Dir(rel)), name)
+		if _, ok := routes[routePath]; !ok {
+			routes[routePath] = &Route{Path: routePath, Desc: "fixture"}
+		}
+
+		log.Printf("[fixtures] %s %s added from %s ...", method, routePath, file)
+		routes[routePath].Request = append(routes[routePath].Request, RequestHTTP{
+			Method: strings.ToLower(method),
+			Response: []ResponseHTTP{
+				{
+					Status: "200",
+					Headers: &headers{
+						Data: headerData{"Content-Type": {cty.StringVal("application/json")}},
+					},
+					Body: &hcl.Attribute{
+						Name: "body",
+						Expr: &hclsyntax.LiteralValueExpr{Val: cty.StringVal(string(b))},
+					},
+				},
+			},
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, ErrReadFixture.F(err)
+	}
+
+	var paths = make([]string, 0, len(routes))
+	for k := range routes {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+
+	var rtn = make([]Route, len(paths))
+	for i, k := range paths {
+		rtn[i] = *routes[k]
+	}
+	return rtn, nil
+}
+
+// fixtureName splits a fixture file name into the method
+// and the name of the last path segment
+func fixtureName(name string) (method, segment string) {
+	parts := strings.SplitN(name, "_", 2)
+	method = strings.ToUpper(parts[0])
+	if _, ok := fixtureMethods[method]; !ok {
+		return "", ""
+	}
+	if len(parts) == 2 {
+		segment = parts[1]
+	}
+	return method, segment
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/spf13/afero"
+)
+
+func TestLoadFixtures(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	var files = map[string]string{
+		"fixtures/GET_users.json":       `[{"id":1},{"id":2}]`,
+		"fixtures/POST_users.json":      `{"id":3}`,
+		"fixtures/users/GET_{id}.json":  `{"id":1}`,
+		"fixtures/users/DELETE.json":    `{}`,
+		"fixtures/users/README.md":      `not a fixture`,
+		"fixtures/users/unknown_x.json": `{"skipped":true}`,
+	}
+	for name, data := range files {
+		if err := afero.WriteFile(fs, name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	routes, err := loadFixtures(fs, "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var have []string
+	hdl := chi.NewRouter()
+	for _, route := range routes {
+		for _, req := range route.Request {
+			have = append(have, strings.ToUpper(req.Method)+" "+route.Path)
+			hdl.Method(req.Method, route.Path, httpHandler(req, []TextBlock{}))
+		}
+	}
+
+	want := []string{"GET /users", "POST /users", "DELETE /users", "GET /users/{id}"}
+	if strings.Join(have, ",") != strings.Join(want, ",") {
+		t.Errorf("\nhave: %v\nwant: %v", have, want)
+	}
+
+	var tests = []struct {
+		method string
+		url    string
+		want   string
+	}{
+		{method: "GET", url: "/users", want: `[{"id":1},{"id":2}]`},
+		{method: "POST", url: "/users", want: `{"id":3}`},
+		{method: "GET", url: "/users/1", want: `{"id":1}`},
+		{method: "DELETE", url: "/users", want: `{}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method+" "+test.url, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("have: %d want: %d", rec.Code, http.StatusOK)
+			}
+			if have := rec.Body.String(); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+			if have := rec.Header().Get("Content-Type"); have != "application/json" {
+				t.Errorf("have: %q want: %q", have, "application/json")
+			}
+		})
+	}
+}
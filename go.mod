@@ -9,6 +9,7 @@ require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/go-chi/chi v4.0.2+incompatible
+	github.com/google/go-cmp v0.5.8 // indirect
 	github.com/google/uuid v1.1.2 // indirect
 	github.com/gorilla/websocket v1.4.2 // indirect
 	github.com/hashicorp/hcl/v2 v2.7.0
@@ -17,10 +18,13 @@ require (
 	github.com/pubnub/go v4.10.0+incompatible
 	github.com/rs/xid v1.2.1
 	github.com/spf13/afero v1.5.1
-	github.com/stretchr/testify v1.6.1 // indirect
+	github.com/streadway/amqp v0.0.0-20180528204448-e5adc2ada8b8
 	github.com/tidwall/pretty v1.1.0
 	github.com/zclconf/go-cty v1.2.0
 	golang.org/x/tools v0.0.0-20200509030707-2212a7e161a5 // indirect
+	google.golang.org/grpc v1.43.0
+	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v3 v3.0.1
 	plugins/config v0.0.0
 	plugins/request v0.0.0
 	plugins/response v0.0.0
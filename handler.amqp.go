@@ -0,0 +1,304 @@
+// +build plugin_amqp
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	requ "plugins/request"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/streadway/amqp"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// amqpPluginName is the AMQP plugin resgistered
+// name that will be used in loging and plugin requests
+const amqpPluginName = "amqp"
+
+// init registers the built-in plugin to the global registery
+func init() {
+	log.Println("[init] loading the AMQP plugin ...")
+	plugins[amqpPluginName] = new(amqpPlugin)
+}
+
+// amqpChannel is the part of an AMQP channel that is used
+// by the plugin, so a channel can be stubbed out in tests
+type amqpChannel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Close() error
+}
+
+// amqpPlugin is plugin related data
+type amqpPlugin struct {
+	client struct {
+		conn    map[string]*amqp.Connection
+		channel map[string]amqpChannel
+	}
+
+	config map[string]amqpConfig
+}
+
+// amqpConfig is the configuration options that
+// can be set from within a ConfigHTTP block.
+type amqpConfig struct {
+	Name       string         `hcl:"name,label"`
+	URL        *hcl.Attribute `hcl:"url"`
+	Exchange   string         `hcl:"exchange,optional"`
+	RoutingKey string         `hcl:"routing_key,optional"`
+}
+
+// amqpPublish stores the publish configurations
+// that can come from a request block
+type amqpPublish struct {
+	Name string `hcl:"name,label"`
+	Desc string `hcl:"_-,optional"`
+
+	Exchange    *string        `hcl:"exchange"`
+	RoutingKey  *string        `hcl:"routing_key"`
+	ContentType string         `hcl:"content_type,optional"`
+	Data        *hcl.Attribute `hcl:"data"`
+}
+
+// Setup is a plugin construct for the inital
+// setup of a plugin
+func (p *amqpPlugin) Setup() error {
+	log.Println("[amqp] setup plugin ...")
+
+	p.client.conn = make(map[string]*amqp.Connection)
+	p.client.channel = make(map[string]amqpChannel)
+	p.config = make(map[string]amqpConfig)
+
+	return nil
+}
+
+// Version takes in the max version and returns the version
+// that this module supports
+func (p *amqpPlugin) Version(int32) int32 { return 1 }
+
+// Metadata returns the metadata of the plugin
+func (p *amqpPlugin) Metadata() string {
+	return `
+metadata {
+	version   = "0.1.0"
+	author    = "Nika Jones"
+	copyright = "Nika Jones - © 2021"
+}
+`
+}
+
+// SetupConfig  is a plugin construct for
+// collecting service configuration information
+// for setting up a plugin
+func (p *amqpPlugin) SetupConfig(svrName string, svrPlugins hcl.Body) error {
+	svrb, _, _ := svrPlugins.PartialContent(&hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type:       amqpPluginName,
+				LabelNames: []string{"name"},
+			},
+		},
+	})
+
+	for _, block := range svrb.Blocks {
+		var ac amqpConfig
+		switch block.Type {
+		case amqpPluginName:
+			gohcl.DecodeBody(block.Body, nil, &ac)
+			if len(block.Labels) > 0 {
+				ac.Name = block.Labels[0] // the same index as the LabelNames above...
+			}
+
+			if ac.URL == nil {
+				return hcl.Diagnostics{&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Missing url",
+					Detail:   fmt.Sprintf("The AMQP %q block needs a url attribute.", ac.Name),
+					Subject:  block.DefRange.Ptr(),
+				}}
+			}
+
+			url, dia := ac.URL.Expr.Value(&fileEvalCtx)
+			if dia.HasErrors() {
+				return dia
+			}
+			if url.IsNull() || url.Type() != cty.String {
+				return hcl.Diagnostics{&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid url",
+					Detail:   fmt.Sprintf("The AMQP %q url must be a string.", ac.Name),
+					Subject:  ac.URL.Expr.Range().Ptr(),
+				}}
+			}
+
+			conn, err := amqp.Dial(url.AsString())
+			if err != nil {
+				return ErrAMQPConnect.F(err)
+			}
+
+			ch, err := conn.Channel()
+			if err != nil {
+				conn.Close()
+				return ErrAMQPConnect.F(err)
+			}
+
+			p.config[ac.Name] = ac
+			p.client.conn[ac.Name] = conn
+			p.client.channel[ac.Name] = ch
+
+			log.Printf("[amqp] client %s (exchange: %q routing key: %q) ...", ac.Name, ac.Exchange, ac.RoutingKey)
+		}
+	}
+
+	return nil
+}
+
+// SetupRoot is a plugin construct for collecting
+// information from the root configuration. There
+// are no root options for AMQP.
+func (p *amqpPlugin) SetupRoot(hcl.Body) error { return nil }
+
+// Cleanup closes all of the AMQP channels and connections
+// that were opened during the setup of the plugin
+func (p *amqpPlugin) Cleanup(bool) error {
+	for name, ch := range p.client.channel {
+		log.Printf("[amqp] closing channel %s ...", name)
+		err := ch.Close()
+		log.OnErr(err).Printf("[amqp] closing channel err: %v", err)
+	}
+	for name, conn := range p.client.conn {
+		log.Printf("[amqp] closing connection %s ...", name)
+		err := conn.Close()
+		log.OnErr(err).Printf("[amqp] closing connection err: %v", err)
+	}
+	return nil
+}
+
+// PostMiddlewareHTTP is a plugin concept that will add the proper middleware to publish a message
+// to an AMQP exchange when a HTTP request is received. This is passed in all of the blocks, that
+// can be used during setup then return a http.Handler that can be used during the request call.
+func (p *amqpPlugin) PostMiddlewareHTTP(path string, plugins hcl.Body, req requ.HTTP) (MiddlewareHTTP, bool) {
+	reqb, _, _ := plugins.PartialContent(&hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type:       amqpPluginName,
+				LabelNames: []string{"name"},
+			},
+		},
+	})
+
+	if len(reqb.Blocks) == 0 {
+		return nil, false
+	}
+
+	var reqAMQP []amqpPublish
+	for _, block := range reqb.Blocks {
+		var ap amqpPublish
+		switch block.Type {
+		case amqpPluginName:
+			gohcl.DecodeBody(block.Body, nil, &ap)
+			if len(block.Labels) > 0 {
+				ap.Name = block.Labels[0]
+			}
+			reqAMQP = append(reqAMQP, ap)
+		}
+	}
+
+	if len(reqAMQP) == 0 {
+		return nil, false
+	}
+
+	var idx = int64(-1)
+	var resps = reqAMQP
+	if req.Order == "unordered" {
+		rand.Seed(time.Now().UnixNano()) // doesn't have to be crypto-quality random here...
+	}
+	log.Printf("[amqp] %s http publish added ...", path)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() { next.ServeHTTP(w, r) }()
+
+			var x int64
+			switch req.Order {
+			case "random":
+				x = rand.Int63n(int64(len(resps) * 2))
+			case "unordered":
+				x = atomic.AddInt64(&idx, 1)
+				if int(x)%len(resps) == 0 {
+					rand.Shuffle(len(resps), func(i, j int) { resps[i], resps[j] = resps[j], resps[i] })
+				}
+			default:
+				x = atomic.AddInt64(&idx, 1)
+			}
+
+			resp := resps[int(x)%len(resps)]
+			go p.publish(resp, req.Delay)
+		})
+	}, true
+}
+
+// publish sends the templated message to the exchange and routing key
+// that are configured, the request values override the config values.
+// A data value that isn't a string is sent as JSON.
+func (p *amqpPlugin) publish(pub amqpPublish, wait string) {
+	ch, ok := p.client.channel[pub.Name]
+	if !ok {
+		log.Printf("[amqp] no connection for %q ...", pub.Name)
+		return
+	}
+
+	if len(wait) > 0 {
+		time.Sleep(delay(wait))
+	}
+
+	cfg := p.config[pub.Name]
+	exchange, key := cfg.Exchange, cfg.RoutingKey
+	if pub.Exchange != nil {
+		exchange = *pub.Exchange
+	}
+	if pub.RoutingKey != nil {
+		key = *pub.RoutingKey
+	}
+
+	var body []byte
+	if pub.Data != nil {
+		dataVal, dia := pub.Data.Expr.Value(&bodyEvalCtx)
+		if dia.HasErrors() {
+			for _, err := range dia.Errs() {
+				log.Printf("[amqp] http failed to publish: %v", err)
+			}
+			return
+		}
+
+		switch {
+		case dataVal.IsNull():
+		case dataVal.Type() == cty.String:
+			body = []byte(dataVal.AsString())
+		default:
+			b, err := json.Marshal(ctyjson.SimpleJSONValue{Value: dataVal})
+			if log.OnErr(err).Printf("[amqp] %s failed to marshal the data: %v", pub.Name, err).HasErr() {
+				return
+			}
+			body = b
+		}
+	}
+
+	contentType := pub.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	log.Printf("[amqp] http publish %s (exchange: %q routing key: %q) ...", pub.Name, exchange, key)
+	err := ch.Publish(exchange, key, false, false, amqp.Publishing{
+		ContentType: contentType,
+		Timestamp:   time.Now(),
+		Body:        body,
+	})
+	log.OnErr(err).Printf("[amqp] error: %v", err)
+}
@@ -0,0 +1,169 @@
+// +build plugin_amqp
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	requ "plugins/request"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/streadway/amqp"
+)
+
+type testAMQPPublished struct {
+	exchange, key string
+	msg           amqp.Publishing
+}
+
+type testAMQPChannel struct {
+	published chan testAMQPPublished
+}
+
+func (c testAMQPChannel) Publish(exchange, key string, _, _ bool, msg amqp.Publishing) error {
+	c.published <- testAMQPPublished{exchange: exchange, key: key, msg: msg}
+	return nil
+}
+
+func (c testAMQPChannel) Close() error { return nil }
+
+func TestAMQPPublish(t *testing.T) {
+	type want struct {
+		exchange string
+		key      string
+		body     string
+	}
+
+	var tests = []struct {
+		name string
+		src  string
+		want want
+	}{
+		{
+			name: "config routing key",
+			src: `
+amqp "rabbit" {
+	data = "{\"hello\":\"world\"}"
+}`,
+			want: want{exchange: "events", key: "mock.created", body: `{"hello":"world"}`},
+		},
+		{
+			name: "request routing key",
+			src: `
+amqp "rabbit" {
+	routing_key = "mock.updated"
+	data = "updated"
+}`,
+			want: want{exchange: "events", key: "mock.updated", body: "updated"},
+		},
+		{
+			name: "object data",
+			src: `
+amqp "rabbit" {
+	data = { hello = "world" }
+}`,
+			want: want{exchange: "events", key: "mock.created", body: `{"hello":"world"}`},
+		},
+		{
+			name: "null data",
+			src: `
+amqp "rabbit" {
+	data = null
+}`,
+			want: want{exchange: "events", key: "mock.created", body: ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ch := testAMQPChannel{published: make(chan testAMQPPublished, 1)}
+
+			p := new(amqpPlugin)
+			p.Setup()
+			p.config["rabbit"] = amqpConfig{Name: "rabbit", Exchange: "events", RoutingKey: "mock.created"}
+			p.client.channel["rabbit"] = ch
+
+			file, dia := hclsyntax.ParseConfig([]byte(test.src), "test.hcl", hcl.Pos{Line: 1, Column: 1})
+			if dia.HasErrors() {
+				t.Fatal(dia)
+			}
+
+			mw, ok := p.PostMiddlewareHTTP("/test", file.Body, requ.HTTP{Method: "post"})
+			if !ok {
+				t.Fatal("no amqp middleware returned")
+			}
+
+			req, err := http.NewRequest(http.MethodPost, "/test", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+			hdl.With(mw).Post("/test", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(200) })
+			hdl.ServeHTTP(rec, req)
+
+			select {
+			case have := <-ch.published:
+				if have.exchange != test.want.exchange {
+					t.Errorf("[exchange] have: %q want: %q", have.exchange, test.want.exchange)
+				}
+				if have.key != test.want.key {
+					t.Errorf("[key] have: %q want: %q", have.key, test.want.key)
+				}
+				if string(have.msg.Body) != test.want.body {
+					t.Errorf("[body] have: %q want: %q", have.msg.Body, test.want.body)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("publish was not called")
+			}
+		})
+	}
+}
+
+func TestAMQPSetupConfig(t *testing.T) {
+	var tests = []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "missing url",
+			src: `
+amqp "rabbit" {
+	exchange = "events"
+}`,
+			want: "Missing url",
+		},
+		{
+			name: "null url",
+			src: `
+amqp "rabbit" {
+	url = null
+}`,
+			want: "Invalid url",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, dia := hclsyntax.ParseConfig([]byte(test.src), "test.hcl", hcl.Pos{Line: 1, Column: 1})
+			if dia.HasErrors() {
+				t.Fatal(dia)
+			}
+
+			p := new(amqpPlugin)
+			p.Setup()
+
+			err := p.SetupConfig("test", file.Body)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("have: %v want: %q", err, test.want)
+			}
+		})
+	}
+}
@@ -3,13 +3,19 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"regexp"
 	"strings"
 )
 
 // corsHandler handles checking CORS options and
 // making sure they are valid before continuing to
-// process a HTTP request
-func corsHandler(cors *routeCORS) http.HandlerFunc {
+// process a HTTP request. The allowed methods are
+// limited to the methods configured for the route.
+func corsHandler(cors *routeCORS, methods []string) http.HandlerFunc {
+	allowMethods := corsMethods(cors, methods)
+	originPattern, err := corsOriginPattern(cors)
+	log.OnErr(err).Printf("[cors] the allow_origin pattern: %v", err)
+
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		log.Println("[cors] sending back headers ...")
@@ -18,9 +24,27 @@ func corsHandler(cors *routeCORS) http.HandlerFunc {
 			return
 		}
 
-		w.Header().Set("Access-Control-Allow-Origin", cors.AllowOrigin)
-		if cors.AllowMethods != nil {
-			w.Header().Set("Access-Control-Allow-Methods", strings.Join(cors.AllowMethods, ", "))
+		// a "*" origin can not be used with credentials, so the
+		// request origin is sent back (reflected) instead
+		origin := cors.AllowOrigin
+		if origin == "*" && cors.AllowCredentials != nil && *cors.AllowCredentials {
+			origin = r.Header.Get("Origin")
+			w.Header().Add("Vary", "Origin")
+		}
+
+		// a pattern only sends back a matching request origin
+		if originPattern != nil || err != nil {
+			w.Header().Add("Vary", "Origin")
+			if origin = r.Header.Get("Origin"); err != nil || !originPattern.MatchString(origin) {
+				log.Printf("[cors] the %q origin doesn't match %q ...", origin, cors.AllowOrigin)
+				return
+			}
+		}
+		if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if len(allowMethods) > 0 {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(allowMethods, ", "))
 		}
 		if cors.AllowHeaders != nil {
 			w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.AllowHeaders, ", "))
@@ -29,7 +53,48 @@ func corsHandler(cors *routeCORS) http.HandlerFunc {
 			w.Header().Set("Access-Control-Allow-Credentials", fmt.Sprint(*cors.AllowCredentials))
 		}
 		if cors.MaxAge != nil {
-			w.Header().Set("Access-Control-Allow-Max-Age", fmt.Sprint(*cors.MaxAge))
+			w.Header().Set("Access-Control-Max-Age", fmt.Sprint(*cors.MaxAge))
+		}
+	}
+}
+
+// corsOriginPattern returns the regex for an allow_origin pattern. A value
+// that starts with ^ is a regex, a * wildcard matches the host names
+// there, i.e. "https://*.example.com". Other values are literal origins
+// and have no pattern.
+func corsOriginPattern(cors *routeCORS) (*regexp.Regexp, error) {
+	if cors == nil || cors.AllowOrigin == "*" {
+		return nil, nil
+	}
+
+	switch allow := cors.AllowOrigin; {
+	case strings.HasPrefix(allow, "^"):
+		return regexp.Compile(allow)
+	case strings.Contains(allow, "*"):
+		return regexp.Compile("^" + strings.ReplaceAll(regexp.QuoteMeta(allow), `\*`, `[A-Za-z0-9.-]+`) + "$")
+	}
+	return nil, nil
+}
+
+// corsMethods returns the allowed methods that are also configured
+// for the route, when no allowed methods are set then all of the
+// route methods are used
+func corsMethods(cors *routeCORS, methods []string) []string {
+	if cors == nil {
+		return nil
+	}
+	if cors.AllowMethods == nil {
+		return methods
+	}
+
+	var allow []string
+	for _, am := range cors.AllowMethods {
+		for _, method := range methods {
+			if strings.EqualFold(am, method) {
+				allow = append(allow, method)
+				break
+			}
 		}
 	}
+	return allow
 }
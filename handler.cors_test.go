@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSAllowMethods(t *testing.T) {
+	var tests = []struct {
+		name    string
+		allow   []string
+		methods []string
+		want    string
+	}{
+		{name: "route methods", methods: []string{"GET", "POST"}, want: "GET, POST"},
+		{name: "configured only", allow: []string{"get", "put", "delete"}, methods: []string{"DELETE", "GET"}, want: "GET, DELETE"},
+		{name: "none configured", allow: []string{"PUT"}, methods: []string{"GET"}, want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodOptions, "/test", nil)
+
+			cors := &routeCORS{AllowOrigin: "*", AllowMethods: test.allow}
+			corsHandler(cors, test.methods).ServeHTTP(w, r)
+
+			if have := w.Header().Get("Access-Control-Allow-Methods"); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestCORSCredentials(t *testing.T) {
+	var T = true
+	var tests = []struct {
+		name   string
+		allow  string
+		creds  *bool
+		origin string
+		want   string
+	}{
+		{name: "any origin", allow: "*", origin: "https://app.example.com", want: "*"},
+		{name: "origin with credentials", allow: "https://app.example.com", creds: &T, origin: "https://app.example.com", want: "https://app.example.com"},
+		{name: "reflected origin with credentials", allow: "*", creds: &T, origin: "https://app.example.com", want: "https://app.example.com"},
+		{name: "no origin with credentials", allow: "*", creds: &T, want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodOptions, "/test", nil)
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+
+			cors := &routeCORS{AllowOrigin: test.allow, AllowCredentials: test.creds}
+			corsHandler(cors, []string{"GET"}).ServeHTTP(w, r)
+
+			if have := w.Header().Get("Access-Control-Allow-Origin"); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+			if test.creds != nil && w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+				t.Errorf("have: %q want: %q", w.Header().Get("Access-Control-Allow-Credentials"), "true")
+			}
+		})
+	}
+}
+
+func TestCORSOriginPattern(t *testing.T) {
+	var tests = []struct {
+		name   string
+		allow  string
+		origin string
+		want   string
+	}{
+		{name: "wildcard match", allow: "https://*.example.com", origin: "https://pr-12.preview.example.com", want: "https://pr-12.preview.example.com"},
+		{name: "wildcard no match", allow: "https://*.example.com", origin: "https://example.com.evil.io", want: ""},
+		{name: "wildcard other scheme", allow: "https://*.example.com", origin: "http://app.example.com", want: ""},
+		{name: "regex match", allow: `^https://(app|admin)\.example\.com(:\d+)?$`, origin: "https://admin.example.com:8443", want: "https://admin.example.com:8443"},
+		{name: "regex no match", allow: `^https://(app|admin)\.example\.com$`, origin: "https://www.example.com", want: ""},
+		{name: "bad regex", allow: `^https://(app`, origin: "https://app", want: ""},
+		{name: "no origin", allow: "https://*.example.com", want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodOptions, "/test", nil)
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+
+			corsHandler(&routeCORS{AllowOrigin: test.allow}, []string{"GET"}).ServeHTTP(w, r)
+
+			if have := w.Header().Get("Access-Control-Allow-Origin"); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+			if have := w.Header().Get("Vary"); have != "Origin" {
+				t.Errorf("have: %q want: %q", have, "Origin")
+			}
+			if have := w.Header().Get("Access-Control-Allow-Methods"); (have != "") != (test.want != "") {
+				t.Errorf("have: %q want CORS headers: %t", have, test.want != "")
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+// +build plugin_grpc
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// grpcPluginName is the gRPC plugin resgistered
+// name that will be used in loging and plugin requests
+const grpcPluginName = "grpc"
+
+// init registers the built-in plugin to the global registery
+func init() {
+	log.Println("[init] loading the gRPC plugin ...")
+	plugins[grpcPluginName] = new(grpcPlugin)
+}
+
+// grpcPlugin is plugin related data
+type grpcPlugin struct {
+	server map[string]*grpc.Server
+	lis    map[string]net.Listener
+	files  map[string]*protoregistry.Files
+
+	methods map[string]map[string]grpcMethod
+}
+
+// grpcConfig is the configuration options that
+// can be set from within a ConfigHTTP block.
+type grpcConfig struct {
+	Name     string `hcl:"name,label"`
+	Host     string `hcl:"host"`
+	Protoset string `hcl:"protoset"`
+}
+
+// grpcMethod stores the unary response for a full
+// method name, i.e. /package.Service/Method
+type grpcMethod struct {
+	Name   string `hcl:"name,label"`
+	Method string `hcl:"method,label"`
+	Desc   string `hcl:"_-,optional"`
+
+	Data *hcl.Attribute `hcl:"data"`
+
+	Status  *string `hcl:"status"`  // a non-OK status sent in the trailers, i.e. "NOT_FOUND" or "5"
+	Message *string `hcl:"message"` // the grpc-message sent with the status
+
+	code codes.Code
+}
+
+// Setup is a plugin construct for the inital
+// setup of a plugin
+func (p *grpcPlugin) Setup() error {
+	log.Println("[grpc] setup plugin ...")
+
+	p.server = make(map[string]*grpc.Server)
+	p.lis = make(map[string]net.Listener)
+	p.files = make(map[string]*protoregistry.Files)
+	p.methods = make(map[string]map[string]grpcMethod)
+
+	return nil
+}
+
+// Version takes in the max version and returns the version
+// that this module supports
+func (p *grpcPlugin) Version(int32) int32 { return 1 }
+
+// Metadata returns the metadata of the plugin
+func (p *grpcPlugin) Metadata() string {
+	return `
+metadata {
+	version   = "0.1.0"
+	author    = "Nika Jones"
+	copyright = "Nika Jones - © 2021"
+}
+`
+}
+
+// SetupConfig is a plugin construct for collecting service
+// configuration information. Each gRPC block starts a server
+// that answers the methods found in the protoset.
+func (p *grpcPlugin) SetupConfig(svrName string, svrPlugins hcl.Body) error {
+	svrb, _, _ := svrPlugins.PartialContent(&hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type:       grpcPluginName,
+				LabelNames: []string{"name"},
+			},
+		},
+	})
+
+	for _, block := range svrb.Blocks {
+		var gc grpcConfig
+		switch block.Type {
+		case grpcPluginName:
+			gohcl.DecodeBody(block.Body, nil, &gc)
+			if len(block.Labels) > 0 {
+				gc.Name = block.Labels[0] // the same index as the LabelNames above...
+			}
+
+			files, err := loadProtoset(gc.Protoset)
+			if err != nil {
+				return err
+			}
+
+			lis, err := net.Listen("tcp", gc.Host)
+			if err != nil {
+				return ErrGRPCListen.F(err)
+			}
+
+			p.files[gc.Name] = files
+			p.lis[gc.Name] = lis
+			p.server[gc.Name] = grpc.NewServer(grpc.UnknownServiceHandler(p.handler(gc.Name)))
+
+			log.Printf("[grpc] server %s listening on %s ...", gc.Name, lis.Addr())
+			go func(name string) {
+				err := p.server[name].Serve(p.lis[name])
+				log.OnErr(err).Printf("[grpc] server %s err: %v", name, err)
+			}(gc.Name)
+		}
+	}
+
+	return nil
+}
+
+// SetupRoot is a plugin construct for collecting information from
+// the root configuration. This is where the unary method responses
+// are configured.
+func (p *grpcPlugin) SetupRoot(configPlugins hcl.Body) error {
+	cfgb, _, _ := configPlugins.PartialContent(&hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type:       grpcPluginName,
+				LabelNames: []string{"name", "method"},
+			},
+		},
+	})
+
+	for _, block := range cfgb.Blocks {
+		var gm grpcMethod
+		switch block.Type {
+		case grpcPluginName:
+			gohcl.DecodeBody(block.Body, nil, &gm)
+			if len(block.Labels) > 1 {
+				gm.Name, gm.Method = block.Labels[0], block.Labels[1] // the same index as the LabelNames above...
+			}
+
+			if gm.Status != nil {
+				code, err := grpcCode(*gm.Status)
+				if err != nil {
+					return err
+				}
+				gm.code = code
+			}
+
+			if _, ok := p.methods[gm.Name]; !ok {
+				p.methods[gm.Name] = make(map[string]grpcMethod)
+			}
+			p.methods[gm.Name][gm.Method] = gm
+
+			log.Printf("[grpc] %s unary method %s added ...", gm.Name, gm.Method)
+		}
+	}
+
+	return nil
+}
+
+// Cleanup stops all of the gRPC servers that were
+// started during the setup of the plugin
+func (p *grpcPlugin) Cleanup(bool) error {
+	for name, svr := range p.server {
+		log.Printf("[grpc] stopping server %s ...", name)
+		svr.GracefulStop()
+	}
+	return nil
+}
+
+// handler returns a stream handler that answers every method of the
+// named server. The request message is decoded using the descriptors
+// from the protoset and the JSON data is transcoded into the response.
+func (p *grpcPlugin) handler(name string) grpc.StreamHandler {
+	return func(_ interface{}, stream grpc.ServerStream) error {
+		fullMethod, ok := grpc.MethodFromServerStream(stream)
+		if !ok {
+			return status.Error(codes.Internal, "no method found")
+		}
+		log.Printf("[grpc] %s call %s ...", name, fullMethod)
+
+		gm, ok := p.methods[name][fullMethod]
+		if !ok {
+			return status.Errorf(codes.Unimplemented, "method %s is not mocked", fullMethod)
+		}
+
+		md, err := p.method(name, fullMethod)
+		if err != nil {
+			return status.Error(codes.Unimplemented, err.Error())
+		}
+
+		in := dynamicpb.NewMessage(md.Input())
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+
+		// the status and message are sent to the client in the trailers
+		if gm.code != codes.OK {
+			var msg string
+			if gm.Message != nil {
+				msg = *gm.Message
+			}
+			return status.Error(gm.code, msg)
+		}
+
+		out := dynamicpb.NewMessage(md.Output())
+		if gm.Data != nil {
+			dataVal, dia := gm.Data.Expr.Value(&bodyEvalCtx)
+			if dia.HasErrors() {
+				return status.Error(codes.Internal, dia.Error())
+			}
+			if err := protojson.Unmarshal([]byte(dataVal.AsString()), out); err != nil {
+				return status.Error(codes.Internal, ErrGRPCTranscode.F(err).Error())
+			}
+		}
+
+		return stream.SendMsg(out)
+	}
+}
+
+// method finds the method descriptor for a full method
+// name, i.e. /package.Service/Method in the protoset
+func (p *grpcPlugin) method(name, fullMethod string) (protoreflect.MethodDescriptor, error) {
+	parts := strings.SplitN(strings.TrimPrefix(fullMethod, "/"), "/", 2)
+	if len(parts) != 2 {
+		return nil, ErrGRPCMethod.F(fullMethod)
+	}
+
+	files, ok := p.files[name]
+	if !ok {
+		return nil, ErrGRPCMethod.F(fullMethod)
+	}
+
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(parts[0]))
+	if err != nil {
+		return nil, ErrGRPCMethod.F(fullMethod)
+	}
+
+	svc, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, ErrGRPCMethod.F(fullMethod)
+	}
+
+	md := svc.Methods().ByName(protoreflect.Name(parts[1]))
+	if md == nil || md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, ErrGRPCMethod.F(fullMethod)
+	}
+	return md, nil
+}
+
+// grpcCode returns the gRPC code for a status name or
+// number, i.e. "NOT_FOUND", "not_found" or "5"
+func grpcCode(s string) (codes.Code, error) {
+	var code codes.Code
+	if _, err := strconv.ParseUint(s, 10, 32); err != nil {
+		s = strconv.Quote(strings.ToUpper(s)) // the names are JSON strings
+	}
+	if err := code.UnmarshalJSON([]byte(s)); err != nil {
+		return code, ErrGRPCStatus.F(s, err)
+	}
+	return code, nil
+}
+
+// loadProtoset reads a descriptor set, i.e. the output of
+// `protoc --include_imports --descriptor_set_out` and returns
+// the file descriptors it contains
+func loadProtoset(filename string) (*protoregistry.Files, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, ErrGRPCProtoset.F(err)
+	}
+
+	var fds descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &fds); err != nil {
+		return nil, ErrGRPCProtoset.F(err)
+	}
+
+	files, err := protodesc.NewFiles(&fds)
+	if err != nil {
+		return nil, ErrGRPCProtoset.F(err)
+	}
+	return files, nil
+}
@@ -0,0 +1,192 @@
+// +build plugin_grpc
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// testGreeterProtoset returns a descriptor set with a single
+// test.Greeter service, the same as protoc would create for:
+//
+//	service Greeter {
+//		rpc SayHello (HelloRequest) returns (HelloReply);
+//		rpc SayNothing (HelloRequest) returns (HelloReply);
+//	}
+func testGreeterProtoset() *descriptorpb.FileDescriptorSet {
+	field := func(name string, num int32) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(num),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+		}
+	}
+
+	return &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{
+			{
+				Name:    proto.String("greeter.proto"),
+				Package: proto.String("test"),
+				Syntax:  proto.String("proto3"),
+				MessageType: []*descriptorpb.DescriptorProto{
+					{Name: proto.String("HelloRequest"), Field: []*descriptorpb.FieldDescriptorProto{field("name", 1)}},
+					{Name: proto.String("HelloReply"), Field: []*descriptorpb.FieldDescriptorProto{field("message", 1)}},
+				},
+				Service: []*descriptorpb.ServiceDescriptorProto{
+					{
+						Name: proto.String("Greeter"),
+						Method: []*descriptorpb.MethodDescriptorProto{
+							{
+								Name:       proto.String("SayHello"),
+								InputType:  proto.String(".test.HelloRequest"),
+								OutputType: proto.String(".test.HelloReply"),
+							},
+							{
+								Name:       proto.String("SayNothing"),
+								InputType:  proto.String(".test.HelloRequest"),
+								OutputType: proto.String(".test.HelloReply"),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestGRPCUnary(t *testing.T) {
+	fds := testGreeterProtoset()
+	b, err := proto.Marshal(fds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	protoset := filepath.Join(t.TempDir(), "greeter.protoset")
+	if err := ioutil.WriteFile(protoset, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parse := func(src string) hcl.Body {
+		file, dia := hclsyntax.ParseConfig([]byte(src), "test.hcl", hcl.Pos{Line: 1, Column: 1})
+		if dia.HasErrors() {
+			t.Fatal(dia)
+		}
+		return file.Body
+	}
+
+	p := new(grpcPlugin)
+	p.Setup()
+	defer p.Cleanup(false)
+
+	if err := p.SetupRoot(parse(`
+grpc "greeter" "/test.Greeter/SayHello" {
+	data = "{\"message\":\"Hello, World\"}"
+}
+grpc "greeter" "/test.Greeter/SayNothing" {
+	status  = "not_found"
+	message = "nobody is here"
+}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.SetupConfig("test", parse(strings.Replace(`
+grpc "greeter" {
+	host     = "127.0.0.1:0"
+	protoset = "%s"
+}`, "%s", protoset, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, p.lis["greeter"].Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	files := p.files["greeter"]
+	msg := func(name string) *dynamicpb.Message {
+		desc, err := files.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dynamicpb.NewMessage(desc.(protoreflect.MessageDescriptor))
+	}
+
+	var tests = []struct {
+		name   string
+		method string
+		want   string
+		code   codes.Code
+		msg    string
+	}{
+		{name: "mocked", method: "/test.Greeter/SayHello", want: "Hello, World"},
+		{name: "not mocked", method: "/test.Greeter/SayGoodbye", code: codes.Unimplemented},
+		{name: "mocked status", method: "/test.Greeter/SayNothing", code: codes.NotFound, msg: "nobody is here"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in, out := msg("test.HelloRequest"), msg("test.HelloReply")
+			in.Set(in.Descriptor().Fields().ByName("name"), protoreflect.ValueOfString("World"))
+
+			err := conn.Invoke(ctx, test.method, in, out)
+			if have := status.Code(err); have != test.code {
+				t.Fatalf("have: %v want: %v (%v)", have, test.code, err)
+			}
+			if have := status.Convert(err).Message(); test.msg != "" && have != test.msg {
+				t.Errorf("have: %q want: %q", have, test.msg)
+			}
+
+			have := out.Get(out.Descriptor().Fields().ByName("message")).String()
+			if have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestGRPCCode(t *testing.T) {
+	var tests = []struct {
+		status  string
+		want    codes.Code
+		wantErr bool
+	}{
+		{status: "NOT_FOUND", want: codes.NotFound},
+		{status: "permission_denied", want: codes.PermissionDenied},
+		{status: "14", want: codes.Unavailable},
+		{status: "NOT_A_STATUS", wantErr: true},
+		{status: "99", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.status, func(t *testing.T) {
+			have, err := grpcCode(test.status)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("have: %v want error: %t", err, test.wantErr)
+			}
+			if have != test.want {
+				t.Errorf("have: %v want: %v", have, test.want)
+			}
+		})
+	}
+}
@@ -1,17 +1,27 @@
 package main
 
 import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"path/filepath"
 	requ "plugins/request"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,9 +29,13 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/njones/logger"
+	"github.com/spf13/afero"
 	"github.com/zclconf/go-cty/cty"
+	ctyconvert "github.com/zclconf/go-cty/cty/convert"
 	"github.com/zclconf/go-cty/cty/function"
 	ctyjson "github.com/zclconf/go-cty/cty/json"
+	"gopkg.in/yaml.v3"
 )
 
 // interval holds a map of the string names that
@@ -50,6 +64,89 @@ func delay(str string) time.Duration {
 	return time.Duration(0)
 }
 
+// delayRange returns the min and max time duration of a delay range
+// formatted string, i.e. "100ms-500ms". A single delay, i.e. "200ms",
+// returns the same min and max time duration.
+func delayRange(str string) (min, max time.Duration) {
+	if i := strings.Index(str, "-"); i >= 0 {
+		min, max = delay(strings.TrimSpace(str[:i])), delay(strings.TrimSpace(str[i+1:]))
+		if max < min {
+			min, max = max, min
+		}
+		return min, max
+	}
+
+	min = delay(str)
+	return min, min
+}
+
+// orderIndexes holds the response order index of each request,
+// so the order continues from the same place after a reload
+var orderIndexes = struct {
+	sync.Mutex
+	m map[string]*uint64
+}{m: make(map[string]*uint64)}
+
+// orderIndex returns the saved order index for the key, or a
+// new index when there is no key
+func orderIndex(key string) *uint64 {
+	if key == "" {
+		return new(uint64)
+	}
+
+	orderIndexes.Lock()
+	defer orderIndexes.Unlock()
+
+	if idx, ok := orderIndexes.m[key]; ok {
+		return idx
+	}
+	idx := new(uint64)
+	orderIndexes.m[key] = idx
+	return idx
+}
+
+// orderKeyIndexes holds the response order index for
+// each of the values of a request order_key
+type orderKeyIndexes struct {
+	sync.Mutex
+	m map[string]*uint64
+}
+
+// index returns the order index for the value, a new index
+// is added the first time a value is seen
+func (o *orderKeyIndexes) index(value string) *uint64 {
+	o.Lock()
+	defer o.Unlock()
+
+	if idx, ok := o.m[value]; ok {
+		return idx
+	}
+	idx := new(uint64)
+	o.m[value] = idx
+	return idx
+}
+
+// orderKeyValue returns the request value that the order_key points
+// to, i.e. "header.x-session-id", "cookie.session" or "query.user"
+func orderKeyValue(r *http.Request, orderKey string) string {
+	var kind, name = orderKey, ""
+	if i := strings.Index(orderKey, "."); i >= 0 {
+		kind, name = orderKey[:i], orderKey[i+1:]
+	}
+
+	switch kind {
+	case "header":
+		return r.Header.Get(name)
+	case "cookie":
+		if cookie, err := r.Cookie(name); err == nil {
+			return cookie.Value
+		}
+	case "query":
+		return r.URL.Query().Get(name)
+	}
+	return ""
+}
+
 // reqStateFn is the recursive type that represents
 // a state during the processing of a HTTP request
 type reqStateFn func(*reqState) reqStateFn
@@ -60,14 +157,18 @@ type reqState struct {
 	state  reqStateFn
 	status int
 
-	req RequestHTTP
-	res ResponseHTTP
+	req  RequestHTTP
+	res  ResponseHTTP
+	seq  string // the current named state, when using request states
+	call uint64 // the 1-based count of this request
 
 	w http.ResponseWriter
 	r *http.Request
 
 	txts []TextBlock
 
+	proxy *configProxy // the proxy that has a request body to rewrite
+
 	vars map[string]cty.Value         // HCL variables
 	funs map[string]function.Function // HCL functions
 
@@ -76,25 +177,37 @@ type reqState struct {
 
 // setup is the inital setup state where all things are
 // initialized
-func setup(idx *uint64, resps []ResponseHTTP, texts []TextBlock) reqStateFn {
+func setup(idx *uint64, keyed *orderKeyIndexes, resps []ResponseHTTP, texts []TextBlock) reqStateFn {
 	return func(st *reqState) reqStateFn {
 		st.txts = texts
-		return execOrder(idx, resps)
+		return execOrder(idx, keyed, resps)
 	}
 }
 
 // execOrder executes the Order of responses for each state
 // this requires passing in the HTTP responses that can be used
 // and the index as a reference, the index will be atomiclly
-// incremented accross *all* requests. There currently is no
-// way to increment for a single request profile  (ie user,
-// instance, or some identifying factor)
-func execOrder(idx *uint64, resps []ResponseHTTP) reqStateFn {
+// incremented accross *all* requests. When there is an order_key
+// the index for the request value (ie user, instance, or some
+// identifying factor) is used instead, so each has its own order.
+func execOrder(idx *uint64, keyed *orderKeyIndexes, resps []ResponseHTTP) reqStateFn {
 	return func(st *reqState) reqStateFn {
+		if st.req.OrderKey != "" {
+			idx = keyed.index(orderKeyValue(st.r, st.req.OrderKey))
+		}
+
+		if len(st.req.States) > 0 {
+			return execStates(idx, resps)
+		}
+
 		var order uint64
 		switch st.req.Order {
 		case "random":
 			order = uint64(st.req.rand.Int63n(int64(len(resps) * 2)))
+		case "url-hash":
+			h := fnv.New64a() // the same URL always gets the same response
+			h.Write([]byte(st.r.URL.Path + "?" + st.r.URL.RawQuery))
+			order = h.Sum64()
 		case "unordered":
 			order = atomic.AddUint64(idx, 1) - 1
 			if int(order)%len(resps) == 0 {
@@ -103,9 +216,62 @@ func execOrder(idx *uint64, resps []ResponseHTTP) reqStateFn {
 		default:
 			order = atomic.AddUint64(idx, 1) - 1
 		}
-		st.res = resps[int(order)%len(resps)]
+		st.res = resps[order%uint64(len(resps))]
+		return execFailOn
+	}
+}
+
+// execStates executes the named states of a request, where each
+// call advances to the next state until the last state is reached.
+// The response with a matching state name is used, otherwise the
+// response at the same index as the state is used.
+func execStates(idx *uint64, resps []ResponseHTTP) reqStateFn {
+	return func(st *reqState) reqStateFn {
+		n := int(atomic.AddUint64(idx, 1) - 1)
+		if n >= len(st.req.States) {
+			n = len(st.req.States) - 1 // stay on the last state
+		}
+
+		st.seq = st.req.States[n]
+		st.res = resps[n%len(resps)]
+		for _, res := range resps {
+			if res.State == st.seq {
+				st.res = res
+				break
+			}
+		}
+		return execFailOn
+	}
+}
+
+// execFailOn executes replacing the response with the fail
+// response when the request count is one that should fail
+func execFailOn(st *reqState) reqStateFn {
+	if _, ok := st.req.failOn[st.call]; !ok {
+		return execMaxUses
+	}
+
+	st.res = ResponseHTTP{Status: "500"}
+	if st.req.Fail != nil {
+		st.res = *st.req.Fail
+	}
+	log.Printf("[http] failing request %d ...", st.call)
+	return execMaxUses
+}
+
+// execMaxUses executes replacing the response with the gone
+// response when the request count is over the max uses
+func execMaxUses(st *reqState) reqStateFn {
+	if st.req.MaxUses == nil || st.call <= *st.req.MaxUses {
 		return execPrePluginRequestHTTP
 	}
+
+	st.res = ResponseHTTP{Status: "410"}
+	if st.req.Gone != nil {
+		st.res = *st.req.Gone
+	}
+	log.Printf("[http] gone after %d uses ...", *st.req.MaxUses)
+	return execPrePluginRequestHTTP
 }
 
 func execPrePluginRequestHTTP(st *reqState) reqStateFn {
@@ -131,9 +297,88 @@ func execPrePluginRequestHTTP(st *reqState) reqStateFn {
 // execDelay executed the delay of a request
 func execDelay(st *reqState) reqStateFn {
 	if len(st.req.Delay) > 0 {
-		time.Sleep(delay(st.req.Delay))
+		d, max := delayRange(st.req.Delay)
+		if max > d {
+			d += time.Duration(st.req.rand.Int63n(int64(max-d) + 1))
+		}
+		time.Sleep(d)
+	}
+	if st.req.LatencyProfile != nil {
+		time.Sleep(st.req.LatencyProfile.sample(st.req.rand))
+	}
+	if st.req.DelayRamp != nil {
+		time.Sleep(st.req.DelayRamp.delay(st.call))
+	}
+	if st.res.ConnectDelay != nil {
+		time.Sleep(delay(*st.res.ConnectDelay))
+	}
+	return execReset
+}
+
+// delay returns the ramp delay for the 1-based call count,
+// the first call has no delay and each call after adds a
+// step until the cap is reached
+func (dr *delayRamp) delay(call uint64) time.Duration {
+	if call == 0 {
+		return 0
+	}
+	step, max := delay(dr.Step), delay(dr.Cap)
+	if d := step * time.Duration(call-1); d < max {
+		return d
+	}
+	return max
+}
+
+// sample returns a delay from the latency profile, the delay is linear
+// between each of the percentiles so that 50% of the delays are under
+// the p50, 95% are under the p95 and 99% are under the p99 delay.
+func (lp *latencyProfile) sample(rnd *rand.Rand) time.Duration {
+	var points = []struct {
+		p float64
+		d time.Duration
+	}{
+		{0, 0},
+		{0.50, delay(lp.P50)},
+		{0.95, delay(lp.P95)},
+		{0.99, delay(lp.P99)},
+		{1.00, delay(lp.P99)},
+	}
+
+	u := rnd.Float64()
+	for i := 1; i < len(points); i++ {
+		lo, hi := points[i-1], points[i]
+		if u <= hi.p {
+			frac := (u - lo.p) / (hi.p - lo.p)
+			return lo.d + time.Duration(frac*float64(hi.d-lo.d))
+		}
+	}
+	return points[len(points)-1].d
+}
+
+// execReset executes closing the connection without a response,
+// using the reset probability of the response. The connection
+// is reset (RST) when it can be hijacked, otherwise the server
+// is told to abort the response and close the connection.
+func execReset(st *reqState) reqStateFn {
+	if st.res.Reset == nil || st.req.rand.Float64() >= *st.res.Reset {
+		return execStatus
+	}
+
+	log.Println("[http] resetting the connection ...")
+	hj, ok := hijacker(st.w)
+	if !ok {
+		panic(http.ErrAbortHandler) // the server closes the connection without logging
+	}
+
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0) // send a RST instead of a FIN
 	}
-	return execStatus
+	conn.Close()
+	return nil
 }
 
 // execStatus executes the return status of a request
@@ -148,11 +393,23 @@ func execStatus(st *reqState) reqStateFn {
 		resStatus = "200"
 	}
 
+	if code, ok := statusClass(resStatus); ok {
+		resStatus = strconv.Itoa(code)
+	}
+
 	st.status, st.err = strconv.Atoi(resStatus)
 	if st.err != nil {
 		var numError *strconv.NumError
 		if errors.As(st.err, &numError) { // then we're usually looking at words
 			st.err = nil // clear error before the next state
+
+			// the rewrite templates need the request variables and functions
+			if proxy, ok := st.r.Context().Value(ctxKey(resStatus)).(*configProxy); ok {
+				if _, rewrite := proxyPathOptions(st.r, proxy); proxy.RewriteRequest != nil || rewrite != nil {
+					st.proxy = proxy
+					return execAddVariables(make(map[string]cty.Value))
+				}
+			}
 			return execProxyHTTP(resStatus)
 		}
 		st.err = ErrOrderIndexParse.F(st.err)
@@ -163,24 +420,86 @@ func execStatus(st *reqState) reqStateFn {
 	return execAddVariables(varsCtx)
 }
 
+// statusClass returns the first code of a status class,
+// i.e. "2xx" is 200 and "4xx" is 400
+func statusClass(status string) (int, bool) {
+	if len(status) != 3 || !strings.EqualFold(status[1:], "xx") {
+		return 0, false
+	}
+	if status[0] < '1' || status[0] > '5' {
+		return 0, false
+	}
+	return int(status[0]-'0') * 100, true
+}
+
 // useProxy returns the request via a proxy based on the
 // configured proxy. It will take in any headers and send
 // those in the request to the proxy server.
-func useProxy(w http.ResponseWriter, r *http.Request, proxy *configProxy, headers *headers) {
+func useProxy(w http.ResponseWriter, r *http.Request, proxy *configProxy, resHeaders *headers, ctx *hcl.EvalContext) {
 	xy := httputil.NewSingleHostReverseProxy(proxy._url)
+	if proxy.Timeout != nil || proxy.Retries != nil {
+		xy.Transport = proxyTransportFor(proxy)
+	}
+	xy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if he, ok := err.(HandlerError); ok && he.ErrorResponseWriter(w, r) {
+			return // i.e. a request body that is over max_body_bytes
+		}
+		ErrProxyUpstream.F502(proxy.Name, err).(Ext502Error).ErrorResponseWriter(w, r)
+	}
 
-	r.Host = proxy._url.Host
-	r.URL.Host = proxy._url.Host
+	// the same ID is logged for the inbound and proxied requests
+	var correlationID string
+	if proxy.CorrelationHeader != nil {
+		if correlationID = r.Header.Get(*proxy.CorrelationHeader); correlationID == "" {
+			correlationID = newCorrelationID()
+			r.Header.Set(*proxy.CorrelationHeader, correlationID)
+		}
+		log.Printf("[http] [proxy] [%s] inbound %s %s", correlationID, r.Method, r.URL.Path)
+	}
 
-	if headers != nil {
-		for k, vals := range headers.Data {
-			for _, val := range vals {
-				r.Header.Set(k, val.AsString())
+	// the upstream may expect a different path than the mock
+	if strip, rewrite := proxyPathOptions(r, proxy); strip != nil || rewrite != nil {
+		path, dia := proxyPath(r.URL.Path, strip, rewrite, ctx)
+		if dia.HasErrors() {
+			ErrBadHCLExpression.F400(dia).(Ext400Error).ErrorResponseWriter(w, r)
+			return
+		}
+		log.Printf("[http] [proxy] rewriting the path %s to %s ...", r.URL.Path, path)
+		r.URL.Path, r.URL.RawPath = path, ""
+	}
+
+	// save upstream responses, or send saved responses without the upstream
+	if proxy.Mode == ProxyModeRecord || proxy.Mode == ProxyModeReplay {
+		filename, err := proxyRecordingFile(r, proxy)
+		if log.OnErr(err).Printf("[http] [proxy] %s: %v", proxy.Mode, err).HasErr() {
+			if he, ok := err.(HandlerError); ok && he.ErrorResponseWriter(w, r) {
+				return // i.e. a request body that is over max_body_bytes
 			}
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if proxy.Mode == ProxyModeReplay {
+			replayProxy(w, filename)
+			return
 		}
+		xy.ModifyResponse = recordProxy(filename)
+	}
+
+	// check the upstream responses against the expect block
+	if proxy.Mode == ProxyModeContract {
+		xy.ModifyResponse = contractProxy(proxy)
 	}
-	if proxy.Headers != nil {
-		for k, vals := range proxy.Headers.Data {
+
+	r.Host = proxy._url.Host
+	r.URL.Host = proxy._url.Host
+
+	for _, hdrs := range []*headers{resHeaders, proxy.Headers} {
+		if hdrs == nil {
+			continue
+		}
+		data, dia := hdrs.values(headerEvalCtx)
+		log.OnErr(dia).Printf("[http] [proxy] header values: %v", dia)
+		for k, vals := range data {
 			for _, val := range vals {
 				r.Header.Set(k, val.AsString())
 			}
@@ -189,20 +508,218 @@ func useProxy(w http.ResponseWriter, r *http.Request, proxy *configProxy, header
 
 	r.URL.Scheme = proxy._url.Scheme
 	log.Printf("[http] [proxy] to %s", proxy._url.String())
+	if correlationID != "" {
+		log.Printf("[http] [proxy] [%s] proxied %s %s%s", correlationID, r.Method, proxy._url.String(), r.URL.Path)
+	}
 	xy.ServeHTTP(w, r)
 }
 
+// CtxKeyRouteProxy is the context key that holds the route proxy block
+const CtxKeyRouteProxy ctxKey = "_route_proxy_"
+
+// proxyPathOptions returns the strip_prefix and rewrite options for the
+// request, the route proxy options are used over the server proxy options
+func proxyPathOptions(r *http.Request, proxy *configProxy) (strip *string, rewrite *hcl.Attribute) {
+	strip, rewrite = proxy.StripPrefix, proxy.Rewrite
+	if pxy, ok := r.Context().Value(CtxKeyRouteProxy).(*routeProxy); ok {
+		if pxy.StripPrefix != nil {
+			strip = pxy.StripPrefix
+		}
+		if pxy.Rewrite != nil {
+			rewrite = pxy.Rewrite
+		}
+	}
+	return strip, rewrite
+}
+
+// proxyPath returns the path that is sent to the upstream. The prefix is
+// stripped first, then the rewrite template has the stripped path as
+// ${url.path} along with the request variables.
+func proxyPath(path string, strip *string, rewrite *hcl.Attribute, ctx *hcl.EvalContext) (string, hcl.Diagnostics) {
+	if strip != nil {
+		path = "/" + strings.TrimPrefix(strings.TrimPrefix(path, *strip), "/")
+	}
+	if rewrite == nil {
+		return path, nil
+	}
+	if tmpl, ok := rewrite.Expr.(*hclsyntax.TemplateExpr); ok {
+		templateIndexes(tmpl)
+	}
+
+	if ctx == nil {
+		ctx = &hcl.EvalContext{}
+	}
+	vars := make(map[string]cty.Value, len(ctx.Variables)+1)
+	for k, v := range ctx.Variables {
+		vars[k] = v
+	}
+
+	urlCtx := make(map[string]cty.Value)
+	if u, ok := vars["url"]; ok && !u.IsNull() && u.Type().IsObjectType() {
+		urlCtx = u.AsValueMap()
+	}
+	if _, ok := urlCtx["path"]; !ok { // a path route param is kept
+		urlCtx["path"] = cty.StringVal(path)
+	}
+	vars["url"] = cty.ObjectVal(urlCtx)
+
+	val, dia := rewrite.Expr.Value(&hcl.EvalContext{Variables: vars, Functions: ctx.Functions})
+	if dia.HasErrors() {
+		return "", dia
+	}
+	val, err := ctyconvert.Convert(val, cty.String)
+	if err != nil || val.IsNull() {
+		return "", hcl.Diagnostics{{Severity: hcl.DiagError, Summary: "Invalid proxy rewrite", Detail: "The rewrite must be a string path."}}
+	}
+	return val.AsString(), nil
+}
+
+// newCorrelationID returns a random ID for a proxied request
+func newCorrelationID() string {
+	b := make([]byte, 16)
+	_, err := crand.Read(b)
+	log.OnErr(err).Printf("[http] [proxy] creating a correlation ID: %v", err)
+	return hex.EncodeToString(b)
+}
+
+// proxyTransports are the upstream transports of each proxy,
+// so the connections are reused across requests
+var proxyTransports sync.Map
+
+// closeProxyTransports removes the upstream transports of each proxy, the
+// proxy configs are replaced on a reload so the transports aren't used again
+func closeProxyTransports() {
+	proxyTransports.Range(func(proxy, rt interface{}) bool {
+		proxyTransports.Delete(proxy)
+		if tr, ok := rt.(proxyTransport).RoundTripper.(*http.Transport); ok {
+			tr.CloseIdleConnections()
+		}
+		return true
+	})
+}
+
+// proxyTransportFor returns the upstream transport of the proxy, with
+// the timeout and retries of the proxy config
+func proxyTransportFor(proxy *configProxy) http.RoundTripper {
+	if tr, ok := proxyTransports.Load(proxy); ok {
+		return tr.(http.RoundTripper)
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy.Timeout != nil {
+		timeout := delay(*proxy.Timeout)
+		tr.DialContext = (&net.Dialer{Timeout: timeout}).DialContext
+		tr.TLSHandshakeTimeout = timeout
+		tr.ResponseHeaderTimeout = timeout
+	}
+
+	var retries int
+	if proxy.Retries != nil {
+		retries = *proxy.Retries
+	}
+
+	rt, _ := proxyTransports.LoadOrStore(proxy, proxyTransport{RoundTripper: tr, retries: retries})
+	return rt.(http.RoundTripper)
+}
+
+// proxyRetryable returns true when the request can be sent to the upstream
+// again, which are the idempotent methods or requests with an idempotency key
+func proxyRetryable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get("Idempotency-Key") != ""
+}
+
+// proxyTransport tries a failed upstream request again, up to the number
+// of retries, the body is held (up to max_body_bytes) so it can be sent again
+type proxyTransport struct {
+	http.RoundTripper
+	retries int
+}
+
+// RoundTrip satisfies the http.RoundTripper interface
+func (t proxyTransport) RoundTrip(r *http.Request) (res *http.Response, err error) {
+	if t.retries == 0 || !proxyRetryable(r) {
+		return t.RoundTripper.RoundTrip(r)
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err = readBody(r)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 0; i <= t.retries; i++ {
+		if body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		if res, err = t.RoundTripper.RoundTrip(r); err == nil {
+			return res, nil
+		}
+		log.Printf("[http] [proxy] upstream try %d of %d: %v", i+1, t.retries+1, err)
+		if r.Context().Err() != nil {
+			break // the client has gone away
+		}
+	}
+	return nil, err
+}
+
 // execProxyHTTP executes a proxy server if the state requires it
 func execProxyHTTP(resStatus string) reqStateFn {
 	return func(st *reqState) reqStateFn {
 		if proxy, ok := st.r.Context().Value(ctxKey(resStatus)).(*configProxy); ok {
-			useProxy(st.w, st.r, proxy, st.res.Headers)
+			useProxy(st.w, st.r, proxy, st.res.Headers, nil)
 		}
 		st.err = nil // exit smoothly regardless of past transgressions
 		return nil
 	}
 }
 
+// execProxyRewrite replaces the request body with the proxy
+// rewrite template before the request is sent to the proxy
+func execProxyRewrite(st *reqState) reqStateFn {
+	ctx := &hcl.EvalContext{Variables: st.vars, Functions: st.funs}
+	if st.proxy.RewriteRequest == nil {
+		useProxy(st.w, st.r, st.proxy, st.res.Headers, ctx) // only the path is rewritten
+		return nil
+	}
+
+	if tmpl, ok := st.proxy.RewriteRequest.Expr.(*hclsyntax.TemplateExpr); ok {
+		templateIndexes(tmpl)
+	}
+
+	val, dia := st.proxy.RewriteRequest.Expr.Value(ctx)
+	if dia.HasErrors() {
+		st.err = ErrBadHCLExpression.F400(dia)
+		return nil
+	}
+
+	var body []byte
+	if val.Type() == cty.String {
+		body = []byte(val.AsString())
+	} else {
+		b, err := json.Marshal(ctyjson.SimpleJSONValue{Value: val})
+		if err != nil {
+			st.err = ErrBadHCLExpression.F400(err)
+			return nil
+		}
+		body = b
+	}
+
+	log.Printf("[http] [proxy] rewriting the request body for %s ...", st.proxy.Name)
+	setBody(st.r, body)
+	st.r.ContentLength = int64(len(body))
+	st.r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	useProxy(st.w, st.r, st.proxy, st.res.Headers, ctx)
+	return nil
+}
+
 // execAddVariables gathers all of the HIL variables that
 // can be used in a HTTP request/response
 func execAddVariables(varsCtx map[string]cty.Value) reqStateFn {
@@ -214,6 +731,9 @@ func execAddVariables(varsCtx map[string]cty.Value) reqStateFn {
 		if _, ok := varsCtx["header"]; !ok {
 			return execVarCtxHeader(varsCtx)
 		}
+		if _, ok := varsCtx["cookie"]; !ok {
+			return execVarCtxCookie(varsCtx)
+		}
 		if _, ok := varsCtx["query"]; !ok {
 			return execVarCtxQuery(varsCtx)
 		}
@@ -229,6 +749,9 @@ func execAddVariables(varsCtx map[string]cty.Value) reqStateFn {
 		if _, ok := varsCtx["plugin"]; !ok {
 			return execVarCtxPlugin(varsCtx)
 		}
+		if _, ok := varsCtx["tls"]; !ok {
+			return execVarCtxTLS(varsCtx)
+		}
 
 		st.vars = varsCtx
 
@@ -237,6 +760,16 @@ func execAddVariables(varsCtx map[string]cty.Value) reqStateFn {
 	}
 }
 
+// requestVars returns the HIL variables of the request, so plugins can
+// template with the same variables as the response
+func requestVars(r *http.Request) (map[string]cty.Value, error) {
+	st := &reqState{r: r}
+	for fn := execAddVariables(make(map[string]cty.Value)); fn != nil && st.vars == nil; {
+		fn = fn(st)
+	}
+	return st.vars, st.err
+}
+
 // execAddFunctions gathers all of the HIL functions that can be
 // used during the HTTP request/response
 func execAddFunctions(funsCtx map[string]function.Function) reqStateFn {
@@ -252,42 +785,194 @@ func execAddFunctions(funsCtx map[string]function.Function) reqStateFn {
 
 		st.funs = funsCtx
 
+		if st.proxy != nil {
+			return execProxyRewrite
+		}
+		return execScript
+	}
+}
+
+// execScript executes the request script. Each script value is evaluated
+// in the order it is written, and can use the values set before it. The
+// values are available as ${script.<name>} and setting `status` changes
+// the status of the response.
+func execScript(st *reqState) reqStateFn {
+	if st.req.Script == nil || !_featureScript {
 		return execResponseHeaders
 	}
+
+	attrs := make([]*hcl.Attribute, 0, len(st.req.Script.Vars))
+	for _, attr := range st.req.Script.Vars {
+		attrs = append(attrs, attr)
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Range.Start.Byte < attrs[j].Range.Start.Byte })
+
+	scriptCtx := make(map[string]cty.Value)
+	for _, attr := range attrs {
+		st.vars["script"] = cty.ObjectVal(scriptCtx)
+		val, dia := attr.Expr.Value(&hcl.EvalContext{Variables: st.vars, Functions: st.funs})
+		if dia.HasErrors() {
+			st.err = ErrBadHCLExpression.F400(dia)
+			return nil
+		}
+		scriptCtx[attr.Name] = val
+	}
+	st.vars["script"] = cty.ObjectVal(scriptCtx)
+
+	if status, ok := scriptCtx["status"]; ok && status.IsKnown() && !status.IsNull() {
+		switch status.Type() {
+		case cty.Number:
+			n, _ := status.AsBigFloat().Int64()
+			st.status = int(n)
+		case cty.String:
+			if st.status, st.err = strconv.Atoi(status.AsString()); st.err != nil {
+				st.err = ErrScriptStatusParse.F(st.err)
+				return nil
+			}
+		}
+	}
+
+	return execResponseHeaders
 }
 
 // execVarCtxRequest executes gathering HIL Request variables
 func execVarCtxRequest(varsCtx map[string]cty.Value) reqStateFn {
 	return func(st *reqState) reqStateFn {
+		requestCtx := make(map[string]cty.Value)
+		requestCtx["query_string"] = cty.StringVal(st.r.URL.RawQuery) // as sent, for pass-through or signing
+		if st.seq != "" {
+			requestCtx["state"] = cty.StringVal(st.seq)
+		}
+		if st.r.TLS != nil && len(st.r.TLS.PeerCertificates) > 0 {
+			requestCtx["client_cert"] = clientCertValue(st.r.TLS.PeerCertificates[0])
+		}
+		if traceID, _, ok := parseTraceParent(st.r.Header.Get(HeaderTraceParent)); ok {
+			requestCtx["trace_id"] = cty.StringVal(traceID)
+		}
+
 		if st.r.Method != http.MethodPost {
-			varsCtx["request"] = cty.NilVal
+			varsCtx["request"] = cty.ObjectVal(requestCtx)
 			return execAddVariables(varsCtx)
 		}
 
-		body, err := ioutil.ReadAll(io.LimitReader(st.r.Body, (2^20)*10)) // 10MB limit
+		body, err := readBody(st.r)
 		if err != nil {
-			st.err = ErrReadRequestBody.F(err)
+			st.err = err
 			return nil
 		}
-		requestCtx := map[string]cty.Value{
-			"body": cty.StringVal(string(body)),
-		}
+		requestCtx["body"] = cty.StringVal(string(body))
 
 		varsCtx["request"] = cty.ObjectVal(requestCtx)
 		return execAddVariables(varsCtx)
 	}
 }
 
+// DefaultMaxBodyBytes is the most bytes of a request body that are
+// read for templates, unless the server has a max_body_bytes
+var DefaultMaxBodyBytes int64 = 10 << 20 // 10MB
+
+// CtxKeyMaxBodyBytes is the context key that holds the server max_body_bytes
+const CtxKeyMaxBodyBytes ctxKey = "_max_body_bytes_"
+
+// readBody reads the request body, a body that is over the max body
+// bytes is an error instead of being truncated. A buffered body is read
+// from the start and the body is put back so it can be read again.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil // a client request that was made without a body
+	}
+
+	max := DefaultMaxBodyBytes
+	if n, ok := r.Context().Value(CtxKeyMaxBodyBytes).(int64); ok {
+		max = n
+	}
+
+	rd := r.Body
+	if r.GetBody != nil {
+		var err error
+		if rd, err = r.GetBody(); err != nil {
+			return nil, ErrReadRequestBody.F(err)
+		}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(rd, max+1))
+	if err != nil {
+		return nil, ErrReadRequestBody.F(err)
+	}
+	if int64(len(body)) > max {
+		return nil, ErrRequestBodyTooLarge.F413(max)
+	}
+	setBody(r, body)
+	return body, nil
+}
+
+// execVarCtxTLS executes gathering HIL variables from the verified
+// client certificate, the values are empty when there isn't one
+func execVarCtxTLS(varsCtx map[string]cty.Value) reqStateFn {
+	return func(st *reqState) reqStateFn {
+		var cn, subject string
+		if st.r.TLS != nil && len(st.r.TLS.VerifiedChains) > 0 && len(st.r.TLS.VerifiedChains[0]) > 0 {
+			cert := st.r.TLS.VerifiedChains[0][0]
+			cn, subject = cert.Subject.CommonName, cert.Subject.String()
+		}
+
+		varsCtx["tls"] = cty.ObjectVal(map[string]cty.Value{
+			"client_cn":       cty.StringVal(cn),
+			"client_subject":  cty.StringVal(subject),
+			"client_verified": cty.BoolVal(subject != ""),
+		})
+		return execAddVariables(varsCtx)
+	}
+}
+
+// clientCertValue returns the client certificate values that can be used
+// in templates, i.e. ${request.client_cert.subject}
+func clientCertValue(cert *x509.Certificate) cty.Value {
+	var sans []cty.Value
+	for _, name := range cert.DNSNames {
+		sans = append(sans, cty.StringVal(name))
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, cty.StringVal(email))
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, cty.StringVal(ip.String()))
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, cty.StringVal(uri.String()))
+	}
+
+	sansVal := cty.ListValEmpty(cty.String)
+	if len(sans) > 0 {
+		sansVal = cty.ListVal(sans)
+	}
+
+	var serial string
+	if cert.SerialNumber != nil {
+		serial = cert.SerialNumber.String()
+	}
+
+	return cty.ObjectVal(map[string]cty.Value{
+		"subject":     cty.StringVal(cert.Subject.String()),
+		"common_name": cty.StringVal(cert.Subject.CommonName),
+		"issuer":      cty.StringVal(cert.Issuer.String()),
+		"serial":      cty.StringVal(serial),
+		"sans":        sansVal,
+	})
+}
+
 // execVarCtxHeader executes gathering HIL Request Header variables
 func execVarCtxHeader(varsCtx map[string]cty.Value) reqStateFn {
 	return func(st *reqState) reqStateFn {
 		params := st.r.Header
 		if len(params) == 0 {
 			varsCtx["header"] = cty.NilVal
+			varsCtx["header_map"] = cty.NilVal
 			return execAddVariables(varsCtx)
 		}
 
 		headerCtx := make(map[string]cty.Value)
+		headerMapCtx := make(map[string]cty.Value) // the first value only, i.e. ${header_map.x-custom}
 		for k, vals := range params {
 			indexCtx := make(map[string]cty.Value)
 			for i, val := range vals {
@@ -295,9 +980,44 @@ func execVarCtxHeader(varsCtx map[string]cty.Value) reqStateFn {
 			}
 			k = strings.ToLower(k)
 			headerCtx[k] = cty.ObjectVal(indexCtx)
+			if len(vals) > 0 {
+				headerMapCtx[k] = cty.StringVal(vals[0])
+			}
 		}
 
 		varsCtx["header"] = cty.ObjectVal(headerCtx)
+		varsCtx["header_map"] = cty.ObjectVal(headerMapCtx)
+		return execAddVariables(varsCtx)
+	}
+}
+
+// execVarCtxCookie executes gathering HIL Request Cookie variables, cookies
+// can be sent more than once with the same name so they are indexed
+// like headers, i.e. ${cookie.session.1}
+func execVarCtxCookie(varsCtx map[string]cty.Value) reqStateFn {
+	return func(st *reqState) reqStateFn {
+		cookies := st.r.Cookies()
+		if len(cookies) == 0 {
+			varsCtx["cookie"] = cty.NilVal
+			return execAddVariables(varsCtx)
+		}
+
+		indexes := make(map[string]map[string]cty.Value)
+		for _, cookie := range cookies {
+			indexCtx, ok := indexes[cookie.Name] // cookie names are case sensitive
+			if !ok {
+				indexCtx = make(map[string]cty.Value)
+				indexes[cookie.Name] = indexCtx
+			}
+			indexCtx[strconv.Itoa(len(indexCtx))] = cty.StringVal(cookie.Value)
+		}
+
+		cookieCtx := make(map[string]cty.Value)
+		for k, indexCtx := range indexes {
+			cookieCtx[k] = cty.ObjectVal(indexCtx)
+		}
+
+		varsCtx["cookie"] = cty.ObjectVal(cookieCtx)
 		return execAddVariables(varsCtx)
 	}
 }
@@ -346,11 +1066,22 @@ func execVarCtxPath(varsCtx map[string]cty.Value) reqStateFn {
 	}
 }
 
-// execVarCtxPost executes gathering HIL Request POST variables
+// execVarCtxPost executes gathering HIL Request POST variables,
+// uploaded files have the filename, size and content_type available
 func execVarCtxPost(varsCtx map[string]cty.Value) reqStateFn {
 	return func(st *reqState) reqStateFn {
+		if st.r.MultipartForm == nil && strings.HasPrefix(st.r.Header.Get("Content-Type"), "multipart/form-data") {
+			err := st.r.ParseMultipartForm(32 << 20) // 32MB in memory, the rest is stored in temp files
+			log.OnErr(err).Printf("[http] parse multipart form: %v", err)
+		}
+
+		var files map[string][]*multipart.FileHeader
+		if st.r.MultipartForm != nil {
+			files = st.r.MultipartForm.File
+		}
+
 		params := st.r.Form
-		if params == nil || len(params) == 0 {
+		if len(params) == 0 && len(files) == 0 {
 			varsCtx["post"] = cty.NilVal
 			return execAddVariables(varsCtx)
 		}
@@ -365,6 +1096,21 @@ func execVarCtxPost(varsCtx map[string]cty.Value) reqStateFn {
 			postCtx[k] = cty.ObjectVal(indexCtx)
 		}
 
+		for k, fhs := range files {
+			if len(fhs) == 0 {
+				continue
+			}
+			indexCtx := make(map[string]cty.Value)
+			for i, fh := range fhs {
+				indexCtx[strconv.Itoa(i)] = cty.StringVal(fh.Filename)
+			}
+			indexCtx["filename"] = cty.StringVal(fhs[0].Filename)
+			indexCtx["size"] = cty.NumberIntVal(fhs[0].Size)
+			indexCtx["content_type"] = cty.StringVal(fhs[0].Header.Get("Content-Type"))
+			k = strings.ToLower(k)
+			postCtx[k] = cty.ObjectVal(indexCtx)
+		}
+
 		varsCtx["post"] = cty.ObjectVal(postCtx)
 		return execAddVariables(varsCtx)
 	}
@@ -423,7 +1169,19 @@ func execVarCtxPlugin(varsCtx map[string]cty.Value) reqStateFn {
 func execFunCtxStandard(funsCtx map[string]function.Function) reqStateFn {
 	return func(st *reqState) reqStateFn {
 		funsCtx["file"] = FileToStr("", "")
-		funsCtx["text"] = TextBlockToStr(st.txts)
+		funsCtx["file_lines"] = FileLinesToStr("", "")
+		strict, _ := st.r.Context().Value(CtxKeyStrictText).(bool)
+		funsCtx["text"] = TextBlockToStr(st.txts, strict)
+		funsCtx["jsonpointer"] = JSONPointerToStr
+		funsCtx["urlencode"] = URLEncodeToStr
+		funsCtx["urldecode"] = URLDecodeToStr
+		funsCtx["env"] = EnvToStr
+		funsCtx["must_env"] = MustEnvToStr
+		funsCtx["dependency"] = DependencyToStr
+		funsCtx["jwt_sign"] = JWTSignToStr(st.r.Context())
+		funsCtx["fragment"] = FragmentToStr(st.req.fragments, func() *hcl.EvalContext {
+			return &hcl.EvalContext{Variables: st.vars, Functions: st.funs}
+		})
 		funsCtx["standard placeholder"] = function.Function{} // a placeholder, standard functions have a different root
 		return execAddFunctions(funsCtx)
 	}
@@ -452,26 +1210,325 @@ func execFunCtxPlugin(funsCtx map[string]function.Function) reqStateFn {
 // execResponseHeaders executes adding response headers to the response
 func execResponseHeaders(st *reqState) reqStateFn {
 	if st.res.Headers == nil {
-		return execOutput
+		return execSignedCookies
+	}
+
+	for _, attr := range st.res.Headers.Attrs {
+		headerIndexes(attr.Expr)
+	}
+
+	ctx := &hcl.EvalContext{Variables: st.vars, Functions: st.funs}
+	data, dia := st.res.Headers.values(ctx)
+	if dia.HasErrors() {
+		st.err = ErrBadHCLExpression.F400(dia)
+		return nil
 	}
 
-	for k, vals := range st.res.Headers.Data {
+	for k, vals := range data {
 		for _, val := range vals {
 			st.w.Header().Add(k, val.AsString())
 		}
 	}
+	return execSignedCookies
+}
+
+// headerIndexes adds the implied indexes to the templates of
+// a header value, which can be a list of templates
+func headerIndexes(expr hcl.Expression) {
+	switch ex := expr.(type) {
+	case *hclsyntax.TemplateExpr:
+		templateIndexes(ex)
+	case *hclsyntax.TupleConsExpr:
+		for _, ex := range ex.Exprs {
+			headerIndexes(ex)
+		}
+	}
+}
+
+// execSignedCookies executes setting the cookies with
+// the templated values signed with the server secret
+func execSignedCookies(st *reqState) reqStateFn {
+	if len(st.res.SignedCookie) == 0 {
+		return execDownload
+	}
+
+	secret, ok := st.r.Context().Value(CtxKeyCookieSecret).([]byte)
+	if !ok {
+		st.err = ErrCookieSecretNotFound
+		return nil
+	}
+
+	ctx := &hcl.EvalContext{Variables: st.vars, Functions: st.funs}
+	for _, cookie := range st.res.SignedCookie {
+		if tmpl, ok := cookie.Value.Expr.(*hclsyntax.TemplateExpr); ok {
+			templateIndexes(tmpl)
+		}
+
+		val, dia := cookie.Value.Expr.Value(ctx)
+		if dia.HasErrors() {
+			st.err = ErrBadHCLExpression.F400(dia)
+			return nil
+		}
+		if val.Type() != cty.String {
+			st.err = ErrBadHCLExpression.F400(fmt.Sprintf("the %q signed cookie value must be a string", cookie.Name))
+			return nil
+		}
+
+		http.SetCookie(st.w, &http.Cookie{
+			Name:     cookie.Name,
+			Value:    signCookie(secret, cookie.Name, val.AsString()),
+			Path:     "/",
+			HttpOnly: true,
+		})
+	}
+	return execDownload
+}
+
+// execDownload executes adding a Content-Disposition header
+// with the templated filename so the response is downloaded
+func execDownload(st *reqState) reqStateFn {
+	if st.res.Download == nil {
+		return execOutput
+	}
+
+	if tmpl, ok := st.res.Download.Expr.(*hclsyntax.TemplateExpr); ok {
+		templateIndexes(tmpl)
+	}
+
+	ctx := &hcl.EvalContext{Variables: st.vars, Functions: st.funs}
+	filename, dia := st.res.Download.Expr.Value(ctx)
+	if dia.HasErrors() {
+		st.err = ErrBadHCLExpression.F400(dia)
+		return nil
+	}
+
+	name := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(filename.AsString())
+	st.w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
 	return execOutput
 }
 
 // execOutput executes determining if the output is a JWT or some other output,
 // which is currently a body
 func execOutput(st *reqState) reqStateFn {
+	if st.res.BodyFile != nil {
+		return execBodyFileOutput
+	}
+	if st.req.JSONRPC != nil || st.res.JSONRPCError != nil {
+		return execJSONRPCOutput
+	}
 	if st.res.JWT != nil {
 		return execJWTOutput
 	}
+	if st.res.MergePatch != nil {
+		return execMergePatchOutput
+	}
+	if st.res.BodyYAML != nil {
+		return execYAMLOutput
+	}
+	if st.res.EchoHeaders {
+		return execEchoHeadersOutput
+	}
 	return execBodyOutput
 }
 
+// jsonRPCResponse is a JSON-RPC 2.0 response envelope, it has
+// either a result or an error
+type jsonRPCResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// jsonRPCError is the error object of a JSON-RPC response
+type jsonRPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// execJSONRPCOutput executes wrapping the body in a JSON-RPC envelope
+// with the request id. The body is the result, a string body that isn't
+// JSON is sent as a JSON string.
+func execJSONRPCOutput(st *reqState) reqStateFn {
+	ctx := &hcl.EvalContext{Variables: st.vars, Functions: st.funs}
+	jsonValue := func(attr *hcl.Attribute) (json.RawMessage, error) {
+		if attr == nil {
+			return json.RawMessage("null"), nil
+		}
+		if tmpl, ok := attr.Expr.(*hclsyntax.TemplateExpr); ok {
+			templateIndexes(tmpl)
+		}
+		val, dia := attr.Expr.Value(ctx)
+		if dia.HasErrors() {
+			return nil, dia
+		}
+		if val.Type() == cty.String && json.Valid([]byte(val.AsString())) {
+			return json.RawMessage(val.AsString()), nil
+		}
+		return json.Marshal(ctyjson.SimpleJSONValue{Value: val})
+	}
+
+	out := jsonRPCResponse{Version: "2.0", ID: json.RawMessage("null")}
+	if id, ok := st.r.Context().Value(CtxKeyJSONRPCID).(json.RawMessage); ok && len(id) > 0 {
+		out.ID = id
+	}
+
+	var err error
+	if e := st.res.JSONRPCError; e != nil {
+		out.Error = &jsonRPCError{Code: e.Code, Message: e.Message}
+		if e.Data != nil {
+			out.Error.Data, err = jsonValue(e.Data)
+		}
+	} else {
+		out.Result, err = jsonValue(st.res.Body)
+	}
+	if err != nil {
+		st.err = ErrBadHCLExpression.F400(err)
+		return nil
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		st.err = ErrBadHCLExpression.F400(err)
+		return nil
+	}
+
+	st.w.Header().Set("Content-Type", "application/json")
+	return finish(string(b))
+}
+
+// CtxKeyFs is the context key that holds the file system that body files are read from
+const CtxKeyFs ctxKey = "_fs_"
+
+// execBodyFileOutput executes streaming the body file to the output, so big
+// files are not loaded into memory. A 200 is sent with ServeContent, which
+// handles Range and conditional requests.
+func execBodyFileOutput(st *reqState) reqStateFn {
+	filename := runtimeFilePath(*st.res.BodyFile)
+	if rel, err := filepath.Rel(_runtimePath, filename); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		st.err = ErrBodyFile.F(*st.res.BodyFile, "it is outside of the runtime path")
+		return nil
+	}
+
+	fs, ok := st.r.Context().Value(CtxKeyFs).(afero.Fs)
+	if !ok {
+		fs = afero.NewOsFs()
+	}
+
+	f, err := fs.Open(filename)
+	if err != nil {
+		st.err = ErrBodyFile.F(*st.res.BodyFile, err)
+		return nil
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		st.err = ErrBodyFile.F(*st.res.BodyFile, err)
+		return nil
+	}
+
+	if st.res.TTFBDelay != nil {
+		time.Sleep(delay(*st.res.TTFBDelay))
+	}
+	if st.res.CloseConnection {
+		st.w.Header().Set("Connection", "close")
+	}
+
+	switch {
+	case st.res.Chunked:
+		streamChunked(st.w, st.status, f)
+	case st.status == http.StatusOK:
+		http.ServeContent(st.w, st.r, fi.Name(), fi.ModTime(), f)
+	default:
+		st.w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		st.w.WriteHeader(int(st.status))
+		_, err = io.Copy(st.w, f)
+		log.OnErr(err).Printf("[http] streaming the body file %q: %v", *st.res.BodyFile, err)
+	}
+	return nil
+}
+
+// streamChunked copies the reader in chunks, flushing after each one so
+// that the server uses chunked transfer encoding instead of a Content-Length
+func streamChunked(w http.ResponseWriter, status int, rd io.Reader) {
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+
+	fl, ok := flusher(w)
+	if !ok {
+		log.Printf("[http] the %d response can't be chunked, sending it all at once ...", status)
+		_, err := io.Copy(w, rd)
+		log.OnErr(err).Printf("[http] streaming the %d response: %v", status, err)
+		return
+	}
+	fl.Flush() // the headers are sent without a Content-Length
+
+	buf := make([]byte, DefaultChunkSize)
+	for {
+		n, err := rd.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n])
+			fl.Flush()
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[http] streaming the %d response: %v", status, err)
+			}
+			return
+		}
+	}
+}
+
+// execEchoHeadersOutput executes sending back all of the request
+// headers as a JSON object of each header name and its values
+func execEchoHeadersOutput(st *reqState) reqStateFn {
+	b, err := json.Marshal(st.r.Header)
+	if err != nil {
+		st.err = ErrBadHCLExpression.F400(err)
+		return nil
+	}
+
+	st.w.Header().Set("Content-Type", "application/json")
+	return finish(string(b))
+}
+
+// execYAMLOutput executes templating the YAML body, which is sent as
+// JSON, or as YAML with a YAML content type when serve_yaml is set
+func execYAMLOutput(st *reqState) reqStateFn {
+	if tmpl, ok := st.res.BodyYAML.Expr.(*hclsyntax.TemplateExpr); ok {
+		templateIndexes(tmpl)
+	}
+
+	ctx := &hcl.EvalContext{Variables: st.vars, Functions: st.funs}
+	expr, dia := st.res.BodyYAML.Expr.Value(ctx)
+	if dia.HasErrors() {
+		st.err = ErrBadHCLExpression.F400(dia)
+		return nil
+	}
+
+	var doc interface{}
+	if err := yaml.Unmarshal([]byte(expr.AsString()), &doc); err != nil {
+		st.err = ErrYAMLBody.F(err)
+		return nil
+	}
+
+	if st.res.ServeYAML {
+		st.w.Header().Set("Content-Type", "application/yaml")
+		return finish(expr.AsString())
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		st.err = ErrYAMLBody.F(err)
+		return nil
+	}
+
+	st.w.Header().Set("Content-Type", "application/json")
+	return finish(string(b))
+}
+
 // execJWTOutput executes gathering all of the JWT values for output
 // this includes using the variable, and function contexts to determine
 // the final output of values
@@ -526,15 +1583,38 @@ func execBodyOutput(st *reqState) reqStateFn {
 // that don't have an index but should.
 func execBodyTemplateOutput(st *reqState) reqStateFn {
 	body, _ := st.res.Body.Expr.(*hclsyntax.TemplateExpr)
+	templateIndexes(body)
+	return execBodyValueOutput
+}
+
+// templateIndexed holds a *sync.Once for each template, the templates
+// are shared by all requests so the indexes are only added once
+var templateIndexed sync.Map
 
+// templateIndexes adds the 0 indexes to the template the first time
+// it's used, later requests wait until they have been added
+func templateIndexes(tmpl *hclsyntax.TemplateExpr) {
+	if tmpl == nil {
+		return
+	}
+	once, _ := templateIndexed.LoadOrStore(tmpl, new(sync.Once))
+	once.(*sync.Once).Do(func() { appendTemplateIndexes(tmpl) })
+}
+
+// appendTemplateIndexes appends a 0 index to the header, cookie, query
+// and post template variables that don't have an index
+func appendTemplateIndexes(tmpl *hclsyntax.TemplateExpr) {
 LookForIndexes:
-	for i, part := range body.Parts {
+	for i, part := range tmpl.Parts {
 		variables := part.Variables()
 		for _, vars := range variables {
+			if len(vars) > 2 {
+				continue // there is more than the root and name, i.e. post.upload.filename
+			}
 			for _, v := range vars {
 				if root, ok := v.(hcl.TraverseRoot); ok {
 					switch root.Name {
-					case "header", "query", "post":
+					case "header", "cookie", "query", "post":
 						continue
 					}
 					break LookForIndexes
@@ -544,16 +1624,9 @@ LookForIndexes:
 				}
 			}
 
-			// append the index to header, query and post values that don't have one.
-			st.
-				res.Body.
-				Expr.(*hclsyntax.TemplateExpr).
-				Parts[i].(*hclsyntax.ScopeTraversalExpr).
-				Traversal = append(st.
-				res.Body.
-				Expr.(*hclsyntax.TemplateExpr).
-				Parts[i].(*hclsyntax.ScopeTraversalExpr).
-				Traversal, hcl.TraverseIndex{
+			// append the index to header, cookie, query and post values that don't have one.
+			trv := tmpl.Parts[i].(*hclsyntax.ScopeTraversalExpr)
+			trv.Traversal = append(trv.Traversal, hcl.TraverseIndex{
 				SrcRange: hcl.Range{
 					Filename: "internal",
 				},
@@ -561,7 +1634,6 @@ LookForIndexes:
 			})
 		}
 	}
-	return execBodyValueOutput
 }
 
 // execBodyValueOutput resolves all of the function/variables
@@ -588,6 +1660,77 @@ func execBodyValueOutput(st *reqState) reqStateFn {
 	return finish(string(b))
 }
 
+// execMergePatchOutput executes applying the request body as a
+// JSON merge patch (RFC 7386) to the merge_patch base value
+func execMergePatchOutput(st *reqState) reqStateFn {
+	ctx := &hcl.EvalContext{Variables: st.vars, Functions: st.funs}
+
+	expr, dia := st.res.MergePatch.Expr.Value(ctx)
+	if dia.HasErrors() {
+		st.err = ErrBadHCLExpression.F400(dia)
+		return nil
+	}
+
+	var base []byte
+	if expr.Type() == cty.String {
+		base = []byte(expr.AsString())
+	} else if base, st.err = json.Marshal(ctyjson.SimpleJSONValue{Value: expr}); st.err != nil {
+		st.err = ErrBadHCLExpression.F400(st.err)
+		return nil
+	}
+
+	var patch []byte
+	if st.r.Method == http.MethodPost { // the body has already been read
+		patch = []byte(st.vars["request"].GetAttr("body").AsString())
+	} else if patch, st.err = readBody(st.r); st.err != nil {
+		return nil
+	}
+
+	var target, doc interface{}
+	if err := json.Unmarshal(base, &target); err != nil {
+		st.err = ErrMergePatch.F(err)
+		return nil
+	}
+	if err := json.Unmarshal(patch, &doc); err != nil {
+		st.err = ErrMergePatch.F400(err)
+		return nil
+	}
+
+	b, err := json.Marshal(mergePatch(target, doc))
+	if err != nil {
+		st.err = ErrMergePatch.F(err)
+		return nil
+	}
+
+	if st.w.Header().Get("Content-Type") == "" {
+		st.w.Header().Set("Content-Type", "application/json")
+	}
+	return finish(string(b))
+}
+
+// mergePatch returns the target with the patch applied. A patch that is
+// not an object replaces the target, and null values remove keys.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+			continue
+		}
+		targetObj[k] = mergePatch(targetObj[k], v)
+	}
+	return targetObj
+}
+
 // finished writes an empty string to the output
 func finished(st *reqState) reqStateFn { return finish("") }
 
@@ -595,6 +1738,63 @@ func finished(st *reqState) reqStateFn { return finish("") }
 // that was deterimed during the execStatus stage.
 func finish(out string) reqStateFn {
 	return func(st *reqState) reqStateFn {
+		if st.res.TTFBDelay != nil {
+			time.Sleep(delay(*st.res.TTFBDelay))
+		}
+
+		if st.res.CorruptRate != nil && st.req.rand.Float64() < *st.res.CorruptRate {
+			out = corruptBody(st.req.rand, out)
+		}
+
+		// send back a 206 with only the requested bytes, the
+		// other response options still apply to the part sent
+		if st.status == http.StatusOK && st.r.Header.Get("Range") != "" {
+			start, end, valid, satisfiable := byteRange(st.r.Header.Get("Range"), len(out))
+			switch {
+			case valid && !satisfiable:
+				st.w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(out)))
+				st.w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return nil
+			case valid:
+				st.w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(out)))
+				st.status, out = http.StatusPartialContent, out[start:end+1]
+			}
+			st.w.Header().Set("Accept-Ranges", "bytes")
+		}
+
+		// net/http closes the connection after the response because of the
+		// header, so only a reason or raw headers need a hijacked connection
+		if st.res.CloseConnection {
+			st.w.Header().Set("Connection", "close")
+		}
+
+		if st.res.Reason != nil || len(st.res.RawHeaders) > 0 {
+			reason := http.StatusText(st.status)
+			if st.res.Reason != nil {
+				reason = *st.res.Reason
+			}
+			if writeReason(st.w, st.r, st.status, reason, st.res.RawHeaders, out) {
+				return nil
+			}
+		}
+
+		if st.res.TransferDelay != nil {
+			writeTransfer(st.w, st.status, out, delay(*st.res.TransferDelay))
+			return nil
+		}
+
+		if st.res.Chunked {
+			writeChunked(st.w, st.status, out)
+			return nil
+		}
+
+		// only compress bodies that are big enough to be worth it, a
+		// partial body isn't compressed because the range is of the raw bytes
+		if min := st.res.MinCompressSize; min != nil && len(out) >= *min && acceptsGzip(st.r) && st.status != http.StatusPartialContent {
+			writeGzip(st.w, st.status, out)
+			return nil
+		}
+
 		st.w.WriteHeader(int(st.status))
 		fmt.Fprint(st.w, out)
 
@@ -602,21 +1802,300 @@ func finish(out string) reqStateFn {
 	}
 }
 
+// byteRange returns the first and last byte of a single "bytes=" range of a
+// body that is size bytes long. A Range header that isn't valid, or that has
+// more than one range, is not valid and the whole body is sent instead.
+func byteRange(header string, size int) (start, end int, valid, satisfiable bool) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, 0, false, false
+	}
+
+	ab := strings.SplitN(strings.TrimPrefix(header, "bytes="), "-", 2)
+	if len(ab) != 2 {
+		return 0, 0, false, false
+	}
+	a, b := strings.TrimSpace(ab[0]), strings.TrimSpace(ab[1])
+
+	if a == "" { // the suffix range, i.e. "bytes=-3" is the last 3 bytes
+		n, err := strconv.Atoi(b)
+		if err != nil || n < 0 {
+			return 0, 0, false, false
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, true, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true, true
+	}
+
+	start, err := strconv.Atoi(a)
+	if err != nil || start < 0 {
+		return 0, 0, false, false
+	}
+	end = size - 1
+	if b != "" {
+		if end, err = strconv.Atoi(b); err != nil || end < start {
+			return 0, 0, false, false
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, true, false
+	}
+	return start, end, true, true
+}
+
+// corruptBody returns the out string truncated to a random length,
+// so that clients can be tested with bodies that can't be parsed
+func corruptBody(rnd *rand.Rand, out string) string {
+	if len(out) == 0 {
+		return out
+	}
+	n := rnd.Intn(len(out))
+	log.Printf("[http] corrupting the body, truncated from %d to %d bytes ...", len(out), n)
+	return out[:n]
+}
+
+// unwrapWriter returns the response writer that is wrapped by the
+// logger, stats and idempotency writers, which can't be hijacked or flushed
+func unwrapWriter(w http.ResponseWriter) http.ResponseWriter {
+	for {
+		switch ww := w.(type) {
+		case *logger.ResponseWriter:
+			w = ww.ResponseWriter
+		case *statusWriter:
+			w = ww.ResponseWriter
+		case *idempotentWriter:
+			w = ww.ResponseWriter
+		default:
+			return w
+		}
+	}
+}
+
+// hijacker returns the hijacker of the response writer, looking
+// through the logger response writer which can't be hijacked
+func hijacker(w http.ResponseWriter) (http.Hijacker, bool) {
+	hj, ok := unwrapWriter(w).(http.Hijacker)
+	return hj, ok
+}
+
+// flusher returns the flusher of the response writer, looking
+// through the logger response writer which can't be flushed
+func flusher(w http.ResponseWriter) (http.Flusher, bool) {
+	fl, ok := unwrapWriter(w).(http.Flusher)
+	return fl, ok
+}
+
+// DefaultChunkSize is the number of bytes sent in each chunk
+// of a response that uses chunked transfer encoding
+var DefaultChunkSize = 1024
+
+// writeChunked writes the out string in chunks, flushing after each one so
+// that the server uses chunked transfer encoding instead of a Content-Length
+func writeChunked(w http.ResponseWriter, status int, out string) {
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+
+	fl, ok := flusher(w)
+	if !ok {
+		log.Printf("[http] the %d response can't be chunked, sending it all at once ...", status)
+		fmt.Fprint(w, out)
+		return
+	}
+	fl.Flush() // the headers are sent without a Content-Length
+
+	for len(out) > 0 {
+		n := DefaultChunkSize
+		if n > len(out) {
+			n = len(out)
+		}
+		fmt.Fprint(w, out[:n])
+		fl.Flush()
+		out = out[n:]
+	}
+}
+
+// DefaultTransferParts is the number of parts a body is split
+// into when it is sent across the transfer delay
+var DefaultTransferParts = 10
+
+// writeTransfer writes the out string in parts with the transfer delay spread
+// evenly before each part, so the body is complete after the transfer delay
+func writeTransfer(w http.ResponseWriter, status int, out string, transfer time.Duration) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.WriteHeader(status)
+
+	fl, ok := flusher(w)
+	if !ok {
+		log.Printf("[http] the %d response can't be spread, sending it all after the delay ...", status)
+		time.Sleep(transfer)
+		fmt.Fprint(w, out)
+		return
+	}
+	fl.Flush() // the headers are sent before the body
+
+	size := (len(out) + DefaultTransferParts - 1) / DefaultTransferParts
+	if size == 0 {
+		time.Sleep(transfer)
+		return
+	}
+
+	parts := time.Duration((len(out) + size - 1) / size)
+	for len(out) > 0 {
+		n := size
+		if n > len(out) {
+			n = len(out)
+		}
+		time.Sleep(transfer / parts)
+		fmt.Fprint(w, out[:n])
+		fl.Flush()
+		out = out[n:]
+	}
+}
+
+// recordHijacked sets the status on the stats and idempotency writers, and
+// the body on the idempotency writer, because they don't see the response
+// that is written to a hijacked connection
+func recordHijacked(w http.ResponseWriter, status int, out string) {
+	for {
+		switch ww := w.(type) {
+		case *logger.ResponseWriter:
+			w = ww.ResponseWriter
+		case *statusWriter:
+			if ww.status == 0 {
+				ww.status = status
+			}
+			w = ww.ResponseWriter
+		case *idempotentWriter:
+			if ww.res.status == 0 {
+				ww.res.status = status
+				ww.res.body.WriteString(out)
+			}
+			w = ww.ResponseWriter
+		default:
+			return
+		}
+	}
+}
+
+// writeReason writes the response directly to the connection so that
+// the status line can have a custom reason phrase, and the raw headers
+// are sent in order as they are written, the connection is closed
+// afterwards. It returns false if the connection can't be hijacked.
+func writeReason(w http.ResponseWriter, r *http.Request, status int, reason string, raw []string, out string) bool {
+	hj, ok := hijacker(w)
+	if !ok {
+		log.Printf("[http] the %d %q reason can't be sent, using the standard reason ...", status, reason)
+		return false
+	}
+
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		log.Printf("[http] the %d %q reason can't be sent: %v", status, reason, err)
+		return false
+	}
+	defer conn.Close()
+
+	body := out
+	if r.Method == http.MethodHead {
+		body = "" // the Content-Length is still the length of the body
+	}
+	recordHijacked(w, status, body)
+
+	proto := r.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+
+	hdr := w.Header().Clone()
+	hdr.Set("Content-Length", strconv.Itoa(len(out)))
+	hdr.Set("Connection", "close")
+	if hdr.Get("Content-Type") == "" {
+		hdr.Set("Content-Type", http.DetectContentType([]byte(out)))
+	}
+
+	// the raw headers are used instead of the canonical ones
+	var lines []string
+	for _, line := range raw {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || strings.ContainsAny(line, "\r\n") {
+			log.Printf("[http] skipping the raw header %q ...", line)
+			continue
+		}
+		hdr.Del(strings.TrimSpace(kv[0]))
+		lines = append(lines, strings.TrimSpace(kv[0])+": "+strings.TrimSpace(kv[1]))
+	}
+
+	fmt.Fprintf(buf, "%s %03d %s\r\n", proto, status, reason)
+	hdr.Write(buf)
+	for _, line := range lines {
+		fmt.Fprintf(buf, "%s\r\n", line)
+	}
+	fmt.Fprint(buf, "\r\n", body)
+
+	err = buf.Flush()
+	log.OnErr(err).Printf("[http] writing the %d %q response: %v", status, reason, err)
+	return true
+}
+
+// lockedSource is a random source that can be shared by concurrent requests,
+// the source from rand.NewSource is not safe for concurrent use
+type lockedSource struct {
+	sync.Mutex
+	src rand.Source64
+}
+
+func newLockedSource(seed int64) *lockedSource {
+	return &lockedSource{src: rand.NewSource(seed).(rand.Source64)}
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.src.Seed(seed)
+}
+
 // httpHandler returns the HTTP handler that can be added to the
 // mux route, for a given path. This is what kicks off the
 // state machine for every call. Pass in a req.rand Random number
 // generater and you're own req.seed to make detereministic results
 // for testing.
 func httpHandler(req RequestHTTP, texts []TextBlock) http.HandlerFunc {
-	var idx uint64
+	var calls uint64
+	var idx = orderIndex(req.key)
+	var keyed = &orderKeyIndexes{m: make(map[string]*uint64)}
+	if req.Seed != nil {
+		req.seed = *req.Seed
+	}
 	if req.seed == 0 {
 		req.seed = time.Now().UnixNano()
 	}
-	req.rand = rand.New(rand.NewSource(req.seed)) // doesn't have to be crypto-quality random here...
+	req.rand = rand.New(newLockedSource(req.seed)) // doesn't have to be crypto-quality random here...
+	req.failOn = make(map[uint64]struct{}, len(req.FailOn))
+	for _, n := range req.FailOn {
+		req.failOn[uint64(n)] = struct{}{}
+	}
 	resps := req.Response
 	return WriteError(func(w http.ResponseWriter, r *http.Request) (err error) {
-		st := &reqState{r: r, w: w, req: req}
-		st.state = setup(&idx, resps, texts)
+		st := &reqState{r: r, w: w, req: req, call: atomic.AddUint64(&calls, 1)}
+		st.state = setup(idx, keyed, resps, texts)
 		for st.state != nil && st.err == nil {
 			st.state = st.state(st)
 		}
@@ -1,14 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/zclconf/go-cty/cty"
 )
 
 // CtxKeyRetries is the context key that holds retry middleware that is
@@ -26,11 +38,286 @@ func checkRetries(v hfsmws) func(http.Handler) http.Handler {
 	}
 }
 
+// DefaultReplayBodyLimit is the most bytes of a request body that
+// are buffered so the body can be read more than once
+var DefaultReplayBodyLimit int64 = 10 << 20 // 10MB
+
+// setBody replaces the request body with the buffered bytes, GetBody returns
+// a new reader of the bytes so matching middleware (i.e. parsing a form) and
+// the handler (i.e. ${request.body}) each read the whole body from the start
+func setBody(r *http.Request, body []byte) {
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(body)), nil }
+}
+
+// replayRequestBody is middleware that buffers the request body so it can
+// be read more than once, a body over the limit is passed along as it is
+func replayRequestBody(next http.Handler) http.Handler {
+	return WriteError(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return nil
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, DefaultReplayBodyLimit+1))
+		if err != nil {
+			return ErrReadRequestBody.F(err)
+		}
+
+		if int64(len(body)) > DefaultReplayBodyLimit {
+			r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		} else {
+			setBody(r, body)
+		}
+
+		next.ServeHTTP(w, r)
+		return nil
+	})
+}
+
+// DefaultShutdownMessage is the body sent to new requests
+// once a server has started to shutdown
+var DefaultShutdownMessage = "shutting down"
+
+// checkShutdown is middleware that sends a 503 to any new request once
+// the server has started to shutdown, requests already being handled
+// are allowed to complete.
+func checkShutdown(draining *int32, msg string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(draining) == 1 {
+				w.Header().Set("Connection", "close")
+				http.Error(w, msg, http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// checkReady is middleware that sends a 503 to every request until the
+// server has been started for the ready after time, like a service that
+// is slow to come up
+func checkReady(start time.Time, after time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if wait := after - time.Since(start); wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// checkConcurrent is middleware that limits how many requests are handled at
+// the same time, requests over the limit get a 503 instead of waiting.
+func checkConcurrent(max int) func(http.Handler) http.Handler {
+	sem := make(chan struct{}, max)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+				next.ServeHTTP(w, r)
+			default:
+				log.Printf("[concurrent] over the limit of %d requests ...", max)
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
+
+// checkContentType is middleware that sends a 415 to any request that does not
+// have the content type, parameters like charset are not part of the check
+func checkContentType(want string) func(http.Handler) http.Handler {
+	if mediaType, _, err := mime.ParseMediaType(want); err == nil {
+		want = mediaType
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			have, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if !strings.EqualFold(have, want) {
+				log.Printf("[content type] %q is not %q ...", have, want)
+				http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// checkMaxBody is middleware that sends a 413 to any request with a body over
+// the max bytes, the body is put back so it can be read again by the handler
+func checkMaxBody(max int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > max {
+				log.Printf("[max body] %d is over %d bytes ...", r.ContentLength, max)
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			if r.Body != nil {
+				body, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+				log.OnErr(err).Printf("[max body] reading body: %v", err)
+				if int64(len(body)) > max {
+					log.Printf("[max body] the body is over %d bytes ...", max)
+					http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+					return
+				}
+				setBody(r, body)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// DefaultIdempotencyTTL is how long a response is kept for an idempotency key
+var DefaultIdempotencyTTL = "24h"
+
+// idempotentResponse is a response saved for an idempotency key, done is
+// closed once the first request with the key has written the response
+type idempotentResponse struct {
+	status  int
+	header  http.Header
+	body    bytes.Buffer
+	expires time.Time
+	done    chan struct{}
+}
+
+// expired returns true when the response has been written and the TTL has passed
+func (res *idempotentResponse) expired(now time.Time) bool {
+	select {
+	case <-res.done:
+		return now.After(res.expires)
+	default:
+		return false // still in-flight
+	}
+}
+
+// idempotentWriter writes the response while also saving it
+type idempotentWriter struct {
+	http.ResponseWriter
+	res *idempotentResponse
+}
+
+func (w *idempotentWriter) WriteHeader(status int) {
+	if w.res.status == 0 {
+		w.res.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idempotentWriter) Write(b []byte) (int, error) {
+	if w.res.status == 0 {
+		w.res.status = http.StatusOK
+	}
+	w.res.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// checkIdempotency is middleware that saves the response for each Idempotency-Key
+// header, requests that repeat a key get the saved response until the TTL passes.
+// Requests that repeat a key while the first one is in-flight wait for its response.
+func checkIdempotency(req RequestHTTP) func(http.Handler) http.Handler {
+	ttl := DefaultIdempotencyTTL
+	if req.IdempotencyTTL != nil {
+		ttl = *req.IdempotencyTTL
+	}
+
+	var mu sync.Mutex
+	var cache = make(map[string]*idempotentResponse)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			mu.Lock()
+			now := time.Now()
+			res, ok := cache[key]
+			if ok && res.expired(now) {
+				ok = false
+			}
+			if !ok {
+				for k, v := range cache { // sweep the expired keys while adding a new one
+					if v.expired(now) {
+						delete(cache, k)
+					}
+				}
+				res = &idempotentResponse{done: make(chan struct{})}
+				cache[key] = res
+			}
+			mu.Unlock()
+
+			if ok {
+				<-res.done
+				if res.status == 0 { // the first request never wrote a response, so there is nothing to replay
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				log.Printf("[idempotency] using the saved response for %q ...", key)
+				for k, vals := range res.header {
+					w.Header()[k] = vals
+				}
+				w.WriteHeader(res.status)
+				w.Write(res.body.Bytes())
+				return
+			}
+
+			defer close(res.done)
+			next.ServeHTTP(&idempotentWriter{ResponseWriter: w, res: res}, r)
+			res.header = w.Header().Clone()
+			res.expires = time.Now().Add(delay(ttl))
+
+			if res.status == 0 {
+				mu.Lock()
+				delete(cache, key)
+				mu.Unlock()
+			}
+		})
+	}
+}
+
+// normalizePath is middleware that lowercases and cleans the request
+// path before it is routed, a trailing slash is kept
+func normalizePath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean("/" + strings.ToLower(r.URL.Path))
+		if strings.HasSuffix(r.URL.Path, "/") && p != "/" {
+			p += "/"
+		}
+		r.URL.Path, r.URL.RawPath = p, ""
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DefaultBasicAuthRealm is the realm sent with a challenge
+// when the basic auth config does not have one
+var DefaultBasicAuthRealm = "Restricted"
+
 // checkBasicAuth is middleware that preforms a Basic Auth check. Any errors result
 // in a 401 wrapped error
 func checkBasicAuth(config ConfigHTTP, notfound http.HandlerFunc) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(WriteError(func(w http.ResponseWriter, r *http.Request) error {
+			// always challenge, the credentials are never checked
+			if config.BasicAuth.ChallengeOnly {
+				relm := config.BasicAuth.Relm
+				if relm == "" {
+					relm = DefaultBasicAuthRealm
+				}
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, relm))
+				return Ext401Error{fmt.Errorf("basic auth challenge only")}
+			}
+
 			authStrs := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
 			if len(authStrs) != 2 {
 				return Ext401Error{fmt.Errorf("auth header is not two parts")}
@@ -67,6 +354,11 @@ func checkRequestJWT(req RequestHTTP, notfound http.HandlerFunc) func(http.Handl
 			token, err := decodeJWT(w, r, req.JWT)
 			if err != nil {
 				if !errors.As(err, &WarnError{}) {
+					if invalid := invalidJWTHandler(r, req); invalid != nil {
+						log.Printf("[jwt] using the on_invalid_jwt response: %v", err)
+						invalid.ServeHTTP(w, r)
+						return nil
+					}
 					return ErrMarshalJWT.F(err)
 				}
 			}
@@ -83,6 +375,16 @@ func checkRequestJWT(req RequestHTTP, notfound http.HandlerFunc) func(http.Handl
 						}
 					}
 				}
+
+				if req.JWT.Contains != nil {
+					contains, diags := req.JWT.Contains.Expr.Value(nil)
+					if diags.HasErrors() {
+						return ErrInvalidJWTClaim
+					}
+					if err := checkJWTContains(claims, contains); err != nil {
+						return err
+					}
+				}
 			}
 
 			ctx := context.WithValue(r.Context(), CtxKeyJWTToken, token)
@@ -93,11 +395,144 @@ func checkRequestJWT(req RequestHTTP, notfound http.HandlerFunc) func(http.Handl
 	}
 }
 
+// checkRequestCookie checks that the incoming cookies have the values, a
+// cookie sent more than once only needs one of the values to match
+func checkRequestCookie(req RequestHTTP, _nf http.HandlerFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return WriteError(func(w http.ResponseWriter, r *http.Request) error {
+			cookies := r.Cookies()
+			for name, want := range req.Cookies.Data {
+				var found bool
+				for _, cookie := range cookies {
+					if cookie.Name == name && (want == "*" || cookie.Value == want) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return ErrFilterFailed.F404("cookie", fmt.Sprintf("did not find the %q value", name))
+				}
+			}
+
+			next.ServeHTTP(w, r)
+			return nil
+		})
+	}
+}
+
+// checkSignedCookies checks that the signed cookies have not been
+// tampered with, a missing or tampered cookie gets a 401
+func checkSignedCookies(req RequestHTTP) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return WriteError(func(w http.ResponseWriter, r *http.Request) error {
+			secret, ok := r.Context().Value(CtxKeyCookieSecret).([]byte)
+			if !ok {
+				return ErrCookieSecretNotFound
+			}
+
+			for _, name := range req.SignedCookies {
+				cookie, err := r.Cookie(name)
+				if err != nil {
+					return ErrInvalidSignedCookie.F401(name)
+				}
+				if _, ok := verifyCookie(secret, name, cookie.Value); !ok {
+					log.Printf("[signed cookie] %q has been tampered with ...", name)
+					return ErrInvalidSignedCookie.F401(name)
+				}
+			}
+
+			next.ServeHTTP(w, r)
+			return nil
+		})
+	}
+}
+
+// checkJWTContains checks that each claim contains all of the values
+// that are given, i.e. contains = { scope = "read:users", roles = ["admin"] }
+// a claim can be a space delimited string (like scope) or an array
+func checkJWTContains(claims jwtgo.MapClaims, contains cty.Value) error {
+	if !contains.CanIterateElements() {
+		return ErrInvalidJWTClaim
+	}
+
+	for it := contains.ElementIterator(); it.Next(); {
+		key, val := it.Element()
+		name := key.AsString()
+
+		have := make(map[string]bool)
+		switch clav := claims[name].(type) {
+		case string:
+			for _, v := range strings.Fields(clav) {
+				have[v] = true
+			}
+		case []interface{}:
+			for _, v := range clav {
+				if v, ok := v.(string); ok {
+					have[v] = true
+				}
+			}
+		}
+
+		var want []cty.Value
+		switch {
+		case val.Type() == cty.String:
+			want = append(want, val)
+		case val.CanIterateElements():
+			want = val.AsValueSlice()
+		}
+
+		for _, v := range want {
+			if v.Type() != cty.String {
+				return ErrInvalidJWTClaim
+			}
+			if !have[v.AsString()] {
+				return ErrFilterFailed.F404("jwt", fmt.Sprintf("the %q claim does not contain %q", name, v.AsString()))
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkExactURI checks that the request URI, including the
+// query, is exactly the same as the one that was sent
+func checkExactURI(req RequestHTTP) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return WriteError(func(w http.ResponseWriter, r *http.Request) error {
+			if r.RequestURI != *req.ExactURI {
+				return ErrFilterFailed.F404("exact uri", fmt.Sprintf("have %q want %q", r.RequestURI, *req.ExactURI))
+			}
+
+			next.ServeHTTP(w, r)
+			return nil
+		})
+	}
+}
+
+// checkHTTPVersion checks the request protocol version, a version
+// without a minor version (i.e. "2") matches any minor version
+func checkHTTPVersion(req RequestHTTP) func(http.Handler) http.Handler {
+	want := strings.TrimPrefix(strings.ToUpper(*req.HTTPVersion), "HTTP/")
+	return func(next http.Handler) http.Handler {
+		return WriteError(func(w http.ResponseWriter, r *http.Request) error {
+			have := fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)
+			if have != want && want != strconv.Itoa(r.ProtoMajor) {
+				return ErrFilterFailed.F404("http version", fmt.Sprintf("have %q want %q", have, want))
+			}
+
+			next.ServeHTTP(w, r)
+			return nil
+		})
+	}
+}
+
 // checkRequestHeader checks incoming header values against values that it should contain
 func checkRequestHeader(req RequestHTTP, _nf http.HandlerFunc) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
+		data, dia := req.Headers.values(headerEvalCtx)
+		log.OnErr(dia).Printf("[http] request header values: %v", dia)
 		return WriteError(func(w http.ResponseWriter, r *http.Request) error {
-			for k, vals := range req.Headers.Data {
+			for k, vals := range data {
 				values := r.Header.Values(k)
 				chk := len(vals)
 				if chk != len(values) {
@@ -126,6 +561,120 @@ func checkRequestHeader(req RequestHTTP, _nf http.HandlerFunc) func(http.Handler
 	}
 }
 
+// checkRequestBody checks the incoming JSON body against the values at the
+// dotted paths, the body is put back so it can be read again by the handler
+func checkRequestBody(req RequestHTTP) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return WriteError(func(w http.ResponseWriter, r *http.Request) error {
+			if r.Body == nil {
+				return ErrFilterFailed.F404("json body", "there is no body")
+			}
+
+			body, err := readBody(r)
+			if err != nil {
+				return err
+			}
+
+			var doc interface{}
+			dec := json.NewDecoder(bytes.NewReader(body))
+			dec.UseNumber()
+			if err := dec.Decode(&doc); err != nil {
+				return ErrFilterFailed.F404("json body", err)
+			}
+
+			for path, want := range req.BodyJSON {
+				have, ok := jsonPath(doc, path)
+				if !ok {
+					return ErrFilterFailed.F404("json body", fmt.Sprintf("did not find the %q path", path))
+				}
+				if want != "*" && jsonPathValue(have) != want {
+					return ErrFilterFailed.F404("json body", fmt.Sprintf("the %q path is not %q", path, want))
+				}
+			}
+
+			next.ServeHTTP(w, r)
+			return nil
+		})
+	}
+}
+
+// CtxKeyJSONRPCID is the context key that holds the raw id of a
+// matched JSON-RPC request, so it can be sent back in the response
+const CtxKeyJSONRPCID ctxKey = "_jsonrpc_id_"
+
+// jsonRPCRequest is a JSON-RPC 2.0 request object
+type jsonRPCRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// checkJSONRPC checks the incoming body is a JSON-RPC 2.0 call of the method,
+// the body is put back so it can be read again by the handler
+func checkJSONRPC(req RequestHTTP) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return WriteError(func(w http.ResponseWriter, r *http.Request) error {
+			if r.Body == nil {
+				return ErrFilterFailed.F404("jsonrpc", "there is no body")
+			}
+
+			body, err := readBody(r)
+			if err != nil {
+				return err
+			}
+
+			var call jsonRPCRequest
+			if err := json.Unmarshal(body, &call); err != nil {
+				return ErrFilterFailed.F404("jsonrpc", err)
+			}
+			if call.Version != "2.0" {
+				return ErrFilterFailed.F404("jsonrpc", fmt.Sprintf("the %q version is not 2.0", call.Version))
+			}
+			if call.Method != req.JSONRPC.Method {
+				return ErrFilterFailed.F404("jsonrpc", fmt.Sprintf("the %q method is not %q", call.Method, req.JSONRPC.Method))
+			}
+
+			ctx := context.WithValue(r.Context(), CtxKeyJSONRPCID, call.ID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return nil
+		})
+	}
+}
+
+// jsonPath returns the value at the dotted path of the decoded
+// JSON document, array elements use the index, i.e. "users.0.id"
+func jsonPath(doc interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			val, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			doc = val
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// jsonPathValue returns the JSON value as a string to compare with,
+// strings are used as-is and all other values are JSON encoded
+func jsonPathValue(val interface{}) string {
+	if s, ok := val.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(val)
+	return string(b)
+}
+
 // checkRequestJWT checks incoming post against values that it should contain
 func checkRequestPost(req RequestHTTP, notfound http.HandlerFunc) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -1,18 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -20,6 +37,8 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/njones/logger"
+	"github.com/spf13/afero"
 	"github.com/zclconf/go-cty/cty"
 	"github.com/zclconf/go-cty/cty/function"
 )
@@ -344,6 +363,44 @@ func TestRequestHandler(t *testing.T) {
 				Status: "200", Body: attr(`Hello, ${header.a.0}`),
 			}),
 		),
+		test(t, "header map template",
+			testHeaders(
+				http.Header{"X-Custom": {"World"}},
+				reqHeader("x-custom", "*")),
+			testResponse(ResponseHTTP{
+				Status: "200", Body: attr(`Hello, ${header_map.x-custom}`),
+			}),
+		),
+
+		test(t, "cookie template",
+			testHeaders(
+				http.Header{"Cookie": {"name=World"}},
+				reqHeader("Cookie", "*")),
+			testResponse(ResponseHTTP{
+				Status: "200", Body: attr(`Hello, ${cookie.name}`),
+			}),
+		),
+		test(t, "cookie template with duplicate names",
+			testHeaders(
+				http.Header{"Cookie": {"name=Nobody; other=x; name=World"}},
+				reqHeader("Cookie", "*")),
+			testResponse(ResponseHTTP{
+				Status: "200", Body: attr(`Hello, ${cookie.name.1}`),
+			}),
+		),
+
+		test(t, "status class",
+			testResponse(ResponseHTTP{
+				Status: "2xx", Body: attr("Hello, World"),
+			}),
+			testWant(200, "Hello, World"),
+		),
+		test(t, "status class client error",
+			testResponse(ResponseHTTP{
+				Status: "4xx", Body: attr("Bad, World"),
+			}),
+			testWant(400, "Bad, World"),
+		),
 
 		test(t, "headers in response",
 			testResponseHeaders(reqHeader("x-response-1", "hello, world")),
@@ -374,6 +431,13 @@ func TestRequestHandler(t *testing.T) {
 			}),
 			testWant(400, "Bad Request\n"),
 		),
+		test(t, "raw query string template",
+			testURL("/this/is/standard/World?b=2&a=1&a=%20x"),
+			testResponse(ResponseHTTP{
+				Status: "200", Body: attr("${request.query_string}"),
+			}),
+			testWant(200, "b=2&a=1&a=%20x"),
+		),
 		test(t, "urlparam template",
 			testPath("/this/is/standard/{id}"),
 			testResponse(ResponseHTTP{
@@ -822,252 +886,2882 @@ func TestResponseOrder(t *testing.T) {
 	}
 }
 
-func TestBasicAuth(t *testing.T) {
-	type want struct {
-		status int
-		body   string
+func TestResponseOrderURLHash(t *testing.T) {
+	req := RequestHTTP{
+		Method: "get",
+		Order:  "url-hash",
+		Response: []ResponseHTTP{
+			{Status: "200", Body: attr("1")},
+			{Status: "200", Body: attr("2")},
+			{Status: "200", Body: attr("3")},
+			{Status: "200", Body: attr("4")},
+		},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/items/{id}", httpHandler(req, []TextBlock{}))
+
+	var get = func(url string) string {
+		rec := httptest.NewRecorder()
+		hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec.Body.String()
+	}
+
+	var seen = make(map[string]struct{})
+	for i := 0; i < 20; i++ {
+		url := fmt.Sprintf("/items/%d?v=%d", i, i%3)
+		want := get(url)
+		for n := 0; n < 3; n++ {
+			if have := get(url); have != want {
+				t.Errorf("%s have: %q want: %q", url, have, want)
+			}
+		}
+		seen[want] = struct{}{}
+	}
+
+	if len(seen) < 2 {
+		t.Errorf("have: %d different responses want: more than 1", len(seen))
 	}
+}
 
+func TestResponseOrderKey(t *testing.T) {
 	var tests = []struct {
-		name        string
-		method      string
-		auth        string
-		username    string
-		password    string
-		user        string // expected
-		pass        string // expected
-		body        io.Reader
-		req         RequestHTTP
-		contentType string
-		want        want
+		name     string
+		orderKey string
+		set      func(r *http.Request, client string)
+		want     []string
 	}{
 		{
-			name:        "auth",
-			method:      "post",
-			body:        strings.NewReader("This is a test"),
-			auth:        "auth",
-			username:    "user",
-			password:    "password",
-			user:        "user",
-			pass:        "password",
-			contentType: "text/plain",
-			req: RequestHTTP{
-				Method: "post",
-				Response: []ResponseHTTP{
-					{
-						Body: attr("${request.body}"),
-					},
-				},
-			},
-			want: want{
-				status: 200,
-				body:   "This is a test",
-			},
+			name: "shared",
+			set:  func(r *http.Request, client string) { r.Header.Set("X-Session-ID", client) },
+			want: []string{"a:1", "b:2", "a:3", "b:1", "a:2", "b:3"},
 		},
 		{
-			name:     "bad auth",
-			method:   "post",
-			body:     strings.NewReader("This is a test"),
-			auth:     "auth",
-			username: "user",
-			password: "password-bad",
-			user:     "user",
-			pass:     "password",
-			req: RequestHTTP{
-				Method: "post",
-				Response: []ResponseHTTP{
-					{
-						Body: attr("${request.body}"),
-					},
-				},
-			},
-			want: want{
-				status: 401,
-				body:   "Unauthorized\n",
-			},
+			name:     "header",
+			orderKey: "header.x-session-id",
+			set:      func(r *http.Request, client string) { r.Header.Set("X-Session-ID", client) },
+			want:     []string{"a:1", "b:1", "a:2", "b:2", "a:3", "b:3"},
+		},
+		{
+			name:     "cookie",
+			orderKey: "cookie.session",
+			set:      func(r *http.Request, client string) { r.AddCookie(&http.Cookie{Name: "session", Value: client}) },
+			want:     []string{"a:1", "b:1", "a:2", "b:2", "a:3", "b:3"},
+		},
+		{
+			name:     "query",
+			orderKey: "query.user",
+			set:      func(r *http.Request, client string) { r.URL.RawQuery = "user=" + client },
+			want:     []string{"a:1", "b:1", "a:2", "b:2", "a:3", "b:3"},
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-
-			req, err := http.NewRequest(strings.ToUpper(test.method), "/test", test.body)
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			if test.contentType == "" {
-				test.contentType = "application/x-www-form-urlencoded"
+			req := RequestHTTP{
+				Method:   "get",
+				OrderKey: test.orderKey,
+				Response: []ResponseHTTP{
+					{Status: "200", Body: attr("1")},
+					{Status: "200", Body: attr("2")},
+					{Status: "200", Body: attr("3")},
+				},
 			}
-			req.Header.Add("Content-Type", test.contentType)
-			req.SetBasicAuth(test.username, test.password)
 
-			rec := httptest.NewRecorder()
 			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
 
-			server := ConfigHTTP{
-				BasicAuth: &configBA{
-					User: test.user,
-					Pass: test.pass,
-				},
-			}
+			var have []string
+			for i := range test.want {
+				client := []string{"a", "b"}[i%2]
+				r := httptest.NewRequest(http.MethodGet, "/test", nil)
+				test.set(r, client)
 
-			if strings.ToUpper(test.method) == http.MethodPost {
-				hdl.Use(checkRequestPost(test.req, hdl.NotFoundHandler()))
+				rec := httptest.NewRecorder()
+				hdl.ServeHTTP(rec, r)
+				have = append(have, client+":"+rec.Body.String())
 			}
-			hdl.Use(checkBasicAuth(server, hdl.NotFoundHandler()))
-			hdl.Method(test.req.Method, "/test", httpHandler(test.req, []TextBlock{}))
-			hdl.ServeHTTP(rec, req)
 
-			haveBody := rec.Body.String()
-			if haveBody != test.want.body {
-				t.Errorf("have: %q want: %q", haveBody, test.want.body)
+			if !reflect.DeepEqual(have, test.want) {
+				t.Errorf("have: %v want: %v", have, test.want)
 			}
 		})
 	}
 }
 
-func TestJWTAuth(t *testing.T) {
-	tokenStr := getJWTTestToken(t)
-
-	type want struct {
-		status int
-		body   string
-	}
-
+func TestResponseStates(t *testing.T) {
 	var tests = []struct {
-		name   string
-		method string
-		auth   string
-		jwt    string
-		body   io.Reader
-		req    RequestHTTP
-		want   want
+		name string
+		req  RequestHTTP
+		want []string
 	}{
 		{
-			name:   "auth",
-			method: "post",
-			body:   strings.NewReader("This is a test"),
-			auth:   "auth",
-			jwt:    tokenStr,
+			name: "named states",
 			req: RequestHTTP{
-				Method: "post",
+				Method: "get",
+				States: []string{"pending", "processing", "done"},
 				Response: []ResponseHTTP{
-					{
-						Body: attr("${request.body}"),
-					},
+					{Status: "200", State: "done", Body: attr("finished: ${request.state}")},
+					{Status: "202", State: "pending", Body: attr("waiting: ${request.state}")},
+					{Status: "202", State: "processing", Body: attr("working: ${request.state}")},
 				},
 			},
-			want: want{
-				status: 200,
-				body:   "This is a test",
+			want: []string{"waiting: pending", "working: processing", "finished: done", "finished: done"},
+		},
+		{
+			name: "indexed states",
+			req: RequestHTTP{
+				Method: "get",
+				States: []string{"pending", "processing", "done"},
+				Response: []ResponseHTTP{
+					{Status: "202", Body: attr("1: ${request.state}")},
+					{Status: "202", Body: attr("2: ${request.state}")},
+					{Status: "200", Body: attr("3: ${request.state}")},
+				},
 			},
+			want: []string{"1: pending", "2: processing", "3: done", "3: done"},
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-
-			req, err := http.NewRequest(strings.ToUpper(test.method), "/test", test.body)
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			rec := httptest.NewRecorder()
 			hdl := chi.NewRouter()
-
-			hdl.Use(checkRequestPost(test.req, hdl.NotFoundHandler()))
 			hdl.Method(test.req.Method, "/test", httpHandler(test.req, []TextBlock{}))
-			hdl.ServeHTTP(rec, req)
 
-			haveBody := rec.Body.String()
-			if haveBody != test.want.body {
-				t.Errorf("have: %q want: %q", haveBody, test.want.body)
+			for _, want := range test.want {
+				req, err := http.NewRequest(strings.ToUpper(test.req.Method), "/test", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rec := httptest.NewRecorder()
+				hdl.ServeHTTP(rec, req)
+
+				if have := rec.Body.String(); have != want {
+					t.Errorf("have: %q want: %q", have, want)
+				}
 			}
 		})
 	}
 }
 
-func TestJWTResponse(t *testing.T) {
-
-	var stdResJWT = responseJWT{
-		Name:    "test-1",
-		Subject: attr("sub 1"),
-		Payload: map[string]string{
-			"$._internal.test-1.key": "Password/Secret",
+func TestResponseOrderReload(t *testing.T) {
+	req := RequestHTTP{
+		Method: "get",
+		Response: []ResponseHTTP{
+			{Status: "200", Body: attr("1")},
+			{Status: "200", Body: attr("2")},
+			{Status: "200", Body: attr("3")},
 		},
-	}
-	var stdCfgJWT = configJWT{
-		Name:   "test-1",
-		Secret: attr("Password/Secret"),
-		Alg:    jwtgo.SigningMethodHS256.Name,
+		key: "GET /test/reload 0",
 	}
 
-	token := jwtgo.NewWithClaims(jwtgo.SigningMethodHS256, &stdResJWT)
-	tokenStr, err := token.SignedString([]byte("Password/Secret"))
-	if err != nil {
-		t.Fatal(err)
+	var tests = []struct {
+		name string
+		want []string
+	}{
+		{name: "start", want: []string{"1", "2"}},
+		{name: "reload", want: []string{"3", "1", "2"}},
+		{name: "reload again", want: []string{"3"}},
 	}
 
-	type wanted struct {
-		body    *string
-		header  map[string][]string
-		cookies map[string]*http.Cookie
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hdl := chi.NewRouter() // a new handler, the same as a reload
+			hdl.Method(req.Method, "/test/reload", httpHandler(req, []TextBlock{}))
+
+			for _, want := range test.want {
+				r, err := http.NewRequest(http.MethodGet, "/test/reload", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rec := httptest.NewRecorder()
+				hdl.ServeHTTP(rec, r)
+
+				if have := rec.Body.String(); have != want {
+					t.Errorf("have: %q want: %q", have, want)
+				}
+			}
+		})
 	}
+}
 
+func TestRequestFailOn(t *testing.T) {
 	var tests = []struct {
 		name   string
-		method string
-		jwtC   configJWT
-		jwtR   responseJWT
 		req    RequestHTTP
-		reqOut string
-		reqKey string
-		want   wanted
+		status []int
+		body   []string
 	}{
 		{
-			name:   "auth",
-			method: "get",
-			jwtC:   stdCfgJWT,
-			jwtR:   stdResJWT,
-			reqOut: "body",
-			req:    RequestHTTP{},
-			want: wanted{
-				body: func() *string {
-					return &tokenStr
-				}(),
+			name: "fail response",
+			req: RequestHTTP{
+				Method:   "get",
+				FailOn:   []int{2, 5},
+				Fail:     &ResponseHTTP{Status: "503", Body: attr("try again")},
+				Response: []ResponseHTTP{{Status: "200", Body: attr("ok")}},
 			},
+			status: []int{200, 503, 200, 200, 503, 200},
+			body:   []string{"ok", "try again", "ok", "ok", "try again", "ok"},
 		},
 		{
-			name:   "auth",
-			method: "get",
-			jwtC:   stdCfgJWT,
-			jwtR:   stdResJWT,
-			reqOut: "header",
-			reqKey: "x-jwt-test-header",
-			req:    RequestHTTP{},
-			want: wanted{
-				header: func() map[string][]string {
-					return map[string][]string{
-						"x-jwt-test-header": {tokenStr},
-					}
-				}(),
+			name: "default fail",
+			req: RequestHTTP{
+				Method:   "get",
+				Order:    "random",
+				FailOn:   []int{1},
+				Response: []ResponseHTTP{{Status: "200", Body: attr("ok")}},
 			},
+			status: []int{500, 200, 200},
+			body:   []string{"", "ok", "ok"},
 		},
-		{
-			name:   "auth",
-			method: "get",
-			jwtC:   stdCfgJWT,
-			jwtR:   stdResJWT,
-			reqOut: "cookie",
-			reqKey: "cookie_jwt_test",
-			req:    RequestHTTP{},
-			want: wanted{
-				cookies: func() map[string]*http.Cookie {
-					c := http.Cookie{}
-					c.Name = "cookie_jwt_test"
-					c.Value = tokenStr
-					c.Raw = fmt.Sprintf("%s=%s", "cookie_jwt_test", tokenStr)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hdl := chi.NewRouter()
+			hdl.Method(test.req.Method, "/test", httpHandler(test.req, []TextBlock{}))
+
+			for i := range test.status {
+				req, err := http.NewRequest(strings.ToUpper(test.req.Method), "/test", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rec := httptest.NewRecorder()
+				hdl.ServeHTTP(rec, req)
+
+				if rec.Code != test.status[i] {
+					t.Errorf("[%d] have: %d want: %d", i+1, rec.Code, test.status[i])
+				}
+				if have := rec.Body.String(); have != test.body[i] {
+					t.Errorf("[%d] have: %q want: %q", i+1, have, test.body[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRequestMaxUses(t *testing.T) {
+	var one, two uint64 = 1, 2
+	var tests = []struct {
+		name   string
+		req    RequestHTTP
+		status []int
+		body   []string
+	}{
+		{
+			name: "gone response",
+			req: RequestHTTP{
+				Method:   "get",
+				MaxUses:  &two,
+				Gone:     &ResponseHTTP{Status: "410", Body: attr("token used")},
+				Response: []ResponseHTTP{{Status: "200", Body: attr("ok")}},
+			},
+			status: []int{200, 200, 410, 410},
+			body:   []string{"ok", "ok", "token used", "token used"},
+		},
+		{
+			name: "default gone",
+			req: RequestHTTP{
+				Method:   "get",
+				MaxUses:  &one,
+				Response: []ResponseHTTP{{Status: "200", Body: attr("ok")}},
+			},
+			status: []int{200, 410, 410},
+			body:   []string{"ok", "", ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hdl := chi.NewRouter()
+			hdl.Method(test.req.Method, "/test", httpHandler(test.req, []TextBlock{}))
+
+			for i := range test.status {
+				req, err := http.NewRequest(strings.ToUpper(test.req.Method), "/test", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				rec := httptest.NewRecorder()
+				hdl.ServeHTTP(rec, req)
+
+				if rec.Code != test.status[i] {
+					t.Errorf("[%d] have: %d want: %d", i+1, rec.Code, test.status[i])
+				}
+				if have := rec.Body.String(); have != test.body[i] {
+					t.Errorf("[%d] have: %q want: %q", i+1, have, test.body[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRequestIdempotency(t *testing.T) {
+	req := RequestHTTP{
+		Method:      "post",
+		Idempotency: true,
+		Response: []ResponseHTTP{
+			{Status: "201", Body: attr("created 1"), Headers: &headers{Data: headerData{"X-Id": {cty.StringVal("1")}}}},
+			{Status: "201", Body: attr("created 2"), Headers: &headers{Data: headerData{"X-Id": {cty.StringVal("2")}}}},
+		},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.With(checkIdempotency(req)).Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	var tests = []struct {
+		key    string
+		status int
+		body   string
+		id     string
+	}{
+		{key: "a", status: 201, body: "created 1", id: "1"},
+		{key: "a", status: 201, body: "created 1", id: "1"},
+		{key: "b", status: 201, body: "created 2", id: "2"},
+		{key: "a", status: 201, body: "created 1", id: "1"},
+	}
+
+	for i, test := range tests {
+		r, err := http.NewRequest(http.MethodPost, "/test", strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Idempotency-Key", test.key)
+
+		rec := httptest.NewRecorder()
+		hdl.ServeHTTP(rec, r)
+
+		if rec.Code != test.status {
+			t.Errorf("[%d] have: %d want: %d", i+1, rec.Code, test.status)
+		}
+		if have := rec.Body.String(); have != test.body {
+			t.Errorf("[%d] have: %q want: %q", i+1, have, test.body)
+		}
+		if have := rec.Header().Get("X-Id"); have != test.id {
+			t.Errorf("[%d] have: %q want: %q", i+1, have, test.id)
+		}
+	}
+}
+
+func TestRequestIdempotencyInFlight(t *testing.T) {
+	var calls int32
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "created %d", n)
+	})
+
+	hdl := chi.NewRouter()
+	hdl.With(checkIdempotency(RequestHTTP{Idempotency: true})).Post("/test", slow)
+
+	var wg sync.WaitGroup
+	var bodies = make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, "/test", nil)
+			r.Header.Set("Idempotency-Key", "a")
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r)
+			bodies[i] = fmt.Sprintf("%d %s", rec.Code, rec.Body.String())
+		}(i)
+	}
+	wg.Wait()
+
+	if have := atomic.LoadInt32(&calls); have != 1 {
+		t.Errorf("calls have: %d want: %d", have, 1)
+	}
+	for i, have := range bodies {
+		if want := "201 created 1"; have != want {
+			t.Errorf("[%d] have: %q want: %q", i+1, have, want)
+		}
+	}
+}
+
+func TestRequestIdempotencyNoResponse(t *testing.T) {
+	var calls int
+	empty := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { calls++ })
+
+	hdl := chi.NewRouter()
+	hdl.With(checkIdempotency(RequestHTTP{Idempotency: true})).Post("/test", empty)
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/test", nil)
+		r.Header.Set("Idempotency-Key", "a")
+		rec := httptest.NewRecorder()
+		hdl.ServeHTTP(rec, r)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("[%d] have: %d want: %d", i+1, rec.Code, http.StatusOK)
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("calls have: %d want: %d", calls, 2)
+	}
+}
+
+func TestRequestIdempotencyFlusher(t *testing.T) {
+	var ok bool
+	hdl := chi.NewRouter()
+	hdl.With(checkIdempotency(RequestHTTP{Idempotency: true})).Post("/test", func(w http.ResponseWriter, r *http.Request) {
+		_, ok = flusher(w)
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/test", nil)
+	r.Header.Set("Idempotency-Key", "a")
+	hdl.ServeHTTP(httptest.NewRecorder(), r)
+
+	if !ok {
+		t.Error("have: no flusher want: a flusher")
+	}
+}
+
+func TestRequestMaxConcurrent(t *testing.T) {
+	req := RequestHTTP{
+		Method:   "get",
+		Delay:    "200ms",
+		Response: []ResponseHTTP{{Status: "200", Body: attr("ok")}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.With(checkConcurrent(2)).Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	var wg sync.WaitGroup
+	var codes = make([]int, 5)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/test", nil))
+			codes[i] = rec.Code
+		}(i)
+	}
+	wg.Wait()
+
+	var have = make(map[int]int)
+	for _, code := range codes {
+		have[code]++
+	}
+	if have[http.StatusOK] != 2 {
+		t.Errorf("have: %d want: %d", have[http.StatusOK], 2)
+	}
+	if have[http.StatusServiceUnavailable] != 3 {
+		t.Errorf("have: %d want: %d", have[http.StatusServiceUnavailable], 3)
+	}
+}
+
+func TestRequestBodyLimits(t *testing.T) {
+	var max int64 = 10
+	var tests = []struct {
+		name        string
+		contentType string
+		body        string
+		chunked     bool
+		status      int
+	}{
+		{name: "ok", contentType: "application/json", body: `{"a":1}`, status: 200},
+		{name: "ok with charset", contentType: "application/json; charset=utf-8", body: `{"a":1}`, status: 200},
+		{name: "wrong content type", contentType: "text/plain", body: `{"a":1}`, status: 415},
+		{name: "no content type", body: `{"a":1}`, status: 415},
+		{name: "body too large", contentType: "application/json", body: `{"a":1234567890}`, status: 413},
+		{name: "chunked body too large", contentType: "application/json", body: `{"a":1234567890}`, chunked: true, status: 413},
+	}
+
+	req := RequestHTTP{
+		Method:   "post",
+		Response: []ResponseHTTP{{Status: "200", Body: attr("${request.body}")}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.With(checkContentType("application/json"), checkMaxBody(max)).Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(test.body))
+			if test.chunked {
+				r.ContentLength = -1
+			}
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r)
+
+			if rec.Code != test.status {
+				t.Errorf("have: %d want: %d", rec.Code, test.status)
+			}
+			if have := rec.Body.String(); test.status == 200 && have != test.body {
+				t.Errorf("have: %q want: %q", have, test.body)
+			}
+		})
+	}
+}
+
+func TestRequestMaxBodyBytes(t *testing.T) {
+	var max int64 = 8
+	var large = `{"items":[` + strings.Repeat(`"item",`, 200) + `"last"]}`
+
+	var tests = []struct {
+		name   string
+		max    *int64
+		body   string
+		status int
+	}{
+		{name: "default limit", body: large, status: http.StatusOK},
+		{name: "under the server limit", max: &max, body: "12345678", status: http.StatusOK},
+		{name: "over the server limit", max: &max, body: "123456789", status: http.StatusRequestEntityTooLarge},
+	}
+
+	req := RequestHTTP{
+		Method:   "post",
+		Response: []ResponseHTTP{{Status: "200", Body: attr("${request.body}")}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(test.body))
+			if test.max != nil {
+				r = r.WithContext(context.WithValue(r.Context(), CtxKeyMaxBodyBytes, *test.max))
+			}
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r)
+
+			if rec.Code != test.status {
+				t.Fatalf("have: %d want: %d", rec.Code, test.status)
+			}
+			if have := rec.Body.String(); test.status == http.StatusOK && have != test.body {
+				t.Errorf("have: %q want: %q", have, test.body)
+			}
+		})
+	}
+}
+
+func TestRequestReplayBody(t *testing.T) {
+	var tests = []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "matched", body: "name=Nika&id=7", status: 200},
+		{name: "not matched", body: "name=Jones&id=7", status: 404},
+	}
+
+	req := RequestHTTP{
+		Method:   "post",
+		Posted:   map[string]string{"name": "Nika", "id": "*"},
+		Response: []ResponseHTTP{{Status: "200", Body: attr("${request.body}")}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.With(replayRequestBody, checkRequestPost(req, http.NotFound)).Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(test.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r)
+
+			if rec.Code != test.status {
+				t.Fatalf("have: %d want: %d", rec.Code, test.status)
+			}
+			if have := rec.Body.String(); test.status == 200 && have != test.body {
+				t.Errorf("have: %q want: %q", have, test.body)
+			}
+		})
+	}
+}
+
+func TestSetBody(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/test", nil)
+	setBody(r, []byte("name=Nika"))
+
+	// a reader that stops before the end
+	part := make([]byte, 4)
+	if _, err := io.ReadFull(r.Body, part); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(body), "name=Nika"; have != want {
+		t.Errorf("[partial] have: %q want: %q", have, want)
+	}
+
+	// a reader that reads again after the end
+	b, err := ioutil.ReadAll(io.MultiReader(r.Body, r.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(b), "name=Nika"; have != want {
+		t.Errorf("[after EOF] have: %q want: %q", have, want)
+	}
+}
+
+func TestRequestBodyJSON(t *testing.T) {
+	var tests = []struct {
+		name   string
+		match  map[string]string
+		body   string
+		max    int64 // the server max_body_bytes
+		status int
+	}{
+		{name: "nested string", match: map[string]string{"user.role": "admin"}, body: `{"user":{"role":"admin"}}`, status: 200},
+		{name: "nested mismatch", match: map[string]string{"user.role": "admin"}, body: `{"user":{"role":"guest"}}`, status: 404},
+		{name: "number and bool", match: map[string]string{"id": "7", "active": "true"}, body: `{"id":7,"active":true}`, status: 200},
+		{name: "array index", match: map[string]string{"tags.1": "b"}, body: `{"tags":["a","b"]}`, status: 200},
+		{name: "any value", match: map[string]string{"user.id": "*"}, body: `{"user":{"id":42}}`, status: 200},
+		{name: "missing path", match: map[string]string{"user.id": "*"}, body: `{"user":{}}`, status: 404},
+		{name: "not JSON", match: map[string]string{"user.role": "admin"}, body: `role=admin`, status: 404},
+		{name: "over max body bytes", match: map[string]string{"user.role": "admin"}, body: `{"user":{"role":"admin"}}`, max: 8, status: 413},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{
+				Method:   "post",
+				BodyJSON: test.match,
+				Response: []ResponseHTTP{{Status: "200", Body: attr("${request.body}")}},
+			}
+
+			hdl := chi.NewRouter()
+			hdl.With(checkRequestBody(req)).Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+			r := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(test.body))
+			if test.max > 0 {
+				r = r.WithContext(context.WithValue(r.Context(), CtxKeyMaxBodyBytes, test.max))
+			}
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r)
+
+			if rec.Code != test.status {
+				t.Fatalf("have: %d want: %d", rec.Code, test.status)
+			}
+			if have := rec.Body.String(); test.status == 200 && have != test.body {
+				t.Errorf("have: %q want: %q", have, test.body)
+			}
+		})
+	}
+}
+
+func TestRequestJSONRPC(t *testing.T) {
+	var tests = []struct {
+		name   string
+		res    ResponseHTTP
+		body   string
+		max    int64 // the server max_body_bytes
+		status int
+		want   string
+	}{
+		{
+			name:   "method match",
+			res:    ResponseHTTP{Status: "200", Body: attrE(`{ name = "Nika" }`)},
+			body:   `{"jsonrpc":"2.0","method":"user.get","params":[1],"id":7}`,
+			status: 200,
+			want:   `{"jsonrpc":"2.0","result":{"name":"Nika"},"id":7}`,
+		},
+		{
+			name:   "string id and text result",
+			res:    ResponseHTTP{Status: "200", Body: attr("ok")},
+			body:   `{"jsonrpc":"2.0","method":"user.get","id":"abc"}`,
+			status: 200,
+			want:   `{"jsonrpc":"2.0","result":"ok","id":"abc"}`,
+		},
+		{
+			name:   "error envelope",
+			res:    ResponseHTTP{Status: "200", JSONRPCError: &responseJSONRPCError{Code: -32602, Message: "Invalid params", Data: attrE(`["id"]`)}},
+			body:   `{"jsonrpc":"2.0","method":"user.get","id":7}`,
+			status: 200,
+			want:   `{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params","data":["id"]},"id":7}`,
+		},
+		{name: "other method", res: ResponseHTTP{Status: "200"}, body: `{"jsonrpc":"2.0","method":"user.delete","id":7}`, status: 404},
+		{name: "not JSON-RPC 2.0", res: ResponseHTTP{Status: "200"}, body: `{"method":"user.get","id":7}`, status: 404},
+		{name: "over max body bytes", res: ResponseHTTP{Status: "200"}, body: `{"jsonrpc":"2.0","method":"user.get","id":7}`, max: 16, status: 413},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{
+				Method:   "post",
+				JSONRPC:  &requestJSONRPC{Method: "user.get"},
+				Response: []ResponseHTTP{test.res},
+			}
+
+			hdl := chi.NewRouter()
+			hdl.With(checkJSONRPC(req)).Method(req.Method, "/rpc", httpHandler(req, []TextBlock{}))
+
+			r := httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(test.body))
+			if test.max > 0 {
+				r = r.WithContext(context.WithValue(r.Context(), CtxKeyMaxBodyBytes, test.max))
+			}
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r)
+
+			if rec.Code != test.status {
+				t.Fatalf("have: %d want: %d", rec.Code, test.status)
+			}
+			if test.status != 200 {
+				return
+			}
+			if have := rec.Body.String(); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+			if have := rec.Header().Get("Content-Type"); have != "application/json" {
+				t.Errorf("have: %q want: %q", have, "application/json")
+			}
+		})
+	}
+}
+
+func TestRequestJSONRPCConcurrent(t *testing.T) {
+	req := RequestHTTP{
+		Method:   "post",
+		JSONRPC:  &requestJSONRPC{Method: "user.get"},
+		Response: []ResponseHTTP{{Status: "200", Body: attr("Hello, ${query.name}")}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.With(checkJSONRPC(req)).Method(req.Method, "/rpc", httpHandler(req, []TextBlock{}))
+
+	// the requests share the parsed result template, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := strings.NewReader(fmt.Sprintf(`{"jsonrpc":"2.0","method":"user.get","id":%d}`, i))
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/rpc?name=n%d", i), body))
+
+			if have, want := rec.Body.String(), fmt.Sprintf(`{"jsonrpc":"2.0","result":"Hello, n%d","id":%d}`, i, i); have != want {
+				t.Errorf("have: %s want: %s", have, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestResponseRange(t *testing.T) {
+	var tests = []struct {
+		name   string
+		rng    string
+		status int
+		body   string
+		want   string
+	}{
+		{name: "no range", status: 200, body: "0123456789"},
+		{name: "byte range", rng: "bytes=2-5", status: 206, body: "2345", want: "bytes 2-5/10"},
+		{name: "suffix range", rng: "bytes=-3", status: 206, body: "789", want: "bytes 7-9/10"},
+		{name: "unsatisfiable", rng: "bytes=20-30", status: 416, want: "bytes */10"},
+		{name: "open ended", rng: "bytes=8-", status: 206, body: "89", want: "bytes 8-9/10"},
+		{name: "past the end", rng: "bytes=8-20", status: 206, body: "89", want: "bytes 8-9/10"},
+		{name: "multiple ranges", rng: "bytes=0-1,4-5", status: 200, body: "0123456789"},
+		{name: "not bytes", rng: "items=0-1", status: 200, body: "0123456789"},
+	}
+
+	req := RequestHTTP{
+		Method:   "get",
+		Response: []ResponseHTTP{{Status: "200", Body: attr("0123456789")}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/test", nil)
+			if test.rng != "" {
+				r.Header.Set("Range", test.rng)
+			}
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r)
+
+			if rec.Code != test.status {
+				t.Errorf("have: %d want: %d", rec.Code, test.status)
+			}
+			if have := rec.Header().Get("Content-Range"); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+			if test.status != 416 {
+				if have := rec.Body.String(); have != test.body {
+					t.Errorf("have: %q want: %q", have, test.body)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseRangeOptions(t *testing.T) {
+	req := RequestHTTP{
+		Method:   "get",
+		Response: []ResponseHTTP{{Status: "200", Body: attr("0123456789"), Chunked: true, CloseConnection: true}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	r := httptest.NewRequest(http.MethodGet, "/test", nil)
+	r.Header.Set("Range", "bytes=2-5")
+
+	rec := httptest.NewRecorder()
+	hdl.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Errorf("have: %d want: %d", rec.Code, http.StatusPartialContent)
+	}
+	if have := rec.Body.String(); have != "2345" {
+		t.Errorf("have: %q want: %q", have, "2345")
+	}
+	if !rec.Flushed {
+		t.Error("have: not flushed want: a chunked response")
+	}
+	if have := rec.Header().Get("Connection"); have != "close" {
+		t.Errorf("have: %q want: %q", have, "close")
+	}
+}
+
+func TestResponseReset(t *testing.T) {
+	var tests = []struct {
+		name    string
+		reset   float64
+		wrapped bool
+		wantErr bool
+	}{
+		{name: "never", reset: 0},
+		{name: "always", reset: 1, wantErr: true},
+		{name: "always without a hijacker", reset: 1, wrapped: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seed := int64(1)
+			reset := test.reset
+			req := RequestHTTP{
+				Method:   "get",
+				Seed:     &seed,
+				Response: []ResponseHTTP{{Status: "200", Body: attr("ok"), Reset: &reset}},
+			}
+
+			hdl := chi.NewRouter()
+			if test.wrapped {
+				hdl.Use(func(next http.Handler) http.Handler {
+					return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						next.ServeHTTP(struct{ http.ResponseWriter }{w}, r) // can't be hijacked
+					})
+				})
+			}
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+			svr := httptest.NewServer(hdl)
+			defer svr.Close()
+
+			res, err := http.Get(svr.URL + "/test")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("have: %v want error: %t", err, test.wantErr)
+			}
+			if err == nil {
+				res.Body.Close()
+			}
+		})
+	}
+}
+
+func TestResponseResetConcurrent(t *testing.T) {
+	reset := 0.0 // the chance is still drawn for every request
+	req := RequestHTTP{
+		Method:   "get",
+		Response: []ResponseHTTP{{Status: "200", Body: attr("ok"), Reset: &reset}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	// the requests share the random source of the handler, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/test", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("have: %d want: %d", rec.Code, http.StatusOK)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestResponseCorruptRate(t *testing.T) {
+	var body = `{"id":1,"name":"Nika","tags":["a","b","c"]}`
+
+	var tests = []struct {
+		name string
+		rate float64
+	}{
+		{name: "never", rate: 0},
+		{name: "sometimes", rate: 0.5},
+		{name: "always", rate: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var bodies = func() (bodies []string) {
+				var seed int64 = 42
+				req := RequestHTTP{
+					Method:   "get",
+					Seed:     &seed,
+					Response: []ResponseHTTP{{Status: "200", Body: attr(body), CorruptRate: &test.rate}},
+				}
+
+				hdl := chi.NewRouter()
+				hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+				for i := 0; i < 20; i++ {
+					rec := httptest.NewRecorder()
+					hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/test", nil))
+					if rec.Code != http.StatusOK {
+						t.Fatalf("have: %d want: %d", rec.Code, http.StatusOK)
+					}
+					bodies = append(bodies, rec.Body.String())
+				}
+				return bodies
+			}
+
+			first, second := bodies(), bodies()
+			if !reflect.DeepEqual(first, second) {
+				t.Fatalf("the same seed has different bodies\nhave: %q\nwant: %q", second, first)
+			}
+
+			var truncated int
+			for _, have := range first {
+				if !strings.HasPrefix(body, have) {
+					t.Fatalf("have: %q want: a prefix of %q", have, body)
+				}
+				if len(have) < len(body) {
+					truncated++
+				}
+			}
+
+			switch {
+			case test.rate == 0 && truncated != 0:
+				t.Errorf("have: %d truncated want: none", truncated)
+			case test.rate == 1 && truncated != len(first):
+				t.Errorf("have: %d truncated want: %d", truncated, len(first))
+			case test.rate == 0.5 && (truncated == 0 || truncated == len(first)):
+				t.Errorf("have: %d truncated want: some of %d", truncated, len(first))
+			}
+		})
+	}
+}
+
+func TestResponseCorruptRateConcurrent(t *testing.T) {
+	rate := 0.5
+	req := RequestHTTP{
+		Method:   "get",
+		Response: []ResponseHTTP{{Status: "200", Body: attr(`{"id":1,"name":"Nika"}`), CorruptRate: &rate}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	// the requests share the random source of the handler, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hdl.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestResponseFragments(t *testing.T) {
+	var tests = []struct {
+		name string
+		url  string
+		want string
+	}{
+		{name: "both fragments", url: "/test?name=Nika&vip=yes", want: `{"greeting":"Hello, Nika","status":"VIP"}`},
+		{name: "conditional fragment", url: "/test?name=Nika&vip=no", want: `{"greeting":"Hello, Nika","status":"member"}`},
+	}
+
+	req := RequestHTTP{
+		Method: "get",
+		Response: []ResponseHTTP{
+			{Status: "200", Body: attr(`{"greeting":"${fragment("greeting")}","status":"${fragment("status")}"}`)},
+		},
+		fragments: []FragmentBlock{
+			{Name: "greeting", Body: attr("Hello, ${query.name}")},
+			{Name: "status", Body: attr(`%{ if query.vip.0 == "yes" }VIP%{ else }member%{ endif }`)},
+		},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.url, nil))
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("have: %d want: %d", rec.Code, http.StatusOK)
+			}
+			if have := rec.Body.String(); have != test.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, test.want)
+			}
+		})
+	}
+}
+
+func TestResponseFragmentsConcurrent(t *testing.T) {
+	req := RequestHTTP{
+		Method: "get",
+		Response: []ResponseHTTP{
+			{Status: "200", Body: attr(`{"greeting":"${fragment("greeting")}"}`)},
+		},
+		fragments: []FragmentBlock{
+			{Name: "greeting", Body: attr("Hello, ${query.name}")},
+		},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	// the requests share the parsed fragment template, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/test?name=n%d", i), nil))
+
+			if have, want := rec.Body.String(), fmt.Sprintf(`{"greeting":"Hello, n%d"}`, i); have != want {
+				t.Errorf("have: %s want: %s", have, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestTextBlockStrict(t *testing.T) {
+	var tests = []struct {
+		name   string
+		strict bool
+		body   string
+		status int
+		want   string
+	}{
+		{name: "found", body: `Hi ${text("greet", "Nika")}`, status: http.StatusOK, want: "Hi Hello, Nika"},
+		{name: "found strict", strict: true, body: `Hi ${text("greet", "Nika")}`, status: http.StatusOK, want: "Hi Hello, Nika"},
+		{name: "missing lenient", body: `Hi ${text("gret", "Nika")}`, status: http.StatusOK, want: "Hi "},
+		{name: "missing strict", strict: true, body: `Hi ${text("gret", "Nika")}`, status: http.StatusBadRequest, want: "Bad Request\n"},
+	}
+
+	texts := []TextBlock{{Name: "greet", Data: attr("Hello, ${arg.1}")}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{Method: "get", Response: []ResponseHTTP{{Status: "200", Body: attr(test.body)}}}
+
+			r := httptest.NewRequest(http.MethodGet, "/test", nil)
+			if test.strict {
+				r = r.WithContext(context.WithValue(r.Context(), CtxKeyStrictText, true))
+			}
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, texts))
+			hdl.ServeHTTP(rec, r)
+
+			if rec.Code != test.status {
+				t.Errorf("have: %d want: %d", rec.Code, test.status)
+			}
+			if have := rec.Body.String(); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestRequestClientCert(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "client.test", Organization: []string{"API Mocked"}},
+		Issuer:       pkix.Name{CommonName: "ca.test"},
+		SerialNumber: big.NewInt(42),
+		DNSNames:     []string{"client.test", "alt.client.test"},
+	}
+
+	var tests = []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "subject", body: "${request.client_cert.subject}", want: "CN=client.test,O=API Mocked"},
+		{name: "common name", body: "${request.client_cert.common_name}", want: "client.test"},
+		{name: "serial", body: "${request.client_cert.serial}", want: "42"},
+		{name: "sans", body: "${request.client_cert.sans[1]}", want: "alt.client.test"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{
+				Method:   "get",
+				Response: []ResponseHTTP{{Status: "200", Body: attr(test.body)}},
+			}
+
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+			r := httptest.NewRequest(http.MethodGet, "/test", nil)
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r)
+
+			if have := rec.Body.String(); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestRequestLatencyProfile(t *testing.T) {
+	lp := &latencyProfile{P50: "20ms", P95: "100ms", P99: "300ms"}
+	rnd := rand.New(rand.NewSource(1))
+
+	samples := make([]time.Duration, 10000)
+	for i := range samples {
+		samples[i] = lp.sample(rnd)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	var tests = []struct {
+		name string
+		p    float64
+		want time.Duration
+	}{
+		{name: "p50", p: 0.50, want: 20 * time.Millisecond},
+		{name: "p95", p: 0.95, want: 100 * time.Millisecond},
+		{name: "p99", p: 0.99, want: 300 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			have := samples[int(test.p*float64(len(samples)))-1]
+			if diff := have - test.want; diff < -test.want/10 || diff > test.want/10 {
+				t.Errorf("have: %v want: %v (within 10%%)", have, test.want)
+			}
+		})
+	}
+}
+
+func TestRequestLatencyProfileConcurrent(t *testing.T) {
+	req := RequestHTTP{
+		Method:         "get",
+		LatencyProfile: &latencyProfile{P50: "1ms", P95: "2ms", P99: "3ms"},
+		Response:       []ResponseHTTP{{Status: "200", Body: attr("ok")}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	// the requests share the random source of the handler, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hdl.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestResponseYAML(t *testing.T) {
+	var yamlBody = "name: ${query.name}\nage: 42\ntags:\n  - admin\n  - \"user\"\n"
+
+	var tests = []struct {
+		name  string
+		serve bool
+		ctype string
+		want  string
+	}{
+		{name: "as JSON", ctype: "application/json", want: `{"age":42,"name":"Nika","tags":["admin","user"]}`},
+		{name: "as YAML", serve: true, ctype: "application/yaml", want: "name: Nika\nage: 42\ntags:\n  - admin\n  - \"user\"\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{
+				Method:   "get",
+				Response: []ResponseHTTP{{Status: "200", BodyYAML: attr(yamlBody), ServeYAML: test.serve}},
+			}
+
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/test?name=Nika", nil))
+
+			if have := rec.Header().Get("Content-Type"); have != test.ctype {
+				t.Errorf("have: %q want: %q", have, test.ctype)
+			}
+			if have := rec.Body.String(); have != test.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, test.want)
+			}
+		})
+	}
+}
+
+func TestResponseYAMLConcurrent(t *testing.T) {
+	req := RequestHTTP{
+		Method:   "get",
+		Response: []ResponseHTTP{{Status: "200", BodyYAML: attr("name: ${query.name}\nage: 42\n")}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	// the requests share the parsed YAML template, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/test?name=n%d", i), nil))
+
+			if have, want := rec.Body.String(), fmt.Sprintf(`{"age":42,"name":"n%d"}`, i); have != want {
+				t.Errorf("have: %s want: %s", have, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestFileLines(t *testing.T) {
+	defer func(open func(string, string, string) (io.ReadCloser, error)) { fileToStrOpen = open }(fileToStrOpen)
+	fileToStrOpen = func(_, _, _ string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("line 1\nline 2\nline 3\nline 4\nline 5\n")), nil
+	}
+
+	var tests = []struct {
+		name   string
+		body   string
+		status int
+		want   string
+	}{
+		{name: "middle range", body: `${file_lines("testdata/app.log", 2, 3)}`, status: 200, want: "line 2\nline 3\nline 4"},
+		{name: "past the end", body: `${file_lines("testdata/app.log", 4, 10)}`, status: 200, want: "line 4\nline 5"},
+		{name: "bad start", body: `${file_lines("testdata/app.log", 0, 1)}`, status: 400, want: "Bad Request\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{
+				Method:   "get",
+				Response: []ResponseHTTP{{Status: "200", Body: attr(test.body)}},
+			}
+
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+			if rec.Code != test.status {
+				t.Errorf("have: %d want: %d", rec.Code, test.status)
+			}
+			if have := rec.Body.String(); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestResponseEchoHeaders(t *testing.T) {
+	req := RequestHTTP{
+		Method:   "get",
+		Response: []ResponseHTTP{{Status: "200", EchoHeaders: true}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	r := httptest.NewRequest(http.MethodGet, "/test", nil)
+	r.Header.Add("X-Custom", "one")
+	r.Header.Add("X-Custom", "two")
+	r.Header.Set("Accept", "application/json")
+
+	rec := httptest.NewRecorder()
+	hdl.ServeHTTP(rec, r)
+
+	var have map[string][]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &have); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{"X-Custom": {"one", "two"}, "Accept": {"application/json"}}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %v\nwant: %v", have, want)
+	}
+	if have := rec.Header().Get("Content-Type"); have != "application/json" {
+		t.Errorf("have: %q want: %q", have, "application/json")
+	}
+}
+
+func TestRequestDelayRange(t *testing.T) {
+	var tests = []struct {
+		delay    string
+		min, max time.Duration
+	}{
+		{delay: "200ms", min: 200 * time.Millisecond, max: 200 * time.Millisecond},
+		{delay: "100ms-500ms", min: 100 * time.Millisecond, max: 500 * time.Millisecond},
+		{delay: "1s - 2s", min: time.Second, max: 2 * time.Second},
+		{delay: "500ms-100ms", min: 100 * time.Millisecond, max: 500 * time.Millisecond},
+		{delay: "bad", min: 0, max: 0},
+	}
+
+	for _, test := range tests {
+		if min, max := delayRange(test.delay); min != test.min || max != test.max {
+			t.Errorf("[%s] have: %v-%v want: %v-%v", test.delay, min, max, test.min, test.max)
+		}
+	}
+
+	// the handler sleeps for a random delay in the range
+	var seed int64 = 1
+	req := RequestHTTP{
+		Method:   "get",
+		Delay:    "20ms-40ms",
+		Seed:     &seed,
+		Response: []ResponseHTTP{{Status: "200", Body: attr("ok")}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		hdl.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+		if took := time.Since(start); took < 20*time.Millisecond {
+			t.Errorf("[%d] have: %v want: at least %v", i+1, took, 20*time.Millisecond)
+		}
+	}
+}
+
+func TestRequestDelayRangeConcurrent(t *testing.T) {
+	req := RequestHTTP{
+		Method:   "get",
+		Delay:    "1ms-2ms",
+		Response: []ResponseHTTP{{Status: "200", Body: attr("ok")}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	// the requests share the random source of the handler, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hdl.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLockedSource(t *testing.T) {
+	want := rand.New(rand.NewSource(7))
+	have := rand.New(newLockedSource(7))
+	for i := 0; i < 5; i++ {
+		if w, h := want.Int63n(100), have.Int63n(100); w != h {
+			t.Errorf("[%d] have: %d want: %d", i+1, h, w) // the same seed gives the same values
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				have.Int63n(100)
+				have.Float64()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRequestDelayRamp(t *testing.T) {
+	dr := &delayRamp{Step: "10ms", Cap: "35ms"}
+
+	var tests = []struct {
+		call uint64
+		want time.Duration
+	}{
+		{call: 1, want: 0},
+		{call: 2, want: 10 * time.Millisecond},
+		{call: 3, want: 20 * time.Millisecond},
+		{call: 4, want: 30 * time.Millisecond},
+		{call: 5, want: 35 * time.Millisecond},
+		{call: 50, want: 35 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		if have := dr.delay(test.call); have != test.want {
+			t.Errorf("[%d] have: %v want: %v", test.call, have, test.want)
+		}
+	}
+
+	// the handler uses the call count of each request
+	req := RequestHTTP{
+		Method:    "get",
+		DelayRamp: &delayRamp{Step: "30ms", Cap: "60ms"},
+		Response:  []ResponseHTTP{{Status: "200", Body: attr("ok")}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	for i, want := range []time.Duration{0, 30 * time.Millisecond, 60 * time.Millisecond, 60 * time.Millisecond} {
+		start := time.Now()
+		hdl.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+		if took := time.Since(start); took < want {
+			t.Errorf("[%d] have: %v want: at least %v", i+1, took, want)
+		}
+	}
+}
+
+func TestResponseMergePatch(t *testing.T) {
+	var tests = []struct {
+		name   string
+		method string
+		base   *hcl.Attribute
+		patch  string
+		want   string
+	}{
+		{
+			name:   "add and remove",
+			method: "patch",
+			base:   attr(`{"name":"Nika","role":"admin","tags":["a"]}`),
+			patch:  `{"role":null,"age":30,"tags":["b"]}`,
+			want:   `{"age":30,"name":"Nika","tags":["b"]}`,
+		},
+		{
+			name:   "nested objects",
+			method: "post",
+			base:   attrE(`{ user = { name = "Nika", email = "nika@example.com" } }`),
+			patch:  `{"user":{"email":null,"admin":true}}`,
+			want:   `{"user":{"admin":true,"name":"Nika"}}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{
+				Method:   test.method,
+				Response: []ResponseHTTP{{Status: "200", MergePatch: test.base}},
+			}
+
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+			r, err := http.NewRequest(strings.ToUpper(test.method), "/test", strings.NewReader(test.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r)
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("have: %d want: %d", rec.Code, http.StatusOK)
+			}
+			if have := rec.Body.String(); have != test.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, test.want)
+			}
+			if have := rec.Header().Get("Content-Type"); have != "application/json" {
+				t.Errorf("have: %q want: %q", have, "application/json")
+			}
+		})
+	}
+}
+
+func TestRequestHTTPVersion(t *testing.T) {
+	var v2, v11 = "2", "1.1"
+	req2 := RequestHTTP{Method: "get", HTTPVersion: &v2, Response: []ResponseHTTP{{Status: "200", Body: attr("h2")}}}
+	req11 := RequestHTTP{Method: "get", HTTPVersion: &v11, Response: []ResponseHTTP{{Status: "200", Body: attr("http/1.1")}}}
+
+	both := chi.NewRouter()
+	v := hfsmws{hfs: []http.HandlerFunc{httpHandler(req11, []TextBlock{})}, mws: []chi.Middlewares{{checkHTTPVersion(req11)}}}
+	both.With(checkRetries(v)).With(checkHTTPVersion(req2)).Method(http.MethodGet, "/test", httpHandler(req2, []TextBlock{}))
+
+	only2 := chi.NewRouter()
+	only2.With(checkHTTPVersion(req2)).Method(http.MethodGet, "/test", httpHandler(req2, []TextBlock{}))
+
+	var tests = []struct {
+		name   string
+		hdl    http.Handler
+		http2  bool
+		status int
+		want   string
+	}{
+		{name: "HTTP/2", hdl: both, http2: true, status: http.StatusOK, want: "h2"},
+		{name: "HTTP/1.1", hdl: both, status: http.StatusOK, want: "http/1.1"},
+		{name: "no match", hdl: only2, status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svr := httptest.NewUnstartedServer(test.hdl)
+			svr.EnableHTTP2 = test.http2
+			svr.StartTLS()
+			defer svr.Close()
+
+			res, err := svr.Client().Get(svr.URL + "/test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if test.http2 && res.ProtoMajor != 2 {
+				t.Fatalf("have: %s want: HTTP/2", res.Proto)
+			}
+			if res.StatusCode != test.status {
+				t.Errorf("have: %d want: %d", res.StatusCode, test.status)
+			}
+			if have := string(b); test.want != "" && have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestRouteOnNoMatch(t *testing.T) {
+	req := RequestHTTP{
+		Method:   "get",
+		Headers:  &headers{Data: headerData{"X-Api-Key": {cty.StringVal("secret")}}},
+		Response: []ResponseHTTP{{Status: "200", Body: attr("welcome")}},
+	}
+	noMatch := RequestHTTP{
+		Method: "get",
+		Response: []ResponseHTTP{
+			{Status: "404", Body: attr("no match: first")},
+			{Status: "404", Body: attr("no match: second")},
+		},
+	}
+
+	hdl := chi.NewRouter()
+	v := hfsmws{noMatch: httpHandler(noMatch, []TextBlock{})}
+	hdl.With(checkRetries(v)).With(checkRequestHeader(req, hdl.NotFoundHandler())).Method(http.MethodGet, "/test", httpHandler(req, []TextBlock{}))
+
+	var tests = []struct {
+		key    string
+		status int
+		body   string
+	}{
+		{key: "secret", status: 200, body: "welcome"},
+		{key: "wrong", status: 404, body: "no match: first"},
+		{key: "wrong", status: 404, body: "no match: second"},
+		{key: "secret", status: 200, body: "welcome"},
+		{key: "wrong", status: 404, body: "no match: first"},
+	}
+
+	for i, test := range tests {
+		r, err := http.NewRequest(http.MethodGet, "/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-Api-Key", test.key)
+
+		rec := httptest.NewRecorder()
+		hdl.ServeHTTP(rec, r)
+
+		if rec.Code != test.status {
+			t.Errorf("[%d] have: %d want: %d", i, rec.Code, test.status)
+		}
+		if have := rec.Body.String(); have != test.body {
+			t.Errorf("[%d] have: %q want: %q", i, have, test.body)
+		}
+	}
+}
+
+func TestUploadedFile(t *testing.T) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.WriteField("note", "the report"); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := make(textproto.MIMEHeader)
+	hdr.Set("Content-Disposition", `form-data; name="upload"; filename="report.csv"`)
+	hdr.Set("Content-Type", "text/csv")
+	part, err := mw.CreatePart(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(part, "id,name\n1,Nika\n")
+	mw.Close()
+
+	req := RequestHTTP{
+		Method: "post",
+		Response: []ResponseHTTP{
+			{
+				Status: "201",
+				Body:   attr(`{"name":"${post.upload.filename}","size":${post.upload.size},"type":"${post.upload.content_type}","note":"${post.note}"}`),
+			},
+		},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/upload", httpHandler(req, []TextBlock{}))
+
+	r, err := http.NewRequest(http.MethodPost, "/upload", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	rec := httptest.NewRecorder()
+	hdl.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusCreated {
+		t.Errorf("have: %d want: %d", rec.Code, http.StatusCreated)
+	}
+
+	want := `{"name":"report.csv","size":15,"type":"text/csv","note":"the report"}`
+	if have := rec.Body.String(); have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
+
+func TestResponseHeaderTemplate(t *testing.T) {
+	var config Config
+	src := `
+path "/test" {
+	request "get" {
+		response "200" {
+			header {
+				X-Id    = "id-${query.id}"
+				X-Multi = ["static", "from-${query.id}"]
+			}
+		}
+	}
+}`
+	if err := decode([]string{"test.hcl"}, [][]byte{[]byte(src)}, _context(), &config); err != nil {
+		t.Fatal(err)
+	}
+
+	req := config.Routes[0].Request[0]
+	req.Plugins = hcl.EmptyBody()
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	rec := httptest.NewRecorder()
+	hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/test?id=42", nil))
+
+	var tests = []struct {
+		name string
+		want []string
+	}{
+		{name: "X-Id", want: []string{"id-42"}},
+		{name: "X-Multi", want: []string{"static", "from-42"}},
+	}
+
+	for _, test := range tests {
+		if have := rec.Header().Values(test.name); !reflect.DeepEqual(have, test.want) {
+			t.Errorf("%s have: %q want: %q", test.name, have, test.want)
+		}
+	}
+}
+
+func TestResponseHeaderTemplateConcurrent(t *testing.T) {
+	var config Config
+	src := `
+path "/test" {
+	request "get" {
+		response "200" {
+			header {
+				X-Id = "id-${query.id}"
+			}
+			body = "v${query.id}"
+		}
+	}
+}`
+	if err := decode([]string{"test.hcl"}, [][]byte{[]byte(src)}, _context(), &config); err != nil {
+		t.Fatal(err)
+	}
+
+	req := config.Routes[0].Request[0]
+	req.Plugins = hcl.EmptyBody()
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	// the requests share the parsed templates, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/test?id=%d", i), nil))
+
+			if have, want := rec.Header().Get("X-Id"), fmt.Sprintf("id-%d", i); have != want {
+				t.Errorf("have: %q want: %q", have, want)
+			}
+			if have, want := rec.Body.String(), fmt.Sprintf("v%d", i); have != want {
+				t.Errorf("have: %q want: %q", have, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestResponseDownload(t *testing.T) {
+	var tests = []struct {
+		name     string
+		url      string
+		download *hcl.Attribute
+		want     string
+	}{
+		{
+			name:     "templated query",
+			url:      "/test?id=42",
+			download: attr("report-${query.id}.csv"),
+			want:     `attachment; filename="report-42.csv"`,
+		},
+		{
+			name:     "escaped quotes",
+			url:      "/test?name=my%22file",
+			download: attr("${query.name}.txt"),
+			want:     `attachment; filename="my\"file.txt"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{
+				Method:   "get",
+				Response: []ResponseHTTP{{Status: "200", Download: test.download, Body: attr("id,name")}},
+			}
+
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+			r, err := http.NewRequest(http.MethodGet, test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r)
+
+			if have := rec.Header().Get("Content-Disposition"); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+			if have := rec.Body.String(); have != "id,name" {
+				t.Errorf("have: %q want: %q", have, "id,name")
+			}
+		})
+	}
+}
+
+func TestResponseBodyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "body_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var big = strings.Repeat("0123456789abcdef", 1<<16) // 1MB
+	os.MkdirAll(filepath.Join(dir, "run", "fixtures"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "run", "fixtures", "big.json"), []byte(big), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0644)
+
+	defer func(path string) { _runtimePath = path }(_runtimePath)
+	_runtimePath = filepath.Join(dir, "run")
+
+	var tests = []struct {
+		name   string
+		file   string
+		status int
+		want   string
+	}{
+		{name: "file", file: "fixtures/big.json", status: http.StatusCreated, want: big},
+		{name: "leading dots", file: "../secret.txt", status: http.StatusInternalServerError},
+		{name: "escape", file: "fixtures/../../secret.txt", status: http.StatusInternalServerError},
+		{name: "missing", file: "fixtures/nope.json", status: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := test.file
+			req := RequestHTTP{
+				Method:   "get",
+				Response: []ResponseHTTP{{Status: "201", BodyFile: &file}},
+			}
+
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+			if rec.Code != test.status {
+				t.Fatalf("have: %d want: %d", rec.Code, test.status)
+			}
+			if test.status != http.StatusCreated {
+				if rec.Body.String() == "secret" {
+					t.Error("the file outside of the runtime path was sent")
+				}
+				return
+			}
+
+			if have, want := rec.Header().Get("Content-Length"), strconv.Itoa(len(test.want)); have != want {
+				t.Errorf("have: %s want: %s", have, want)
+			}
+			if have := rec.Body.String(); have != test.want {
+				t.Errorf("have: %d bytes want: %d bytes", len(have), len(test.want))
+			}
+		})
+	}
+}
+
+func TestResponseBodyFileOptions(t *testing.T) {
+	defer func(path string) { _runtimePath = path }(_runtimePath)
+	_runtimePath = "/run"
+
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/run/fixtures/digits.txt", []byte("0123456789"), 0644)
+
+	var tests = []struct {
+		name    string
+		status  string
+		rng     string
+		chunked bool
+		code    int
+		want    string
+		length  string
+	}{
+		{name: "ok", status: "200", code: 200, want: "0123456789", length: "10"},
+		{name: "range", status: "200", rng: "bytes=2-5", code: 206, want: "2345", length: "4"},
+		{name: "range on a 201", status: "201", rng: "bytes=2-5", code: 201, want: "0123456789", length: "10"},
+		{name: "chunked", status: "200", chunked: true, code: 200, want: "0123456789"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := "fixtures/digits.txt"
+			req := RequestHTTP{
+				Method:   "get",
+				Response: []ResponseHTTP{{Status: test.status, BodyFile: &file, Chunked: test.chunked, CloseConnection: true}},
+			}
+
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+			r := httptest.NewRequest(http.MethodGet, "/test", nil)
+			if test.rng != "" {
+				r.Header.Set("Range", test.rng)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), CtxKeyFs, fs))
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r)
+
+			if rec.Code != test.code {
+				t.Fatalf("have: %d want: %d", rec.Code, test.code)
+			}
+			if have := rec.Body.String(); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+			if have := rec.Header().Get("Content-Length"); have != test.length {
+				t.Errorf("have: %q want: %q Content-Length", have, test.length)
+			}
+			if have := rec.Header().Get("Connection"); have != "close" {
+				t.Errorf("have: %q want: %q", have, "close")
+			}
+			if rec.Flushed != test.chunked {
+				t.Errorf("have: %t want: %t flushed", rec.Flushed, test.chunked)
+			}
+		})
+	}
+}
+
+func TestJSONPointer(t *testing.T) {
+	var body = `{"users":[{"id":1,"name":"Ann"},{"id":2,"name":"Bo","tags":["a/b"]}],"a/b":{"m~n":true}}`
+
+	type want struct {
+		status int
+		body   string
+	}
+
+	var tests = []struct {
+		name    string
+		pointer string
+		want    want
+	}{
+		{name: "nested array element", pointer: "/users/1/id", want: want{200, "2"}},
+		{name: "string value", pointer: "/users/0/name", want: want{200, "Ann"}},
+		{name: "object value", pointer: "/users/1/tags", want: want{200, `["a/b"]`}},
+		{name: "escaped tokens", pointer: "/a~1b/m~0n", want: want{200, "true"}},
+		{name: "out of range", pointer: "/users/2/id", want: want{400, ""}},
+		{name: "leading zero", pointer: "/users/01/id", want: want{400, ""}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{
+				Method:   "post",
+				Response: []ResponseHTTP{{Status: "200", Body: attrE(`jsonpointer(request.body, "` + test.pointer + `")`)}},
+			}
+
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+			r, err := http.NewRequest(http.MethodPost, "/test", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r)
+
+			if rec.Code != test.want.status {
+				t.Errorf("have: %d want: %d", rec.Code, test.want.status)
+			}
+			if have := rec.Body.String(); test.want.status == 200 && have != test.want.body {
+				t.Errorf("have: %q want: %q", have, test.want.body)
+			}
+		})
+	}
+}
+
+func TestURLEncode(t *testing.T) {
+	var value = "a b&c=d/é?"
+
+	var tests = []struct {
+		name   string
+		expr   string
+		status int
+		want   string
+	}{
+		{name: "encode", expr: `urlencode(request.body)`, status: 200, want: "a+b%26c%3Dd%2F%C3%A9%3F"},
+		{name: "round trip", expr: `urldecode(urlencode(request.body))`, status: 200, want: value},
+		{name: "bad escape", expr: `urldecode("%zz")`, status: 400},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{
+				Method:   "post",
+				Response: []ResponseHTTP{{Status: "200", Body: attrE(test.expr)}},
+			}
+
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(value)))
+
+			if rec.Code != test.status {
+				t.Errorf("have: %d want: %d", rec.Code, test.status)
+			}
+			if have := rec.Body.String(); test.status == 200 && have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestResponseEnv(t *testing.T) {
+	defer os.Unsetenv("API_MOCKED_TEST_REGION")
+	os.Setenv("API_MOCKED_TEST_REGION", "us-east-1")
+
+	req := RequestHTTP{
+		Method:   "get",
+		Response: []ResponseHTTP{{Status: "200", Body: attr(`{"region":"${env("API_MOCKED_TEST_REGION")}","missing":"${env("API_MOCKED_TEST_MISSING")}"}`)}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	rec := httptest.NewRecorder()
+	hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("have: %d want: %d", rec.Code, http.StatusOK)
+	}
+	if have, want := rec.Body.String(), `{"region":"us-east-1","missing":""}`; have != want {
+		t.Errorf("have: %q want: %q", have, want)
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	defer os.Unsetenv("API_MOCKED_TEST_SECRET")
+	os.Setenv("API_MOCKED_TEST_SECRET", "s3cr3t")
+
+	var tests = []struct {
+		name    string
+		expr    string
+		want    string
+		wantErr string
+	}{
+		{name: "env set", expr: `env("API_MOCKED_TEST_SECRET", "default")`, want: "s3cr3t"},
+		{name: "env default", expr: `env("API_MOCKED_TEST_MISSING", "default")`, want: "default"},
+		{name: "env no default", expr: `env("API_MOCKED_TEST_MISSING")`, want: ""},
+		{name: "env two defaults", expr: `env("API_MOCKED_TEST_MISSING", "a", "b")`, wantErr: "env takes one default"},
+		{name: "must env set", expr: `must_env("API_MOCKED_TEST_SECRET")`, want: "s3cr3t"},
+		{name: "must env missing", expr: `must_env("API_MOCKED_TEST_MISSING")`, wantErr: `the "API_MOCKED_TEST_MISSING" environment variable is not set`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := []byte(`http "test" { cookie_secret = ` + test.expr + ` }`)
+
+			var config Config
+			err := decode([]string{"test.hcl"}, [][]byte{src}, _context(), &config)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("have: %v want: %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have := *config.Servers[0].CookieSecret; have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestRequestScript(t *testing.T) {
+	_feature := _featureScript
+	defer func() { _featureScript = _feature }()
+
+	// script parses the HCL source so that the values keep their written order
+	var script = func(src string) *requestScript {
+		file, dia := hclsyntax.ParseConfig([]byte(src), "test.hcl", hcl.Pos{Line: 1, Column: 1})
+		if dia.HasErrors() {
+			t.Fatal(dia)
+		}
+		attrs, dia := file.Body.JustAttributes()
+		if dia.HasErrors() {
+			t.Fatal(dia)
+		}
+		return &requestScript{Vars: attrs}
+	}
+
+	type want struct {
+		status int
+		body   string
+	}
+
+	var tests = []struct {
+		name    string
+		enabled bool
+		url     string
+		req     RequestHTTP
+		want    want
+	}{
+		{
+			name:    "set a variable",
+			enabled: true,
+			url:     "/test?name=World",
+			req: RequestHTTP{
+				Method: "get",
+				Script: script(`
+name     = query.name.0
+greeting = "Hello, ${script.name}"
+`),
+				Response: []ResponseHTTP{{Status: "200", Body: attr("${script.greeting}")}},
+			},
+			want: want{status: 200, body: "Hello, World"},
+		},
+		{
+			name:    "set the status",
+			enabled: true,
+			url:     "/test?fail=yes",
+			req: RequestHTTP{
+				Method:   "get",
+				Script:   script(`status = query.fail.0 == "yes" ? 503 : 200`),
+				Response: []ResponseHTTP{{Status: "200", Body: attr("status: ${script.status}")}},
+			},
+			want: want{status: 503, body: "status: 503"},
+		},
+		{
+			name:    "disabled",
+			enabled: false,
+			url:     "/test?fail=yes",
+			req: RequestHTTP{
+				Method:   "get",
+				Script:   script(`status = 503`),
+				Response: []ResponseHTTP{{Status: "200", Body: attr("OK")}},
+			},
+			want: want{status: 200, body: "OK"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_featureScript = test.enabled
+
+			req, err := http.NewRequest(strings.ToUpper(test.req.Method), test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+			hdl.Method(test.req.Method, "/test", httpHandler(test.req, []TextBlock{}))
+			hdl.ServeHTTP(rec, req)
+
+			if rec.Code != test.want.status {
+				t.Errorf("have: %d want: %d", rec.Code, test.want.status)
+			}
+			if have := rec.Body.String(); have != test.want.body {
+				t.Errorf("have: %q want: %q", have, test.want.body)
+			}
+		})
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	type want struct {
+		status int
+		body   string
+	}
+
+	var tests = []struct {
+		name        string
+		method      string
+		auth        string
+		username    string
+		password    string
+		user        string // expected
+		pass        string // expected
+		body        io.Reader
+		req         RequestHTTP
+		contentType string
+		want        want
+	}{
+		{
+			name:        "auth",
+			method:      "post",
+			body:        strings.NewReader("This is a test"),
+			auth:        "auth",
+			username:    "user",
+			password:    "password",
+			user:        "user",
+			pass:        "password",
+			contentType: "text/plain",
+			req: RequestHTTP{
+				Method: "post",
+				Response: []ResponseHTTP{
+					{
+						Body: attr("${request.body}"),
+					},
+				},
+			},
+			want: want{
+				status: 200,
+				body:   "This is a test",
+			},
+		},
+		{
+			name:     "bad auth",
+			method:   "post",
+			body:     strings.NewReader("This is a test"),
+			auth:     "auth",
+			username: "user",
+			password: "password-bad",
+			user:     "user",
+			pass:     "password",
+			req: RequestHTTP{
+				Method: "post",
+				Response: []ResponseHTTP{
+					{
+						Body: attr("${request.body}"),
+					},
+				},
+			},
+			want: want{
+				status: 401,
+				body:   "Unauthorized\n",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			req, err := http.NewRequest(strings.ToUpper(test.method), "/test", test.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.contentType == "" {
+				test.contentType = "application/x-www-form-urlencoded"
+			}
+			req.Header.Add("Content-Type", test.contentType)
+			req.SetBasicAuth(test.username, test.password)
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+
+			server := ConfigHTTP{
+				BasicAuth: &configBA{
+					User: test.user,
+					Pass: test.pass,
+				},
+			}
+
+			if strings.ToUpper(test.method) == http.MethodPost {
+				hdl.Use(checkRequestPost(test.req, hdl.NotFoundHandler()))
+			}
+			hdl.Use(checkBasicAuth(server, hdl.NotFoundHandler()))
+			hdl.Method(test.req.Method, "/test", httpHandler(test.req, []TextBlock{}))
+			hdl.ServeHTTP(rec, req)
+
+			haveBody := rec.Body.String()
+			if haveBody != test.want.body {
+				t.Errorf("have: %q want: %q", haveBody, test.want.body)
+			}
+		})
+	}
+}
+
+func TestBasicAuthChallengeOnly(t *testing.T) {
+	var tests = []struct {
+		name string
+		relm string
+		user string
+		want string
+	}{
+		{name: "no credentials", relm: "mock", want: `Basic realm="mock"`},
+		{name: "good credentials", relm: "mock", user: "user", want: `Basic realm="mock"`},
+		{name: "default realm", want: `Basic realm="Restricted"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{Method: "get", Response: []ResponseHTTP{{Status: "200", Body: attr("ok")}}}
+			server := ConfigHTTP{BasicAuth: &configBA{User: "user", Pass: "password", Relm: test.relm, ChallengeOnly: true}}
+
+			r := httptest.NewRequest(http.MethodGet, "/test", nil)
+			if test.user != "" {
+				r.SetBasicAuth(test.user, "password")
+			}
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+			hdl.Use(checkBasicAuth(server, hdl.NotFoundHandler()))
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+			hdl.ServeHTTP(rec, r)
+
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("have: %d want: %d", rec.Code, http.StatusUnauthorized)
+			}
+			if have := rec.Header().Get("WWW-Authenticate"); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestShutdownDraining(t *testing.T) {
+	var draining int32
+	var started, release = make(chan struct{}), make(chan struct{})
+
+	hdl := chi.NewRouter()
+	hdl.Use(checkShutdown(&draining, "going away"))
+	hdl.Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		fmt.Fprint(w, "finished")
+	})
+	hdl.Get("/fast", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "fast") })
+
+	// an in-flight request that completes after the shutdown starts
+	inflight := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slow", nil))
+		inflight <- rec
+	}()
+	<-started
+
+	atomic.StoreInt32(&draining, 1)
+
+	rec := httptest.NewRecorder()
+	hdl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("[new] have: %d want: %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if have, want := rec.Body.String(), "going away\n"; have != want {
+		t.Errorf("[new] have: %q want: %q", have, want)
+	}
+	if have := rec.Header().Get("Connection"); have != "close" {
+		t.Errorf("[new] have: %q want: %q", have, "close")
+	}
+
+	close(release)
+	rec = <-inflight
+	if rec.Code != http.StatusOK {
+		t.Errorf("[in-flight] have: %d want: %d", rec.Code, http.StatusOK)
+	}
+	if have := rec.Body.String(); have != "finished" {
+		t.Errorf("[in-flight] have: %q want: %q", have, "finished")
+	}
+}
+
+func TestSignedCookie(t *testing.T) {
+	var secret = []byte("s3cr3t")
+	var signed = signCookie(secret, "session", "user-42")
+
+	var tests = []struct {
+		name   string
+		cookie *http.Cookie
+		status int
+	}{
+		{name: "valid", cookie: &http.Cookie{Name: "session", Value: signed}, status: http.StatusOK},
+		{name: "tampered value", cookie: &http.Cookie{Name: "session", Value: strings.Replace(signed, "42", "43", 1)}, status: http.StatusUnauthorized},
+		{name: "moved to another cookie", cookie: &http.Cookie{Name: "session", Value: signCookie(secret, "other", "user-42")}, status: http.StatusUnauthorized},
+		{name: "unsigned", cookie: &http.Cookie{Name: "session", Value: "user-42"}, status: http.StatusUnauthorized},
+		{name: "missing", status: http.StatusUnauthorized},
+	}
+
+	login := RequestHTTP{
+		Method: "get",
+		Response: []ResponseHTTP{{
+			Status:       "200",
+			SignedCookie: []responseSignedCookie{{Name: "session", Value: attr("user-${query.id}")}},
+		}},
+	}
+	req := RequestHTTP{
+		Method:        "get",
+		SignedCookies: []string{"session"},
+		Response:      []ResponseHTTP{{Status: "200", Body: attr("ok")}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(login.Method, "/login", httpHandler(login, []TextBlock{}))
+	hdl.With(checkSignedCookies(req)).Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	t.Run("issued", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/login?id=42", nil)
+		rec := httptest.NewRecorder()
+		hdl.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), CtxKeyCookieSecret, secret)))
+
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != "session" {
+			t.Fatalf("have: %v want: a session cookie", cookies)
+		}
+		if cookies[0].Value != signed {
+			t.Errorf("have: %q want: %q", cookies[0].Value, signed)
+		}
+		if value, ok := verifyCookie(secret, "session", cookies[0].Value); !ok || value != "user-42" {
+			t.Errorf("have: %q (%t) want: %q", value, ok, "user-42")
+		}
+	})
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/test", nil)
+			if test.cookie != nil {
+				r.AddCookie(test.cookie)
+			}
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), CtxKeyCookieSecret, secret)))
+
+			if rec.Code != test.status {
+				t.Errorf("have: %d want: %d", rec.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestSignedCookieConcurrent(t *testing.T) {
+	var secret = []byte("s3cr3t")
+
+	login := RequestHTTP{
+		Method: "get",
+		Response: []ResponseHTTP{{
+			Status:       "200",
+			SignedCookie: []responseSignedCookie{{Name: "session", Value: attr("user-${query.id}")}},
+		}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Method(login.Method, "/login", httpHandler(login, []TextBlock{}))
+
+	// the requests share the parsed cookie template, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/login?id=%d", i), nil)
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), CtxKeyCookieSecret, secret)))
+
+			cookies := rec.Result().Cookies()
+			if len(cookies) != 1 {
+				t.Errorf("have: %v want: a session cookie", cookies)
+				return
+			}
+			if value, ok := verifyCookie(secret, "session", cookies[0].Value); !ok || value != fmt.Sprintf("user-%d", i) {
+				t.Errorf("have: %q (%t) want: %q", value, ok, fmt.Sprintf("user-%d", i))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestJWTAuth(t *testing.T) {
+	tokenStr := getJWTTestToken(t)
+
+	type want struct {
+		status int
+		body   string
+	}
+
+	var tests = []struct {
+		name   string
+		method string
+		auth   string
+		jwt    string
+		body   io.Reader
+		req    RequestHTTP
+		want   want
+	}{
+		{
+			name:   "auth",
+			method: "post",
+			body:   strings.NewReader("This is a test"),
+			auth:   "auth",
+			jwt:    tokenStr,
+			req: RequestHTTP{
+				Method: "post",
+				Response: []ResponseHTTP{
+					{
+						Body: attr("${request.body}"),
+					},
+				},
+			},
+			want: want{
+				status: 200,
+				body:   "This is a test",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			req, err := http.NewRequest(strings.ToUpper(test.method), "/test", test.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+
+			hdl.Use(checkRequestPost(test.req, hdl.NotFoundHandler()))
+			hdl.Method(test.req.Method, "/test", httpHandler(test.req, []TextBlock{}))
+			hdl.ServeHTTP(rec, req)
+
+			haveBody := rec.Body.String()
+			if haveBody != test.want.body {
+				t.Errorf("have: %q want: %q", haveBody, test.want.body)
+			}
+		})
+	}
+}
+
+func TestJWTExpirationDuration(t *testing.T) {
+	now := time.Now()
+	jwtgo.TimeFunc = func() time.Time { return now }
+	defer func() { jwtgo.TimeFunc = time.Now }()
+
+	var tests = []struct {
+		name string
+		exp  *hcl.Attribute
+		want int64
+	}{
+		{name: "duration", exp: attr("15m"), want: now.Add(15 * time.Minute).Unix()},
+		{name: "unix time", exp: attrE(fmt.Sprint(now.Add(time.Hour).Unix())), want: now.Add(time.Hour).Unix()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resJWT := responseJWT{Name: "test-1", Expiration: test.exp}
+
+			b, err := resJWT.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var claims struct {
+				Exp int64 `json:"exp"`
+			}
+			if err := json.Unmarshal(b, &claims); err != nil {
+				t.Fatal(err)
+			}
+
+			if claims.Exp != test.want {
+				t.Errorf("have: %d want: %d", claims.Exp, test.want)
+			}
+			if !resJWT.VerifyExpiresAt(now.Unix(), true) {
+				t.Errorf("have: expired want: not expired")
+			}
+		})
+	}
+}
+
+func TestJWTContains(t *testing.T) {
+	secret := []byte("the secret string")
+
+	var tests = []struct {
+		name     string
+		claims   jwtgo.MapClaims
+		contains string
+		status   int
+	}{
+		{
+			name:     "scope string",
+			claims:   jwtgo.MapClaims{"scope": "read:users write:users"},
+			contains: `{ scope = "read:users" }`,
+			status:   200,
+		},
+		{
+			name:     "scope string missing",
+			claims:   jwtgo.MapClaims{"scope": "read:orders write:orders"},
+			contains: `{ scope = "read:users" }`,
+			status:   404,
+		},
+		{
+			name:     "roles array",
+			claims:   jwtgo.MapClaims{"roles": []interface{}{"admin", "user"}},
+			contains: `{ roles = ["user", "admin"] }`,
+			status:   200,
+		},
+		{
+			name:     "roles array missing",
+			claims:   jwtgo.MapClaims{"roles": []interface{}{"user"}},
+			contains: `{ roles = ["user", "admin"] }`,
+			status:   404,
+		},
+		{
+			name:     "no claim",
+			claims:   jwtgo.MapClaims{"sub": "me"},
+			contains: `{ scope = "read:users" }`,
+			status:   404,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tokenStr, err := jwtgo.NewWithClaims(jwtgo.SigningMethodHS256, test.claims).SignedString(secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := RequestHTTP{
+				Method:   "get",
+				JWT:      &requestJWT{Input: "header", Key: "X-Token", Contains: attrE(test.contains)},
+				Response: []ResponseHTTP{{Status: "200", Body: attr("ok")}},
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/test", nil)
+			r.Header.Set("X-Token", tokenStr)
+			r = r.WithContext(context.WithValue(r.Context(), CtxKeySignature, secret))
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+			hdl.Use(checkRequestJWT(req, hdl.NotFoundHandler()))
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+			hdl.ServeHTTP(rec, r)
+
+			if rec.Code != test.status {
+				t.Errorf("have: %d want: %d", rec.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestJWTOnInvalid(t *testing.T) {
+	secret := []byte("the secret string")
+	expired := jwtgo.MapClaims{"sub": "me", "exp": time.Now().Add(-time.Hour).Unix()}
+	tokenStr, err := jwtgo.NewWithClaims(jwtgo.SigningMethodHS256, expired).SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := func(body string) http.Handler {
+		return httpHandler(RequestHTTP{Method: "get", Response: []ResponseHTTP{{Status: "401", Body: attr(body)}}}, []TextBlock{})
+	}
+
+	var tests = []struct {
+		name    string
+		request http.Handler
+		server  http.Handler
+		status  int
+		want    string
+	}{
+		{name: "request", request: invalid("request expired"), status: 401, want: "request expired"},
+		{name: "server", server: invalid("server expired"), status: 401, want: "server expired"},
+		{name: "request before server", request: invalid("request expired"), server: invalid("server expired"), status: 401, want: "request expired"},
+		{name: "none", status: 500, want: "Internal server error\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{
+				Method:   "get",
+				JWT:      &requestJWT{Input: "header", Key: "X-Token"},
+				Response: []ResponseHTTP{{Status: "200", Body: attr("ok")}},
+			}
+			req.onInvalidJWT = test.request
+
+			r := httptest.NewRequest(http.MethodGet, "/test", nil)
+			r.Header.Set("X-Token", tokenStr)
+			ctx := context.WithValue(r.Context(), CtxKeySignature, secret)
+			if test.server != nil {
+				ctx = context.WithValue(ctx, CtxKeyOnInvalidJWT, test.server)
+			}
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+			hdl.Use(checkRequestJWT(req, hdl.NotFoundHandler()))
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+			hdl.ServeHTTP(rec, r.WithContext(ctx))
+
+			if rec.Code != test.status {
+				t.Errorf("have: %d want: %d", rec.Code, test.status)
+			}
+			if have := rec.Body.String(); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestJWTSign(t *testing.T) {
+	secret := []byte("the secret string")
+
+	var tests = []struct {
+		name   string
+		body   string
+		status int
+		want   jwtgo.MapClaims
+	}{
+		{
+			name:   "signed token field",
+			body:   `{ token = jwt_sign("auth", { sub = "me", admin = true }) }`,
+			status: 200,
+			want:   jwtgo.MapClaims{"sub": "me", "admin": true},
+		},
+		{
+			name:   "unknown config",
+			body:   `{ token = jwt_sign("other", { sub = "me" }) }`,
+			status: 400,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{Method: "get", Response: []ResponseHTTP{{Status: "200", Body: attrE(test.body)}}}
+
+			r := httptest.NewRequest(http.MethodGet, "/test", nil)
+			ctx := context.WithValue(r.Context(), ctxKey("auth"), &configJWT{Name: "auth", Alg: "HS256"})
+			ctx = context.WithValue(ctx, CtxKeySignature, secret)
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+			hdl.ServeHTTP(rec, r.WithContext(ctx))
+
+			if rec.Code != test.status {
+				t.Fatalf("have: %d want: %d", rec.Code, test.status)
+			}
+			if test.want == nil {
+				return
+			}
+
+			var body struct{ Token string }
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+
+			claims := jwtgo.MapClaims{}
+			_, err := jwtgo.ParseWithClaims(body.Token, claims, func(*jwtgo.Token) (interface{}, error) { return secret, nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(claims, test.want) {
+				t.Errorf("have: %v want: %v", claims, test.want)
+			}
+		})
+	}
+}
+
+func TestJWTEdDSA(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	cfgJWT := &configJWT{Name: "ed", Alg: "EdDSA", Key: attr(string(keyPEM))}
+	key := useJWT(ConfigHTTP{Name: "test", JWT: cfgJWT})
+	if _, ok := key.(ed25519.PrivateKey); !ok {
+		t.Fatalf("have: %T want: ed25519.PrivateKey", key)
+	}
+
+	respJWT := &responseJWT{Name: "ed", Subject: attr("sub 1"), Payload: map[string]string{}}
+	token, err := marshalJWT(cfgJWT, respJWT, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if respJWT.Payload["$._internal.ed.key"] != string(keyPEM) {
+		t.Errorf("have: %q want: %q", respJWT.Payload["$._internal.ed.key"], keyPEM)
+	}
+
+	claims := jwtgo.MapClaims{}
+	tkn, err := jwtgo.ParseWithClaims(token, claims, func(*jwtgo.Token) (interface{}, error) { return pub, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := tkn.Header["alg"]; have != "EdDSA" {
+		t.Errorf("have: %v want: %v", have, "EdDSA")
+	}
+	if have := claims["sub"]; have != "sub 1" {
+		t.Errorf("have: %v want: %v", have, "sub 1")
+	}
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	if _, err := jwtgo.Parse(token, func(*jwtgo.Token) (interface{}, error) { return other, nil }); err == nil {
+		t.Error("expected an invalid signature with the wrong key")
+	}
+}
+
+func TestJWTResponse(t *testing.T) {
+
+	var stdResJWT = responseJWT{
+		Name:    "test-1",
+		Subject: attr("sub 1"),
+		Payload: map[string]string{
+			"$._internal.test-1.key": "Password/Secret",
+		},
+	}
+	var stdCfgJWT = configJWT{
+		Name:   "test-1",
+		Secret: attr("Password/Secret"),
+		Alg:    jwtgo.SigningMethodHS256.Name,
+	}
+
+	token := jwtgo.NewWithClaims(jwtgo.SigningMethodHS256, &stdResJWT)
+	token.Header["kid"] = jwtKeyID(&stdCfgJWT, []byte("Password/Secret"))
+	tokenStr, err := token.SignedString([]byte("Password/Secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type wanted struct {
+		body    *string
+		header  map[string][]string
+		cookies map[string]*http.Cookie
+	}
+
+	var tests = []struct {
+		name   string
+		method string
+		jwtC   configJWT
+		jwtR   responseJWT
+		req    RequestHTTP
+		reqOut string
+		reqKey string
+		want   wanted
+	}{
+		{
+			name:   "auth",
+			method: "get",
+			jwtC:   stdCfgJWT,
+			jwtR:   stdResJWT,
+			reqOut: "body",
+			req:    RequestHTTP{},
+			want: wanted{
+				body: func() *string {
+					return &tokenStr
+				}(),
+			},
+		},
+		{
+			name:   "auth",
+			method: "get",
+			jwtC:   stdCfgJWT,
+			jwtR:   stdResJWT,
+			reqOut: "header",
+			reqKey: "x-jwt-test-header",
+			req:    RequestHTTP{},
+			want: wanted{
+				header: func() map[string][]string {
+					return map[string][]string{
+						"x-jwt-test-header": {tokenStr},
+					}
+				}(),
+			},
+		},
+		{
+			name:   "auth",
+			method: "get",
+			jwtC:   stdCfgJWT,
+			jwtR:   stdResJWT,
+			reqOut: "cookie",
+			reqKey: "cookie_jwt_test",
+			req:    RequestHTTP{},
+			want: wanted{
+				cookies: func() map[string]*http.Cookie {
+					c := http.Cookie{}
+					c.Name = "cookie_jwt_test"
+					c.Value = tokenStr
+					c.Raw = fmt.Sprintf("%s=%s", "cookie_jwt_test", tokenStr)
 					return map[string]*http.Cookie{"cookie_jwt_test": &c}
 				}(),
 			},
@@ -1337,3 +4031,541 @@ func TestProxyHandler(t *testing.T) {
 	}
 
 }
+
+func TestProxyRewriteRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d %s", r.ContentLength, b)
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name    string
+		rewrite *hcl.Attribute
+		body    string
+		want    string
+	}{
+		{name: "no rewrite", body: `{"a":1}`, want: `7 {"a":1}`},
+		{name: "template", rewrite: attr(`{"original":${request.body},"added":true}`), body: `{"a":1}`, want: `33 {"original":{"a":1},"added":true}`},
+		{name: "expression", rewrite: attrE(`{ original = request.body }`), body: `{"a":1}`, want: `24 {"original":"{\"a\":1}"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := configProxy{Name: "upstream", RewriteRequest: test.rewrite, _url: u}
+			req := RequestHTTP{Method: "post", Response: []ResponseHTTP{{Status: "upstream"}}}
+
+			r := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(test.body))
+			r.Header.Set("Content-Type", "application/json")
+			ctx := context.WithValue(r.Context(), ctxKey(proxy.Name), &proxy)
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+			hdl.ServeHTTP(rec, r.WithContext(ctx))
+
+			if have := rec.Body.String(); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestProxyRewriteRequestConcurrent(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := configProxy{Name: "upstream", RewriteRequest: attr(`{"id":"${query.id}"}`), _url: u}
+	req := RequestHTTP{Method: "post", Response: []ResponseHTTP{{Status: "upstream"}}}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	// the requests share the parsed rewrite template, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/test?id=%d", i), strings.NewReader(`{}`))
+			ctx := context.WithValue(r.Context(), ctxKey(proxy.Name), &proxy)
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r.WithContext(ctx))
+
+			if have, want := rec.Body.String(), fmt.Sprintf(`{"id":"%d"}`, i); have != want {
+				t.Errorf("have: %q want: %q", have, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestProxyTimeoutRetries(t *testing.T) {
+	var tests = []struct {
+		name    string
+		method  string
+		key     string // the Idempotency-Key header
+		hang    int32  // the number of upstream tries that hang
+		retries int
+		status  int
+		tries   int32
+	}{
+		{name: "no retries", method: http.MethodPut, hang: 1, retries: 0, status: http.StatusBadGateway, tries: 1},
+		{name: "retried", method: http.MethodPut, hang: 2, retries: 2, status: http.StatusOK, tries: 3},
+		{name: "gives up", method: http.MethodPut, hang: 5, retries: 1, status: http.StatusBadGateway, tries: 2},
+		{name: "post not retried", method: http.MethodPost, hang: 1, retries: 2, status: http.StatusBadGateway, tries: 1},
+		{name: "post with key retried", method: http.MethodPost, key: "a", hang: 1, retries: 2, status: http.StatusOK, tries: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var tries int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				if atomic.AddInt32(&tries, 1) <= test.hang {
+					time.Sleep(200 * time.Millisecond)
+					return
+				}
+				fmt.Fprintf(w, "upstream %s", b)
+			}))
+			defer upstream.Close()
+
+			u, err := url.Parse(upstream.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			timeout := "50ms"
+			proxy := configProxy{Name: "upstream", Timeout: &timeout, Retries: &test.retries, _url: u}
+			req := RequestHTTP{Method: test.method, Response: []ResponseHTTP{{Status: "upstream"}}}
+
+			r := httptest.NewRequest(test.method, "/test", strings.NewReader("body"))
+			if test.key != "" {
+				r.Header.Set("Idempotency-Key", test.key)
+			}
+			ctx := context.WithValue(r.Context(), ctxKey(proxy.Name), &proxy)
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+			hdl.ServeHTTP(rec, r.WithContext(ctx))
+
+			if rec.Code != test.status {
+				t.Errorf("have: %d want: %d", rec.Code, test.status)
+			}
+			if have := atomic.LoadInt32(&tries); have != test.tries {
+				t.Errorf("have: %d tries want: %d", have, test.tries)
+			}
+			if have := rec.Body.String(); test.status == http.StatusOK && have != "upstream body" {
+				t.Errorf("have: %q want: %q", have, "upstream body")
+			}
+		})
+	}
+}
+
+func TestProxyRetriesBodyLimit(t *testing.T) {
+	var tries int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tries, 1)
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retries := 1
+	proxy := configProxy{Name: "upstream", Retries: &retries, _url: u}
+	defer closeProxyTransports()
+
+	r := httptest.NewRequest(http.MethodPut, "/test", strings.NewReader("a body over the limit"))
+	ctx := context.WithValue(r.Context(), CtxKeyMaxBodyBytes, int64(4))
+
+	rec := httptest.NewRecorder()
+	useProxy(rec, r.WithContext(ctx), &proxy, nil, nil)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("have: %d want: %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if have := atomic.LoadInt32(&tries); have != 0 {
+		t.Errorf("have: %d tries want: %d", have, 0)
+	}
+}
+
+func TestCloseProxyTransports(t *testing.T) {
+	retries := 1
+	proxy := &configProxy{Name: "upstream", Retries: &retries}
+	rt := proxyTransportFor(proxy)
+	if have := proxyTransportFor(proxy); have != rt {
+		t.Errorf("have: a new transport want: the saved transport")
+	}
+
+	closeProxyTransports()
+
+	var n int
+	proxyTransports.Range(func(_, _ interface{}) bool { n++; return true })
+	if n != 0 {
+		t.Errorf("have: %d transports want: %d", n, 0)
+	}
+}
+
+func TestProxyPathRewrite(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.RequestURI())
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prefix, other = "/api/v1", "/api"
+	var tests = []struct {
+		name  string
+		proxy configProxy
+		route *routeProxy
+		path  string
+		want  string
+	}{
+		{name: "unchanged", path: "/api/v1/users?id=1", want: "/api/v1/users?id=1"},
+		{name: "strip prefix", proxy: configProxy{StripPrefix: &prefix}, path: "/api/v1/users?id=1", want: "/users?id=1"},
+		{name: "strip to root", proxy: configProxy{StripPrefix: &prefix}, path: "/api/v1", want: "/"},
+		{name: "rewrite", proxy: configProxy{StripPrefix: &prefix, Rewrite: attr("/v2${url.path}")}, path: "/api/v1/users", want: "/v2/users"},
+		{name: "rewrite variables", proxy: configProxy{Rewrite: attr("/v2/${query.kind}/${url.id}")}, path: "/api/v1/users?kind=admin", want: "/v2/admin/users?kind=admin"},
+		{name: "route options", proxy: configProxy{StripPrefix: &prefix}, route: &routeProxy{Name: "upstream", StripPrefix: &other}, path: "/api/v1/users", want: "/v1/users"},
+		{name: "route rewrite", proxy: configProxy{StripPrefix: &prefix}, route: &routeProxy{Name: "upstream", Rewrite: attr("/v3${url.path}")}, path: "/api/v1/users", want: "/v3/users"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := test.proxy
+			proxy.Name, proxy._url = "upstream", u
+			req := RequestHTTP{Method: "get", Response: []ResponseHTTP{{Status: "upstream"}}}
+
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			ctx := context.WithValue(r.Context(), ctxKey(proxy.Name), &proxy)
+			if test.route != nil {
+				ctx = context.WithValue(ctx, CtxKeyRouteProxy, test.route)
+			}
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/api/v1", httpHandler(req, []TextBlock{}))
+			hdl.Method(req.Method, "/api/v1/{id}", httpHandler(req, []TextBlock{}))
+			hdl.ServeHTTP(rec, r.WithContext(ctx))
+
+			if have := rec.Body.String(); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestProxyPathRewriteConcurrent(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := configProxy{Name: "upstream", Rewrite: attr("/v2/${query.kind}"), _url: u}
+	req := RequestHTTP{Method: "get", Response: []ResponseHTTP{{Status: "upstream"}}}
+
+	hdl := chi.NewRouter()
+	hdl.Method(req.Method, "/api/v1", httpHandler(req, []TextBlock{}))
+
+	// the requests share the parsed rewrite template, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/v1?kind=k%d", i), nil)
+			ctx := context.WithValue(r.Context(), ctxKey(proxy.Name), &proxy)
+
+			rec := httptest.NewRecorder()
+			hdl.ServeHTTP(rec, r.WithContext(ctx))
+
+			if have, want := rec.Body.String(), fmt.Sprintf("/v2/k%d", i); have != want {
+				t.Errorf("have: %q want: %q", have, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestProxyCorrelationID(t *testing.T) {
+	var upstreamID string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get("X-Correlation-ID")
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	defer func(l logger.Logger) { log = l }(log)
+	log = logger.New(logger.WithOutput(&buf))
+
+	var tests = []struct {
+		name string
+		id   string
+	}{
+		{name: "created", id: ""},
+		{name: "passed along", id: "abc-123"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf.Reset()
+			header := "X-Correlation-ID"
+			proxy := configProxy{Name: "upstream", CorrelationHeader: &header, _url: u}
+			req := RequestHTTP{Method: "get", Response: []ResponseHTTP{{Status: "upstream"}}}
+
+			r := httptest.NewRequest(http.MethodGet, "/test", nil)
+			if test.id != "" {
+				r.Header.Set(header, test.id)
+			}
+			ctx := context.WithValue(r.Context(), ctxKey(proxy.Name), &proxy)
+
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+			hdl.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+
+			if upstreamID == "" || (test.id != "" && upstreamID != test.id) {
+				t.Fatalf("have: %q want: %q", upstreamID, test.id)
+			}
+			for _, want := range []string{"[" + upstreamID + "] inbound GET /test", "[" + upstreamID + "] proxied GET " + upstream.URL + "/test"} {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("have: %q want: %q", buf.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyRecordReplay(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Upstream", "yes")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "upstream %s", b)
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "proxy_record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(path string) { _runtimePath = path }(_runtimePath)
+	_runtimePath = dir
+
+	var fixtures = "recordings"
+	var tests = []struct {
+		name   string
+		mode   string
+		body   string
+		status int
+		want   string
+		hits   int32
+	}{
+		{name: "record", mode: ProxyModeRecord, body: "a", status: http.StatusCreated, want: "upstream a", hits: 1},
+		{name: "replay", mode: ProxyModeReplay, body: "a", status: http.StatusCreated, want: "upstream a", hits: 1},
+		{name: "replay not recorded", mode: ProxyModeReplay, body: "b", status: http.StatusBadGateway, hits: 1},
+		{name: "passthrough", mode: ProxyModePassthrough, body: "b", status: http.StatusCreated, want: "upstream b", hits: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := configProxy{Name: "upstream", Mode: test.mode, FixturesDir: &fixtures, _url: u}
+			req := RequestHTTP{Method: "post", Response: []ResponseHTTP{{Status: "upstream"}}}
+
+			r := httptest.NewRequest(http.MethodPost, "/test?q=1", strings.NewReader(test.body))
+			ctx := context.WithValue(r.Context(), ctxKey(proxy.Name), &proxy)
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+			hdl.ServeHTTP(rec, r.WithContext(ctx))
+
+			if rec.Code != test.status {
+				t.Fatalf("have: %d want: %d", rec.Code, test.status)
+			}
+			if have := atomic.LoadInt32(&hits); have != test.hits {
+				t.Errorf("have: %d upstream hits want: %d", have, test.hits)
+			}
+			if test.want == "" {
+				return
+			}
+			if have := rec.Body.String(); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+			if have := rec.Header().Get("X-Upstream"); have != "yes" {
+				t.Errorf("have: %q want: %q", have, "yes")
+			}
+		})
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, fixtures, "POST_*.rec"))
+	if len(files) != 1 {
+		t.Errorf("have: %d recordings want: %d", len(files), 1)
+	}
+}
+
+func TestProxyRecordingFileBodyLimit(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader("a body over the limit"))
+	r = r.WithContext(context.WithValue(r.Context(), CtxKeyMaxBodyBytes, int64(4)))
+
+	_, err := proxyRecordingFile(r, &configProxy{Name: "upstream", Mode: ProxyModeRecord})
+	if _, ok := err.(Ext413Error); !ok {
+		t.Errorf("have: %v want: %T", err, Ext413Error{})
+	}
+}
+
+func TestProxyContractEncoded(t *testing.T) {
+	var gz, zl bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(`{"name":"a"}`))
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write([]byte(`{"name":"a"}`))
+	zw.Close()
+
+	var tests = []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     []string
+	}{
+		{name: "gzip", encoding: "gzip", body: gz.Bytes(), want: []string{`the body is missing the "id" field`}},
+		{name: "deflate", encoding: "deflate", body: zl.Bytes(), want: []string{`the body is missing the "id" field`}},
+		{name: "bad gzip", encoding: "gzip", body: []byte(`{"id":1}`), want: []string{`the "gzip" encoded body can't be decoded`}},
+		{name: "unknown encoding", encoding: "br", body: []byte{0x1b, 0x02}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Encoding": {test.encoding}},
+				Body:       ioutil.NopCloser(bytes.NewReader(test.body)),
+			}
+
+			have, err := contractViolations(res, &proxyExpect{Required: []string{"id"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(have, test.want) {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+
+			body, _ := ioutil.ReadAll(res.Body)
+			if !bytes.Equal(body, test.body) {
+				t.Errorf("have: %q want: %q", body, test.body) // the client gets the encoded body
+			}
+		})
+	}
+}
+
+func TestProxyContract(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprint(w, r.URL.Query().Get("body"))
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	defer func(l logger.Logger) { log = l }(log)
+	log = logger.New(logger.WithOutput(&buf))
+
+	contentType := "application/json"
+	var tests = []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{name: "matches", query: `status=200&body={"id":1}`},
+		{name: "unexpected status", query: `status=500&body={"id":1}`, want: "status 500 is not one of [200 201]"},
+		{name: "missing field", query: `status=201&body={"name":"a"}`, want: `the body is missing the "id" field`},
+		{name: "not an object", query: `status=200&body=[1]`, want: "the body is not a JSON object"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf.Reset()
+			var violations []error
+			proxy := configProxy{
+				Name:       "upstream",
+				Mode:       ProxyModeContract,
+				Expect:     &proxyExpect{Status: []int{200, 201}, ContentType: &contentType, Required: []string{"id"}},
+				_url:       u,
+				_violation: func(err error) { violations = append(violations, err) },
+			}
+			req := RequestHTTP{Method: "get", Response: []ResponseHTTP{{Status: "upstream"}}}
+
+			r := httptest.NewRequest(http.MethodGet, "/test?"+test.query, nil)
+			ctx := context.WithValue(r.Context(), ctxKey(proxy.Name), &proxy)
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+			hdl.ServeHTTP(rec, r.WithContext(ctx))
+
+			if have := rec.Body.String(); have != r.URL.Query().Get("body") {
+				t.Errorf("have: %q want: %q", have, r.URL.Query().Get("body"))
+			}
+
+			if test.want == "" {
+				if len(violations) != 0 || strings.Contains(buf.String(), "[contract]") {
+					t.Errorf("have: %v want: no violations", violations)
+				}
+				return
+			}
+			if len(violations) != 1 || !strings.Contains(violations[0].Error(), test.want) {
+				t.Fatalf("have: %v want: %q", violations, test.want)
+			}
+			if want := "[http] [proxy] [contract] " + violations[0].Error(); !strings.Contains(buf.String(), want) {
+				t.Errorf("have: %q want: %q", buf.String(), want)
+			}
+		})
+	}
+}
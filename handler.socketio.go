@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -34,7 +35,12 @@ func init() {
 	plugins[socketioPluginName] = new(socketioPlugin)
 }
 
+// socketioPlugin is plugin related data, the maps are written during
+// setup (and reloads) while they are read during requests so they
+// are guarded by the lock
 type socketioPlugin struct {
+	sync.RWMutex
+
 	conn   map[string]*sktio.Server
 	config map[string]socketioConfig
 }
@@ -77,6 +83,9 @@ var convertToJSON = func(body hcl.Body) map[string]interface{} {
 func (p *socketioPlugin) Setup() error {
 	log.Println("[socketio] setup plugin ...")
 
+	p.Lock()
+	defer p.Unlock()
+
 	p.conn = make(map[string]*sktio.Server)
 	p.config = make(map[string]socketioConfig)
 
@@ -120,15 +129,47 @@ func (p *socketioPlugin) SetupConfig(svrName string, svrPlugins hcl.Body) error
 			if len(block.Labels) > 0 {
 				sioc.Name = block.Labels[0] // the same index as the LabelNames above...
 			}
+			p.Lock()
 			p.config[svrName] = sioc
+			p.Unlock()
 		}
 	}
 
-	p.conn[svrName] = sktio.NewServer(transport.GetDefaultWebsocketTransport())
+	svr := sktio.NewServer(transport.GetDefaultWebsocketTransport())
+
+	p.Lock()
+	p.conn[svrName] = svr
+	p.Unlock()
 
 	return nil
 }
 
+// server returns the named socket.io server
+func (p *socketioPlugin) server(name string) (*sktio.Server, bool) {
+	p.RLock()
+	defer p.RUnlock()
+
+	svr, ok := p.conn[name]
+	return svr, ok
+}
+
+// broadcast sends the data to everyone in the room of the named
+// socket.io server, or to everyone when the room is empty. This
+// is the fan-out used by both events and HTTP requests.
+func (p *socketioPlugin) broadcast(name, room, event string, data interface{}) {
+	svr, ok := p.server(name)
+	if !ok {
+		log.Printf("[socketio] server %q not found ...", name)
+		return
+	}
+
+	if room == "" {
+		svr.BroadcastToAll(event, data)
+		return
+	}
+	svr.BroadcastTo(room, event, data)
+}
+
 func (p *socketioPlugin) SetupRoot(configPlugins hcl.Body) error {
 	cfgb, _, _ := configPlugins.PartialContent(&hcl.BodySchema{
 		Blocks: []hcl.BlockHeaderSchema{
@@ -157,7 +198,13 @@ func (p *socketioPlugin) SetupRoot(configPlugins hcl.Body) error {
 func (p *socketioPlugin) Subscribe(sio socketio) {
 	log.Printf("[socketio] subcribe to event %q ...", sio.Event)
 
-	p.conn[sio.Name].On(sio.Event, func(channel *sktio.Channel, args interface{}) {
+	svr, ok := p.server(sio.Name)
+	if !ok {
+		log.Printf("[socketio] server %q not found ...", sio.Name)
+		return
+	}
+
+	svr.On(sio.Event, func(channel *sktio.Channel, args interface{}) {
 
 		for _, emit := range sio.Emit {
 			log.Println("[socketio] emit ...")
@@ -166,12 +213,12 @@ func (p *socketioPlugin) Subscribe(sio socketio) {
 
 		for _, broadcast := range sio.Broadcast {
 			log.Println("[socketio] broadcast ...")
-			p.conn[sio.Name].BroadcastTo(broadcast.Room, broadcast.Event, convertToJSON(broadcast.Args))
+			p.broadcast(sio.Name, broadcast.Room, broadcast.Event, convertToJSON(broadcast.Args))
 		}
 
 		for _, broadcast := range sio.BroadcastAll {
 			log.Println("[socketio] broadcast all ...")
-			p.conn[sio.Name].BroadcastToAll(broadcast.Event, convertToJSON(broadcast.Args))
+			p.broadcast(sio.Name, "", broadcast.Event, convertToJSON(broadcast.Args))
 		}
 	})
 }
@@ -242,7 +289,7 @@ func (p *socketioPlugin) MiddlewareHTTP(r Route, plugins hcl.Body, req requ.HTTP
 						data := convertToJSON(broadcast.Args)
 						if data != nil {
 							log.Println("[socketio] http broadcast ...")
-							p.conn[resp.Name].BroadcastTo(broadcast.Room, broadcast.Event, data)
+							p.broadcast(resp.Name, broadcast.Room, broadcast.Event, data)
 						}
 					}
 
@@ -250,7 +297,7 @@ func (p *socketioPlugin) MiddlewareHTTP(r Route, plugins hcl.Body, req requ.HTTP
 						data := convertToJSON(broadcast.Args)
 						if data != nil {
 							log.Println("[socketio] http broadcast all ...")
-							p.conn[resp.Name].BroadcastToAll(broadcast.Event, data)
+							p.broadcast(resp.Name, "", broadcast.Event, data)
 						}
 					}
 
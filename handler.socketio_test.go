@@ -0,0 +1,80 @@
+// +build plugin_socketio
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+func testSocketIOBody(t testing.TB, name string) hcl.Body {
+	src := fmt.Sprintf(`socketio %q {}`, name)
+	file, dia := hclsyntax.ParseConfig([]byte(src), "test.hcl", hcl.Pos{Line: 1, Column: 1})
+	if dia.HasErrors() {
+		t.Fatal(dia)
+	}
+	return file.Body
+}
+
+// TestSocketIOConcurrentSetup should be run with -race, it broadcasts
+// while new server configs are added
+func TestSocketIOConcurrentSetup(t *testing.T) {
+	p := new(socketioPlugin)
+	p.Setup()
+
+	if err := p.SetupConfig("svr0", testSocketIOBody(t, "svr0")); err != nil {
+		t.Fatal(err)
+	}
+
+	var bodies = make([]hcl.Body, 50)
+	for i := range bodies {
+		bodies[i] = testSocketIOBody(t, fmt.Sprintf("svr%d", i+1))
+	}
+
+	var wg sync.WaitGroup
+	for i, body := range bodies {
+		wg.Add(2)
+		go func(name string, body hcl.Body) {
+			defer wg.Done()
+			if err := p.SetupConfig(name, body); err != nil {
+				t.Error(err)
+			}
+		}(fmt.Sprintf("svr%d", i+1), body)
+		go func(i int) {
+			defer wg.Done()
+			p.broadcast("svr0", "", "tick", map[string]interface{}{"i": i})
+			p.broadcast("svr0", "room", "tick", map[string]interface{}{"i": i})
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i <= len(bodies); i++ {
+		if _, ok := p.server(fmt.Sprintf("svr%d", i)); !ok {
+			t.Errorf("missing server: svr%d", i)
+		}
+	}
+}
+
+// BenchmarkSocketIOBroadcast is the fan-out hook for scale testing
+// lots of concurrent broadcasts against a single server
+func BenchmarkSocketIOBroadcast(b *testing.B) {
+	p := new(socketioPlugin)
+	p.Setup()
+
+	if err := p.SetupConfig("bench", testSocketIOBody(b, "bench")); err != nil {
+		b.Fatal(err)
+	}
+
+	var data = map[string]interface{}{"hello": "world"}
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p.broadcast("bench", "", "bench", data)
+		}
+	})
+}
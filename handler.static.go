@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/go-chi/chi"
+	"github.com/spf13/afero"
+)
+
+// staticHandler serves the files in the static directory, the
+// path is taken from the wildcard so that it works the same
+// when the routes are mounted under a base path
+func staticHandler(fs afero.Fs, static *routeStatic) http.HandlerFunc {
+	var dir http.FileSystem = afero.NewHttpFs(fs).Dir(static.Dir)
+	if static.DisableListing {
+		dir = noListingFS{dir}
+	}
+	files := http.FileServer(dir)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/" + chi.URLParam(r, "*")
+		r2.URL.RawPath = ""
+
+		files.ServeHTTP(w, r2)
+	}
+}
+
+// noListingFS is a file system that does not list directories,
+// a directory can only be opened if it has an index.html file
+type noListingFS struct{ http.FileSystem }
+
+func (fs noListingFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if info.IsDir() {
+		index, err := fs.FileSystem.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+
+	return f, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/spf13/afero"
+)
+
+func TestStaticDirectory(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "public/app.js", []byte("console.log('app')"), 0644)
+	afero.WriteFile(fs, "public/css/site.css", []byte("body{}"), 0644)
+	afero.WriteFile(fs, "public/docs/index.html", []byte("<h1>docs</h1>"), 0644)
+
+	var tests = []struct {
+		name    string
+		listing bool
+		path    string
+		status  int
+		want    string
+	}{
+		{name: "file", path: "/assets/app.js", status: http.StatusOK, want: "console.log('app')"},
+		{name: "nested file", path: "/assets/css/site.css", status: http.StatusOK, want: "body{}"},
+		{name: "missing file", path: "/assets/nope.js", status: http.StatusNotFound},
+		{name: "directory listing", listing: true, path: "/assets/css/", status: http.StatusOK, want: "site.css"},
+		{name: "directory listing disabled", path: "/assets/css/", status: http.StatusNotFound},
+		{name: "directory index", path: "/assets/docs/", status: http.StatusOK, want: "<h1>docs</h1>"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ro := chi.NewRouter()
+			ro.Get("/assets/*", staticHandler(fs, &routeStatic{Dir: "public", DisableListing: !test.listing}))
+
+			r := chi.NewRouter()
+			r.Mount("/api", ro) // the static files still work under a base path
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api"+test.path, nil))
+
+			if w.Code != test.status {
+				t.Fatalf("have: %d want: %d", w.Code, test.status)
+			}
+			if b, _ := ioutil.ReadAll(w.Body); !strings.Contains(string(b), test.want) {
+				t.Errorf("have: %q want: %q", b, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+// +build plugin_webhook
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	requ "plugins/request"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// webhookPluginName is the webhook plugin resgistered
+// name that will be used in loging and plugin requests
+const webhookPluginName = "webhook"
+
+// defaults for webhook requests
+var (
+	DefaultWebhookSignatureHeader = "X-Signature-256"
+	DefaultWebhookRetries         = 3
+	DefaultWebhookRetryWait       = "1s"
+)
+
+// init registers the built-in plugin to the global registery
+func init() {
+	log.Println("[init] loading the webhook plugin ...")
+	plugins[webhookPluginName] = new(webhookPlugin)
+}
+
+// webhookPlugin is plugin related data
+type webhookPlugin struct {
+	client *http.Client
+}
+
+// webhook stores the outbound webhook configuration
+// that can come from a request block
+type webhook struct {
+	Name string `hcl:"name,label"`
+	Desc string `hcl:"_-,optional"`
+
+	URL       string         `hcl:"url"`
+	Secret    *hcl.Attribute `hcl:"secret"`
+	Header    *string        `hcl:"signature_header"`
+	Retries   *int           `hcl:"retries"`
+	RetryWait *string        `hcl:"retry_wait"`
+	Data      *hcl.Attribute `hcl:"data"`
+}
+
+// Setup is a plugin construct for the inital
+// setup of a plugin
+func (p *webhookPlugin) Setup() error {
+	log.Println("[webhook] setup plugin ...")
+	p.client = &http.Client{Timeout: 10 * time.Second}
+	return nil
+}
+
+// Version takes in the max version and returns the version
+// that this module supports
+func (p *webhookPlugin) Version(int32) int32 { return 1 }
+
+// Metadata returns the metadata of the plugin
+func (p *webhookPlugin) Metadata() string {
+	return `
+metadata {
+	version   = "0.1.0"
+	author    = "Nika Jones"
+	copyright = "Nika Jones - © 2021"
+}
+`
+}
+
+// SetupConfig is a plugin construct for collecting service
+// configuration information. Webhooks are only configured
+// within a request block.
+func (p *webhookPlugin) SetupConfig(string, hcl.Body) error { return nil }
+
+// SetupRoot is a plugin construct for collecting information
+// from the root configuration. Webhooks are only configured
+// within a request block.
+func (p *webhookPlugin) SetupRoot(hcl.Body) error { return nil }
+
+// PostMiddlewareHTTP is a plugin concept that will add the proper middleware to fire a webhook when
+// a HTTP request is received. This is passed in all of the blocks, that can be used during setup
+// then return a http.Handler that can be used during the request call.
+func (p *webhookPlugin) PostMiddlewareHTTP(path string, plugins hcl.Body, req requ.HTTP) (MiddlewareHTTP, bool) {
+	reqb, _, _ := plugins.PartialContent(&hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type:       webhookPluginName,
+				LabelNames: []string{"name"},
+			},
+		},
+	})
+
+	if len(reqb.Blocks) == 0 {
+		return nil, false
+	}
+
+	var reqWebhook []webhook
+	for _, block := range reqb.Blocks {
+		var wh webhook
+		switch block.Type {
+		case webhookPluginName:
+			gohcl.DecodeBody(block.Body, nil, &wh)
+			if len(block.Labels) > 0 {
+				wh.Name = block.Labels[0]
+			}
+			reqWebhook = append(reqWebhook, wh)
+		}
+	}
+
+	if len(reqWebhook) == 0 {
+		return nil, false
+	}
+
+	var idx = int64(-1)
+	var resps = reqWebhook
+	if req.Order == "unordered" {
+		rand.Seed(time.Now().UnixNano()) // doesn't have to be crypto-quality random here...
+	}
+	log.Printf("[webhook] %s http webhook added ...", path)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() { next.ServeHTTP(w, r) }()
+
+			var x int64
+			switch req.Order {
+			case "random":
+				x = rand.Int63n(int64(len(resps) * 2))
+			case "unordered":
+				x = atomic.AddInt64(&idx, 1)
+				if int(x)%len(resps) == 0 {
+					rand.Shuffle(len(resps), func(i, j int) { resps[i], resps[j] = resps[j], resps[i] })
+				}
+			default:
+				x = atomic.AddInt64(&idx, 1)
+			}
+
+			resp := resps[int(x)%len(resps)]
+
+			// the data is templated with the request variables before the
+			// request is finished, the webhook is sent later
+			vars, err := requestVars(r)
+			if log.OnErr(err).Printf("[webhook] %s failed to get the request variables: %v", resp.Name, err).HasErr() {
+				return
+			}
+			go p.fire(resp, req.Delay, &hcl.EvalContext{Variables: vars, Functions: bodyEvalCtx.Functions})
+		})
+	}, true
+}
+
+// fire sends the webhook body to the configured URL, signing the body
+// with the secret when there is one. Failed sends are retried until the
+// number of retries has been used up. A data value that isn't a string
+// is sent as JSON.
+func (p *webhookPlugin) fire(wh webhook, wait string, ctx *hcl.EvalContext) {
+	if len(wait) > 0 {
+		time.Sleep(delay(wait))
+	}
+
+	var body []byte
+	if wh.Data != nil {
+		if tmpl, ok := wh.Data.Expr.(*hclsyntax.TemplateExpr); ok {
+			templateIndexes(tmpl)
+		}
+
+		dataVal, dia := wh.Data.Expr.Value(ctx)
+		if dia.HasErrors() {
+			for _, err := range dia.Errs() {
+				log.Printf("[webhook] http failed to fire: %v", err)
+			}
+			return
+		}
+
+		switch {
+		case dataVal.IsNull():
+		case dataVal.Type() == cty.String:
+			body = []byte(dataVal.AsString())
+		default:
+			b, err := json.Marshal(ctyjson.SimpleJSONValue{Value: dataVal})
+			if log.OnErr(err).Printf("[webhook] %s failed to marshal the data: %v", wh.Name, err).HasErr() {
+				return
+			}
+			body = b
+		}
+	}
+
+	var signature string
+	if wh.Secret != nil {
+		secret, dia := wh.Secret.Expr.Value(&fileEvalCtx)
+		if dia.HasErrors() {
+			for _, err := range dia.Errs() {
+				log.Printf("[webhook] http failed to get secret: %v", err)
+			}
+			return
+		}
+		if secret.IsNull() || secret.Type() != cty.String {
+			log.Printf("[webhook] %s failed to get secret: the secret is not a string", wh.Name)
+			return
+		}
+		signature = webhookSignature([]byte(secret.AsString()), body)
+	}
+
+	header, retries, retryWait := DefaultWebhookSignatureHeader, DefaultWebhookRetries, DefaultWebhookRetryWait
+	if wh.Header != nil {
+		header = *wh.Header
+	}
+	if wh.Retries != nil {
+		retries = *wh.Retries
+	}
+	if wh.RetryWait != nil {
+		retryWait = *wh.RetryWait
+	}
+
+	for i := 0; i <= retries; i++ {
+		if i > 0 {
+			log.Printf("[webhook] retry %d of %d for %s ...", i, retries, wh.Name)
+			time.Sleep(delay(retryWait))
+		}
+
+		err := p.send(wh.URL, header, signature, body)
+		if log.OnErr(err).Printf("[webhook] %s failed: %v", wh.Name, err).HasErr() {
+			continue
+		}
+		log.Printf("[webhook] %s sent to %s ...", wh.Name, wh.URL)
+		return
+	}
+}
+
+// send POSTs a single webhook request, any response that is
+// not a 2xx status is returned as an error so it can be retried
+func (p *webhookPlugin) send(url, header, signature string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return ErrWebhookSend.F(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if signature != "" {
+		req.Header.Set(header, signature)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return ErrWebhookSend.F(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return ErrWebhookSend.F(fmt.Errorf("status %d", res.StatusCode))
+	}
+	return nil
+}
+
+// webhookSignature returns the HMAC SHA256 signature of the body
+// formatted the same as most webhook providers: sha256=<hex>
+func webhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
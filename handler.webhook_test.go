@@ -0,0 +1,151 @@
+// +build plugin_webhook
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	requ "plugins/request"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+func TestWebhookFire(t *testing.T) {
+	type received struct {
+		signature string
+		body      string
+	}
+
+	var tests = []struct {
+		name     string
+		src      string
+		url      string
+		failures int
+		want     received
+	}{
+		{
+			name: "signed",
+			src: `
+webhook "callback" {
+	url = "%s"
+	secret = "the secret string"
+	data = "{\"status\":\"done\"}"
+}`,
+			want: received{
+				signature: webhookSignature([]byte("the secret string"), []byte(`{"status":"done"}`)),
+				body:      `{"status":"done"}`,
+			},
+		},
+		{
+			name: "retry",
+			src: `
+webhook "callback" {
+	url = "%s"
+	secret = "the secret string"
+	retry_wait = "1ms"
+	data = "{\"status\":\"retried\"}"
+}`,
+			failures: 2,
+			want: received{
+				signature: webhookSignature([]byte("the secret string"), []byte(`{"status":"retried"}`)),
+				body:      `{"status":"retried"}`,
+			},
+		},
+		{
+			name: "object data",
+			src: `
+webhook "callback" {
+	url = "%s"
+	data = { status = "done", count = 2 }
+}`,
+			want: received{body: `{"count":2,"status":"done"}`},
+		},
+		{
+			name: "null data",
+			src: `
+webhook "callback" {
+	url = "%s"
+	data = null
+}`,
+			want: received{body: ""},
+		},
+		{
+			name: "request variables",
+			src: `
+webhook "callback" {
+	url = "%s"
+	secret = "the secret string"
+	data = "{\"id\":\"${query.id}\"}"
+}`,
+			url: "/test?id=42",
+			want: received{
+				signature: webhookSignature([]byte("the secret string"), []byte(`{"id":"42"}`)),
+				body:      `{"id":"42"}`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got = make(chan received, 1)
+			var failures = test.failures
+
+			rcv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if failures > 0 {
+					failures--
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				b, _ := ioutil.ReadAll(r.Body)
+				got <- received{signature: r.Header.Get(DefaultWebhookSignatureHeader), body: string(b)}
+			}))
+			defer rcv.Close()
+
+			src := []byte(strings.Replace(test.src, "%s", rcv.URL, 1))
+			file, dia := hclsyntax.ParseConfig(src, "test.hcl", hcl.Pos{Line: 1, Column: 1})
+			if dia.HasErrors() {
+				t.Fatal(dia)
+			}
+
+			p := new(webhookPlugin)
+			p.Setup()
+
+			mw, ok := p.PostMiddlewareHTTP("/test", file.Body, requ.HTTP{Method: "post"})
+			if !ok {
+				t.Fatal("no webhook middleware returned")
+			}
+
+			if test.url == "" {
+				test.url = "/test"
+			}
+
+			req, err := http.NewRequest(http.MethodPost, test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			hdl := chi.NewRouter()
+			hdl.With(mw).Post("/test", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(200) })
+			hdl.ServeHTTP(rec, req)
+
+			select {
+			case have := <-got:
+				if have.signature != test.want.signature {
+					t.Errorf("[signature] have: %q want: %q", have.signature, test.want.signature)
+				}
+				if have.body != test.want.body {
+					t.Errorf("[body] have: %q want: %q", have.body, test.want.body)
+				}
+			case <-time.After(2 * time.Second):
+				t.Errorf("webhook was not received")
+			}
+		})
+	}
+}
@@ -2,15 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	conf "plugins/config"
 	requ "plugins/request"
 	resp "plugins/response"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -23,6 +26,9 @@ type ctxKey string
 // CtxKeyServerName is the context key that holds name of the server that is supplying the request
 const CtxKeyServerName ctxKey = "_server_name_"
 
+// CtxKeyStrictText is the context key that holds if missing text blocks are an error
+const CtxKeyStrictText ctxKey = "_strict_text_"
+
 // hfsmws HandlerFunc's and MiddleWare's struct, that is passed to the context when there are
 // multiple requests in a path. This is so that if a response inside of a path doesn't match
 // then you can check others.
@@ -30,6 +36,8 @@ type hfsmws struct {
 	hfs   []http.HandlerFunc
 	mws   []chi.Middlewares
 	track int
+
+	noMatch http.HandlerFunc // used after all of the requests have been checked
 }
 type (
 	// PrePluginHTTP runs to add plugins Middleware before any other middleware is added
@@ -97,6 +105,29 @@ type (
 	}
 )
 
+// DefaultReadHeaderTimeout is how long a client has to send the
+// request headers, this stops slow header (slow loris) clients
+// from holding connections open
+var DefaultReadHeaderTimeout = "10s"
+
+// DefaultShutdownGrace is how long a server keeps accepting requests once
+// it starts to shutdown, so new requests get the 503 shutdown message
+// before the listeners are closed
+var DefaultShutdownGrace = "250ms"
+
+// drainShutdown sends the shutdown message to new requests for the grace
+// period, then gracefully shuts down the server so requests already being
+// handled are allowed to complete
+func drainShutdown(serve *http.Server, draining *int32, grace time.Duration) error {
+	atomic.StoreInt32(draining, 1)
+	time.Sleep(grace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return serve.Shutdown(ctx)
+}
+
 // plugins is a global map that holds all of the plugins.
 // both GO plugin, and builtin plugins
 var plugins = make(map[string]Plugin)
@@ -108,28 +139,52 @@ func _http(config *Config) chan struct{} {
 
 	ro := chi.NewRouter() // routes
 	mw := chi.NewRouter() // middleware
+	in := chi.NewRouter() // internal routes, not moved by a base path
+
+	stats := newRouteStats() // the metrics of each route
 
 	mw.Use(log.HTTPMiddleware)
 	for _, route := range config.Routes {
 
+		// expand the matrix into requests
+		if route.Matrix != nil {
+			reqs, err := route.Matrix.requests()
+			if err != nil {
+				log.Fatalf("[http] %s matrix: %v", route.Path, err)
+			}
+			route.Request = append(route.Request, reqs...)
+		}
+
+		is := make(map[string]int)
+		for _, v := range route.Request {
+			for _, method := range strings.Split(v.Method, "|") {
+				is[strings.ToUpper(strings.TrimSpace(method))]++
+			}
+		}
+
+		// the methods configured for this route, sorted
+		// so the CORS headers are always the same
+		var methods []string
+		for method := range is {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+
 		// setup CORS if needed...
 		var corsMidware MiddlewareHTTP
 		if route.CORS != nil {
 			block := *route.CORS // copy them here...
+			cors := corsHandler(&block, methods)
 			corsMidware = func(next http.Handler) http.Handler {
 				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					corsHandler(&block).ServeHTTP(w, r)
+					cors.ServeHTTP(w, r)
 					next.ServeHTTP(w, r)
 				})
 			}
-			log.Printf("[http] OPTIONS %s added ...", route.Path)
-			ro.With(corsMidware).MethodFunc("options", route.Path, func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(200) })
-		}
-
-		is := make(map[string]int)
-		for _, v := range route.Request {
-			for _, method := range strings.Split(v.Method, "|") {
-				is[strings.ToUpper(method)]++
+			// a configured OPTIONS request is used instead of the CORS default
+			if is[http.MethodOptions] == 0 {
+				log.Printf("[http] OPTIONS %s added ...", route.Path)
+				ro.With(corsMidware).MethodFunc("options", route.Path, func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(200) })
 			}
 		}
 
@@ -140,11 +195,16 @@ func _http(config *Config) chan struct{} {
 			multiResponse[k] = hfsmws{hfs: make([]http.HandlerFunc, i), mws: make([]chi.Middlewares, i)}
 		}
 
-		// add http response routes
-		for i, req := range route.Request {
+		// add http response routes, each method has its own
+		// index as a request can be used with multiple methods
+		var ns = make(map[string]int)
+		for _, req := range route.Request {
 			for _, method := range strings.Split(req.Method, "|") {
 				method = strings.ToUpper(strings.TrimSpace(method))
 
+				n := ns[method]
+				ns[method]++
+
 				var midware chi.Middlewares
 
 				// add any method middleware
@@ -159,9 +219,22 @@ func _http(config *Config) chan struct{} {
 					}
 				}
 
+				// check the body before anything reads it
+				if req.RequireContentType != nil {
+					log.Printf("[http] %s content type middleware added ...", route.Path)
+					midware = append(midware, checkContentType(*req.RequireContentType))
+				}
+				if req.MaxBody != nil {
+					log.Printf("[http] %s max body middleware added ...", route.Path)
+					midware = append(midware, checkMaxBody(*req.MaxBody))
+				}
+
 				// check for JWT authorization
 				if req.JWT != nil {
 					log.Printf("[http] %s JWT filter middleware added ...", route.Path)
+					if len(req.OnInvalidJWT) > 0 {
+						req.onInvalidJWT = httpHandler(RequestHTTP{Method: method, Response: req.OnInvalidJWT}, config.Texts)
+					}
 					midware = append(midware, checkRequestJWT(req, ro.NotFoundHandler()))
 				}
 
@@ -171,12 +244,64 @@ func _http(config *Config) chan struct{} {
 					midware = append(midware, checkRequestPost(req, ro.NotFoundHandler()))
 				}
 
+				// check for JSON body values
+				if len(req.BodyJSON) > 0 {
+					log.Printf("[http] %s JSON body filter middleware added ...", route.Path)
+					midware = append(midware, checkRequestBody(req))
+				}
+
+				// check for the JSON-RPC method
+				if req.JSONRPC != nil {
+					log.Printf("[http] %s JSON-RPC filter middleware added ...", route.Path)
+					midware = append(midware, checkJSONRPC(req))
+				}
+
+				// check for the exact request URI
+				if req.ExactURI != nil {
+					log.Printf("[http] %s exact URI filter middleware added ...", route.Path)
+					midware = append(midware, checkExactURI(req))
+				}
+
+				// check for the protocol version
+				if req.HTTPVersion != nil {
+					log.Printf("[http] %s HTTP version filter middleware added ...", route.Path)
+					midware = append(midware, checkHTTPVersion(req))
+				}
+
 				// check for header values
 				if req.Headers != nil {
 					log.Printf("[http] %s header filter middleware added ...", route.Path)
 					midware = append(midware, checkRequestHeader(req, ro.NotFoundHandler()))
 				}
 
+				// check for cookie values
+				if req.Cookies != nil {
+					log.Printf("[http] %s cookie filter middleware added ...", route.Path)
+					midware = append(midware, checkRequestCookie(req, ro.NotFoundHandler()))
+				}
+
+				// check the signed cookies
+				if len(req.SignedCookies) > 0 {
+					log.Printf("[http] %s signed cookie middleware added ...", route.Path)
+					midware = append(midware, checkSignedCookies(req))
+				}
+
+				// limit the requests handled at the same time
+				if req.MaxConcurrent != nil {
+					log.Printf("[http] %s max concurrent middleware added ...", route.Path)
+					midware = append(midware, checkConcurrent(*req.MaxConcurrent))
+				}
+
+				// save responses for repeated idempotency keys
+				if req.Idempotency {
+					log.Printf("[http] %s idempotency middleware added ...", route.Path)
+					midware = append(midware, checkIdempotency(req))
+				}
+
+				if req.Script != nil && !_featureScript {
+					log.Printf("[http] %s script skipped (use -enable-script) ...", route.Path)
+				}
+
 				// add any plugin post middleware
 				for k, plugin := range plugins {
 					if plug, ok := plugin.(PostPluginHTTP); ok {
@@ -197,18 +322,28 @@ func _http(config *Config) chan struct{} {
 				if route.Proxy != nil {
 					pxy := route.Proxy // capture for the closure...
 					log.Printf("[http] proxy for %s added ...", route.Path)
+
+					// a proxy response, so the rewrite templates have the request variables
+					rewrite := httpHandler(RequestHTTP{Method: method, Response: []ResponseHTTP{{Status: pxy.Name, Headers: pxy.Headers}}}, config.Texts)
 					midware = append(midware, func(next http.Handler) http.Handler {
 						return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 							if proxy, ok := r.Context().Value(ctxKey(pxy.Name)).(*configProxy); ok {
-								useProxy(w, r, proxy, pxy.Headers) // async call
+								r = r.WithContext(context.WithValue(r.Context(), CtxKeyRouteProxy, pxy))
+								if _, tmpl := proxyPathOptions(r, proxy); proxy.RewriteRequest != nil || tmpl != nil {
+									rewrite(w, r)
+									return
+								}
+								useProxy(w, r, proxy, pxy.Headers, nil) // async call
 								return
 							}
 						})
 					})
 				}
 
-				multiResponse[method].hfs[i] = httpHandler(req, config.Texts)
-				multiResponse[method].mws[i] = midware
+				req.key = fmt.Sprintf("%s %s %d", method, route.Path, n)
+				req.fragments = route.Fragments
+				multiResponse[method].hfs[n] = httpHandler(req, config.Texts)
+				multiResponse[method].mws[n] = midware
 			}
 		}
 
@@ -217,9 +352,20 @@ func _http(config *Config) chan struct{} {
 			hf, mw := v.hfs[0], v.mws[0]
 			v.hfs, v.mws = v.hfs[1:], v.mws[1:]
 
+			if len(route.OnNoMatch) > 0 {
+				log.Printf("[http] %s %s no match responses added ...", method, route.Path)
+				v.noMatch = httpHandler(RequestHTTP{Method: method, Response: route.OnNoMatch}, config.Texts)
+			}
+
 			// add the handler with the proper middleware
 			log.Printf("[http] %s %s added ...", method, route.Path)
-			ro.With(checkRetries(v)).With(mw...).Method(method, route.Path, hf)
+			ro.With(stats.middleware(method+" "+route.Path), checkRetries(v)).With(mw...).Method(method, route.Path, hf)
+		}
+
+		// serve any static files under the path
+		if route.Static != nil {
+			log.Printf("[http] static %s added from %q ...", route.Path, route.Static.Dir)
+			ro.Get(strings.TrimSuffix(route.Path, "/")+"/*", staticHandler(config.internal.os, route.Static))
 		}
 	}
 
@@ -267,8 +413,54 @@ func _http(config *Config) chan struct{} {
 	}
 
 	// show errors and stats
-	ro.Get("/_internal/reload/errors", re.handler(config))
-	ro.Get("/_internal/server/stats", serverStats())
+	in.Get("/reload/errors", re.handler(config))
+	in.Get("/server/stats", serverStats(stats))
+
+	// if the server is up and running the latest config, for liveness probes
+	in.Get("/health", healthHandler(config))
+
+	// the dependency states used by ${dependency("name")}
+	in.Get("/dependency", dependenciesHandler())
+	in.Put("/dependency/{name}", dependencyHandler())
+
+	// the configured response bodies, for discovering response shapes
+	in.Get("/examples", examplesHandler(config.Routes))
+
+	// the loaded config files, with the secrets redacted
+	in.Get("/config.hcl", configSourceHandler(config.internal.os, config.internal.files))
+
+	// the public JWT keys, for clients that validate the signed tokens
+	keys := serverJWKS(config.Servers)
+
+	// record requests to the journal
+	if config.System != nil && config.System.Journal != nil {
+		jr := newJournal(*config.System.Journal)
+		log.Println("[http] request journal added ...")
+		mw.Use(jr.middleware)
+		in.Get("/server/journal", jr.handler())
+	}
+
+	// buffer the request body so it can be read by matching and templates
+	mw.Use(replayRequestBody)
+
+	// body files are read from the same file system as the config
+	mw.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), CtxKeyFs, config.internal.os)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	})
+
+	// error on missing text blocks instead of using an empty string
+	if config.System != nil && config.System.StrictText {
+		log.Println("[http] strict text blocks added ...")
+		mw.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctx := context.WithValue(r.Context(), CtxKeyStrictText, true)
+				next.ServeHTTP(w, r.WithContext(ctx))
+			})
+		})
+	}
 
 	// channels used for stopping all of the running servers
 	var stoppers = make([]chan struct{}, len(config.Servers))
@@ -278,11 +470,28 @@ func _http(config *Config) chan struct{} {
 
 	// how we can wait until all of the servers have gracefully shutdown
 	var svr = new(sync.WaitGroup)
-	svr.Add(len(config.Servers))
 
 	for i, server := range config.Servers {
 		r := chi.NewRouter() // a place where we can combine middleware and routes
 
+		// send back a 503 for new requests once this server is shutting down
+		var draining int32
+		shutdownMsg := DefaultShutdownMessage
+		if server.ShutdownMessage != nil {
+			shutdownMsg = *server.ShutdownMessage
+		}
+		r.Use(checkShutdown(&draining, shutdownMsg))
+
+		// simulate a slow start, where nothing is ready yet
+		if server.ReadyAfter != nil {
+			log.Printf("[http] %q is ready after %s ...", server.Name, *server.ReadyAfter)
+			start := config.internal.svrStart
+			if start.IsZero() {
+				start = time.Now()
+			}
+			r.Use(checkReady(start, delay(*server.ReadyAfter)))
+		}
+
 		tlsConfig := useTLS(r, server) // Getting our TLS status for each server
 
 		// check if we should limit this server to only HTTP2 requests
@@ -299,6 +508,46 @@ func _http(config *Config) chan struct{} {
 			})
 		}
 
+		// check if we should close every connection like HTTP/1.0
+		if server.HTTP10 {
+			log.Printf("[http1.0] %q is closing connections after each response ...", server.Name)
+			r.Use(func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Connection", "close")
+					next.ServeHTTP(w, r)
+				})
+			})
+		}
+
+		if server.ServerHeader != nil {
+			log.Printf("[http] %q is sending the %q server header ...", server.Name, *server.ServerHeader)
+			name := *server.ServerHeader
+			r.Use(func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Server", name)
+					next.ServeHTTP(w, r)
+				})
+			})
+		}
+
+		// compress the response bodies for clients that accept it
+		if server.Compress {
+			log.Printf("[http] %q is compressing responses ...", server.Name)
+			r.Use(compressResponse)
+		}
+
+		// create or pass along the W3C trace context headers
+		if server.TraceContext {
+			log.Printf("[http] %q is adding trace context headers ...", server.Name)
+			r.Use(traceContext)
+		}
+
+		// match mixed-case and unclean paths, i.e. /Users//1 is /users/1
+		if server.NormPath {
+			log.Printf("[http] %q is normalizing request paths ...", server.Name)
+			r.Use(normalizePath)
+		}
+
 		if server.BasicAuth != nil {
 			log.Printf("[basicAuth] %q middleware added ...", server.Name)
 			r.Use(checkBasicAuth(server, ro.NotFoundHandler()))
@@ -315,6 +564,39 @@ func _http(config *Config) chan struct{} {
 			})
 		}
 
+		if len(server.OnInvalidJWT) > 0 {
+			log.Printf("[jwt] %q on_invalid_jwt responses added ...", server.Name)
+			invalid := httpHandler(RequestHTTP{Method: "*", Response: server.OnInvalidJWT}, config.Texts)
+			r.Use(func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					ctx := context.WithValue(r.Context(), CtxKeyOnInvalidJWT, invalid)
+					next.ServeHTTP(w, r.WithContext(ctx))
+				})
+			})
+		}
+
+		if server.MaxBodyBytes != nil {
+			log.Printf("[http] %q max body bytes is %d ...", server.Name, *server.MaxBodyBytes)
+			max := *server.MaxBodyBytes
+			r.Use(func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					ctx := context.WithValue(r.Context(), CtxKeyMaxBodyBytes, max)
+					next.ServeHTTP(w, r.WithContext(ctx))
+				})
+			})
+		}
+
+		if server.CookieSecret != nil {
+			log.Printf("[http] %q cookie secret added ...", server.Name)
+			secret := []byte(*server.CookieSecret)
+			r.Use(func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					ctx := context.WithValue(r.Context(), CtxKeyCookieSecret, secret)
+					next.ServeHTTP(w, r.WithContext(ctx))
+				})
+			})
+		}
+
 		// add server proxy configs
 		if server.Proxy != nil {
 			log.Printf("[proxy] %q add proxy %q lookup ...", server.Name, server.Proxy.Name)
@@ -323,6 +605,13 @@ func _http(config *Config) chan struct{} {
 				log.Fatalf("[server] %q parse proxy block: %v", server.Proxy.Name, err)
 			}
 			server.Proxy._url = urlParsed
+			switch server.Proxy.Mode {
+			case "", ProxyModePassthrough, ProxyModeRecord, ProxyModeReplay:
+			case ProxyModeContract:
+				server.Proxy._violation = func(err error) { re.saveViolation(*config, err) }
+			default:
+				log.Fatalf("[server] %q proxy block: %v", server.Proxy.Name, ErrProxyMode.F(server.Proxy.Mode))
+			}
 			r.Use(func(next http.Handler) http.Handler {
 				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 					ctx := context.WithValue(r.Context(), ctxKey(server.Proxy.Name), server.Proxy)
@@ -338,41 +627,65 @@ func _http(config *Config) chan struct{} {
 			})
 		})
 
+		basePath := "/"
+		if server.BasePath != nil {
+			basePath = "/" + strings.Trim(*server.BasePath, "/")
+			log.Printf("[server] %q routes are under %s ...", server.Name, basePath)
+		}
+
 		r.Use(mw.Middlewares()...)
-		r.Mount("/", ro)
-		serve := &http.Server{
-			Addr:      server.Host,
-			Handler:   r,
-			TLSConfig: tlsConfig,
+		if len(keys.Keys) > 0 {
+			r.Get("/.well-known/jwks.json", jwksHandler(keys))
+		}
+		r.Mount("/_internal", in)
+		r.Mount(basePath, ro)
+
+		hosts, err := server.hosts()
+		if err != nil {
+			log.Fatalf("[server] %v", err)
+		}
+
+		readHeaderTimeout := DefaultReadHeaderTimeout
+		if server.ReadHeaderTimeout != nil {
+			readHeaderTimeout = *server.ReadHeaderTimeout
 		}
 
-		// handle graceful shutdown for all started servers
-		go func() {
-			<-stoppers[i]
-			defer svr.Done()
+		// start a server for each host, all sharing the same routes
+		for _, host := range hosts {
+			serve := &http.Server{
+				Addr:              host,
+				Handler:           r,
+				TLSConfig:         tlsConfig,
+				ReadHeaderTimeout: delay(readHeaderTimeout),
+			}
+			serve.SetKeepAlivesEnabled(!server.HTTP10)
 
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
+			// handle graceful shutdown for all started servers
+			svr.Add(1)
+			go func(stop chan struct{}) {
+				<-stop
+				defer svr.Done()
 
-			err := serve.Shutdown(ctx)
-			log.OnErr(err).Printf("[server] graceful shutdown err: %v", err)
+				err := drainShutdown(serve, &draining, delay(DefaultShutdownGrace))
+				log.OnErr(err).Printf("[server] graceful shutdown err: %v", err)
 
-		}()
+			}(stoppers[i])
 
-		// starting the server
-		go func(name string) {
-			if tlsConfig == nil {
-				log.Printf("[server] %q starting HTTP (addr: %s) ...", name, serve.Addr)
-				if err := serve.ListenAndServe(); err != http.ErrServerClosed {
-					log.Fatalf("[server] HTTP ListenAndServe: %v", err)
-				}
-			} else {
-				log.Printf("[server] %q starting HTTPS (addr: %s) ...", name, serve.Addr)
-				if err := serve.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
-					log.Fatalf("[server] HTTPS ListenAndServe: %v", err)
+			// starting the server
+			go func(name string) {
+				if tlsConfig == nil {
+					log.Printf("[server] %q starting HTTP (addr: %s) ...", name, serve.Addr)
+					if err := serve.ListenAndServe(); err != http.ErrServerClosed {
+						log.Fatalf("[server] HTTP ListenAndServe: %v", err)
+					}
+				} else {
+					log.Printf("[server] %q starting HTTPS (addr: %s) ...", name, serve.Addr)
+					if err := serve.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+						log.Fatalf("[server] HTTPS ListenAndServe: %v", err)
+					}
 				}
-			}
-		}(server.Name)
+			}(server.Name)
+		}
 	}
 
 	shutdown := make(chan struct{}, 1)
@@ -387,10 +700,45 @@ func _http(config *Config) chan struct{} {
 	return shutdown
 }
 
-// serverStats returns the stats around each request
-// NOT YET IMPLEMENTED...
-func serverStats() http.HandlerFunc {
+// serverStats returns the request counts, statuses and
+// latency percentiles of each route as JSON
+func serverStats(stats *routeStats) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "addr:", r.Host)
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(stats.snapshot())
+		log.OnErr(err).Printf("[stats] writing stats: %v", err)
+	}
+}
+
+// serverHealth is the JSON sent by the health handler
+type serverHealth struct {
+	Status      string    `json:"status"`
+	ConfigValid bool      `json:"config_valid"`
+	Uptime      string    `json:"uptime"`
+	Started     time.Time `json:"started"`
+	ConfigLoad  time.Time `json:"config_loaded"`
+}
+
+// healthHandler writes a 200 when the last config reload was applied, and
+// a 503 when the server is running a stale config after a failed reload
+func healthHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		health := serverHealth{
+			Status:      "ok",
+			ConfigValid: config.internal.svrCfgLoadValid,
+			Uptime:      time.Since(config.internal.svrStart).Round(time.Second).String(),
+			Started:     config.internal.svrStart,
+			ConfigLoad:  config.internal.svrCfgLoad,
+		}
+
+		status := http.StatusOK
+		if !health.ConfigValid {
+			health.Status, status = "stale config", http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		err := json.NewEncoder(w).Encode(health)
+		log.OnErr(err).Printf("[health] writing health: %v", err)
 	}
 }
@@ -0,0 +1,1128 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/spf13/afero"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// freeAddr returns a local address that is not being listened on
+func freeAddr(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+// testServe starts the servers in the config and
+// returns a function that shuts them down again
+func testServe(t *testing.T, config *Config) func() {
+	config.internal.os = afero.NewMemMapFs()
+	config.internal.svrCfgLoadValid = true
+	config.shutdown = make(chan struct{}, 1)
+
+	shutdown := _http(config)
+	return func() {
+		config.shutdown <- struct{}{}
+		<-shutdown
+	}
+}
+
+// testDial returns a connection to the address, waiting for the server to start
+func testDial(t *testing.T, addr string) net.Conn {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			return conn
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(err)
+	return nil
+}
+
+func TestServerHosts(t *testing.T) {
+	var tests = []struct {
+		name string
+		host cty.Value
+		want []string
+	}{
+		{name: "not set", host: cty.NilVal, want: []string{""}},
+		{name: "single", host: cty.StringVal(":8080"), want: []string{":8080"}},
+		{name: "list", host: cty.TupleVal([]cty.Value{cty.StringVal(":8080"), cty.StringVal(":8443")}), want: []string{":8080", ":8443"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			have, err := ConfigHTTP{Name: "test", Host: test.host}.hosts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(have) != len(test.want) {
+				t.Fatalf("have: %q want: %q", have, test.want)
+			}
+			for i := range have {
+				if have[i] != test.want[i] {
+					t.Errorf("have: %q want: %q", have[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestServerMultipleHosts(t *testing.T) {
+	addrs := []string{freeAddr(t), freeAddr(t)}
+
+	var config Config
+	config.Servers = []ConfigHTTP{
+		{Name: "test", Host: cty.TupleVal([]cty.Value{cty.StringVal(addrs[0]), cty.StringVal(addrs[1])})},
+	}
+	config.Routes = []Route{
+		{
+			Path: "/test",
+			Request: []RequestHTTP{
+				{
+					Method:   "get",
+					Response: []ResponseHTTP{{Status: "200", Body: attr("same routes")}},
+					Plugins:  hcl.EmptyBody(),
+				},
+			},
+		},
+	}
+
+	defer testServe(t, &config)()
+
+	for _, addr := range addrs {
+		testDial(t, addr).Close() // wait for the server to start
+
+		res, err := http.Get("http://" + addr + "/test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("[%s] have: %d want: %d", addr, res.StatusCode, http.StatusOK)
+		}
+		if have := string(b); have != "same routes" {
+			t.Errorf("[%s] have: %q want: %q", addr, have, "same routes")
+		}
+	}
+}
+
+func TestServerReadHeaderTimeout(t *testing.T) {
+	addr := freeAddr(t)
+	timeout := "50ms"
+
+	var config Config
+	config.Servers = []ConfigHTTP{
+		{Name: "test", Host: cty.StringVal(addr), ReadHeaderTimeout: &timeout},
+	}
+	defer testServe(t, &config)()
+
+	conn := testDial(t, addr)
+	defer conn.Close()
+
+	// send part of the headers, then stall like a slow client
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("the connection was not dropped: %v", err)
+	}
+	if err == nil {
+		t.Fatal("have: a response want: a dropped connection")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("have: %v want: less than %v", elapsed, time.Second)
+	}
+}
+
+func TestServerCombinedMethods(t *testing.T) {
+	addr := freeAddr(t)
+
+	var config Config
+	config.Servers = []ConfigHTTP{{Name: "test", Host: cty.StringVal(addr)}}
+	config.Routes = []Route{
+		{
+			Path: "/test",
+			Request: []RequestHTTP{
+				{
+					Method:   "get",
+					Headers:  &headers{Data: headerData{"X-Key": {cty.StringVal("a")}}},
+					Response: []ResponseHTTP{{Status: "200", Body: attr("get only")}},
+					Plugins:  hcl.EmptyBody(),
+				},
+				{
+					Method:   "get | post",
+					Response: []ResponseHTTP{{Status: "200", Body: attr("combined")}},
+					Plugins:  hcl.EmptyBody(),
+				},
+			},
+		},
+	}
+	defer testServe(t, &config)()
+	testDial(t, addr).Close() // wait for the server to start
+
+	var tests = []struct {
+		method string
+		key    string
+		want   string
+	}{
+		{method: http.MethodGet, key: "a", want: "get only"},
+		{method: http.MethodGet, key: "b", want: "combined"},
+		{method: http.MethodPost, key: "a", want: "combined"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method+" "+test.key, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, "http://"+addr+"/test", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Key", test.key)
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("have: %d want: %d", res.StatusCode, http.StatusOK)
+			}
+			if have := string(b); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestServerHTTP10(t *testing.T) {
+	var tests = []struct {
+		name   string
+		http10 bool
+		want   string
+	}{
+		{name: "keep-alive", http10: false, want: ""},
+		{name: "http/1.0", http10: true, want: "close"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := freeAddr(t)
+
+			var config Config
+			config.Servers = []ConfigHTTP{{Name: "test", Host: cty.StringVal(addr), HTTP10: test.http10}}
+			defer testServe(t, &config)()
+
+			conn := testDial(t, addr)
+			defer conn.Close()
+
+			// read the raw headers, as the http client removes the Connection header
+			fmt.Fprint(conn, "GET /_internal/server/stats HTTP/1.1\r\nHost: test\r\n\r\n")
+			tp := textproto.NewReader(bufio.NewReader(conn))
+			if _, err := tp.ReadLine(); err != nil {
+				t.Fatal(err)
+			}
+			hdr, err := tp.ReadMIMEHeader()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have := hdr.Get("Connection"); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestServerDrainShutdown(t *testing.T) {
+	var draining int32
+	var started, release = make(chan struct{}), make(chan struct{})
+
+	hdl := chi.NewRouter()
+	hdl.Use(checkShutdown(&draining, "going away"))
+	hdl.Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		fmt.Fprint(w, "finished")
+	})
+	hdl.Get("/fast", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "fast") })
+
+	srv := httptest.NewServer(hdl)
+	defer srv.Close()
+
+	// an in-flight request that completes after the shutdown starts
+	inflight := make(chan string)
+	go func() {
+		res, err := http.Get(srv.URL + "/slow")
+		if err != nil {
+			inflight <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		inflight <- string(b)
+	}()
+	<-started
+
+	done := make(chan error)
+	go func() { done <- drainShutdown(srv.Config, &draining, 200*time.Millisecond) }()
+	for atomic.LoadInt32(&draining) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	res, err := http.Get(srv.URL + "/fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("[new] have: %d want: %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+	if have, want := string(b), "going away\n"; have != want {
+		t.Errorf("[new] have: %q want: %q", have, want)
+	}
+
+	close(release)
+	if have := <-inflight; have != "finished" {
+		t.Errorf("[in-flight] have: %q want: %q", have, "finished")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := http.Get(srv.URL + "/fast"); err == nil {
+		t.Error("[closed] have: a response want: an error")
+	}
+}
+
+func TestServerJournal(t *testing.T) {
+	addr := freeAddr(t)
+
+	var config Config
+	config.System = &system{Journal: &systemJournal{CaptureBody: true, Redact: []string{"password", "card.number"}}}
+	config.Servers = []ConfigHTTP{{Name: "test", Host: cty.StringVal(addr)}}
+	config.Routes = []Route{
+		{
+			Path: "/login",
+			Request: []RequestHTTP{
+				{
+					Method:   "post",
+					Response: []ResponseHTTP{{Status: "200", Body: attr("ok")}},
+					Plugins:  hcl.EmptyBody(),
+				},
+			},
+		},
+	}
+	defer testServe(t, &config)()
+	testDial(t, addr).Close() // wait for the server to start
+
+	body := `{"user":"nika","password":"secret","card":{"number":"4111"}}`
+	res, err := http.Post("http://"+addr+"/login", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	res, err = http.Get("http://" + addr + "/_internal/server/journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var entries []journalEntry
+	if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("have: %d want: %d", len(entries), 1)
+	}
+
+	want := `{"card":{"number":"[REDACTED]"},"password":"[REDACTED]","user":"nika"}`
+	if have := entries[0].Body; have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+	if have := entries[0].Path; have != "/login" {
+		t.Errorf("have: %q want: %q", have, "/login")
+	}
+}
+
+func TestJournalRedactBody(t *testing.T) {
+	var tests = []struct {
+		name   string
+		redact [][]string
+		body   string
+		want   string
+	}{
+		{name: "no redact", body: "password=secret", want: "password=secret"},
+		{name: "redacted", redact: [][]string{{"password"}}, body: `{"password":"secret"}`, want: `{"password":"[REDACTED]"}`},
+		{name: "not json", redact: [][]string{{"password"}}, body: "password=secret", want: journalUnparsed},
+		{name: "cut off", redact: [][]string{{"password"}}, body: `{"password":"sec`, want: journalUnparsed},
+		{name: "empty", redact: [][]string{{"password"}}, body: "", want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			jr := &journal{redact: test.redact}
+			if have := jr.redactBody([]byte(test.body)); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestServerBasePath(t *testing.T) {
+	addr := freeAddr(t)
+	basePath := "/api"
+
+	var config Config
+	config.Servers = []ConfigHTTP{{Name: "test", Host: cty.StringVal(addr), BasePath: &basePath}}
+	config.Routes = []Route{
+		{
+			Path: "/users/{id}",
+			Request: []RequestHTTP{
+				{
+					Method:   "get",
+					Response: []ResponseHTTP{{Status: "200", Body: attr("user ${url.id}")}},
+					Plugins:  hcl.EmptyBody(),
+				},
+			},
+		},
+	}
+	defer testServe(t, &config)()
+	testDial(t, addr).Close() // wait for the server to start
+
+	var tests = []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{path: "/api/users/7", status: http.StatusOK, want: "user 7"},
+		{path: "/users/7", status: http.StatusNotFound},
+		{path: "/_internal/server/stats", status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			res, err := http.Get("http://" + addr + test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Errorf("have: %d want: %d", res.StatusCode, test.status)
+			}
+			if have := string(b); test.want != "" && have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestServerReasonPhrase(t *testing.T) {
+	var tests = []struct {
+		name   string
+		method string
+		proto  string
+		body   string
+	}{
+		{name: "HTTP/1.1", method: "GET", proto: "HTTP/1.1", body: "calm down"},
+		{name: "HTTP/1.0", method: "GET", proto: "HTTP/1.0", body: "calm down"},
+		{name: "HEAD", method: "HEAD", proto: "HTTP/1.1", body: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reason := "Enhance Your Calm"
+			req := RequestHTTP{
+				Method:   strings.ToLower(test.method),
+				Response: []ResponseHTTP{{Status: "420", Reason: &reason, Body: attr("calm down")}},
+			}
+
+			stats := newRouteStats()
+			hdl := chi.NewRouter()
+			hdl.Use(log.HTTPMiddleware) // the same as the server, which wraps the writer
+			hdl.With(stats.middleware("test")).Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+			svr := httptest.NewServer(hdl)
+			defer svr.Close()
+
+			conn := testDial(t, svr.Listener.Addr().String())
+			defer conn.Close()
+
+			fmt.Fprintf(conn, "%s /test %s\r\nHost: test\r\n\r\n", test.method, test.proto)
+			tp := textproto.NewReader(bufio.NewReader(conn))
+
+			line, err := tp.ReadLine()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := test.proto + " 420 Enhance Your Calm"; line != want {
+				t.Errorf("have: %q want: %q", line, want)
+			}
+
+			hdr, err := tp.ReadMIMEHeader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have := hdr.Get("Content-Length"); have != "9" {
+				t.Errorf("have: %q want: %q", have, "9")
+			}
+
+			body, _ := ioutil.ReadAll(tp.R)
+			if have := string(body); have != test.body {
+				t.Errorf("have: %q want: %q", have, test.body)
+			}
+
+			if have := stats.snapshot()["test"].Statuses[420]; have != 1 {
+				t.Errorf("have: %d want: %d 420 statuses", have, 1)
+			}
+		})
+	}
+}
+
+func TestServerReasonPhraseIdempotency(t *testing.T) {
+	reason := "Enhance Your Calm"
+	req := RequestHTTP{
+		Method:      "post",
+		Idempotency: true,
+		Response: []ResponseHTTP{
+			{Status: "420", Reason: &reason, Body: attr("calm down")},
+			{Status: "200", Body: attr("second")},
+		},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Use(log.HTTPMiddleware) // the same as the server, which wraps the writer
+	hdl.With(checkIdempotency(req)).Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	svr := httptest.NewServer(hdl)
+	defer svr.Close()
+
+	for i := 0; i < 2; i++ {
+		r, err := http.NewRequest(http.MethodPost, svr.URL+"/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Idempotency-Key", "a")
+
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != 420 || string(b) != "calm down" {
+			t.Errorf("[%d] have: %d %q want: %d %q", i+1, res.StatusCode, b, 420, "calm down")
+		}
+	}
+}
+
+func TestServerRawHeaders(t *testing.T) {
+	req := RequestHTTP{
+		Method: "get",
+		Response: []ResponseHTTP{{
+			Status:     "200",
+			RawHeaders: []string{"x-request-id: abc", "X-UPPER: 1", "content-type: text/x-mock", "bad header"},
+			Body:       attr("raw"),
+		}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Use(log.HTTPMiddleware) // the same as the server, which wraps the writer
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	svr := httptest.NewServer(hdl)
+	defer svr.Close()
+
+	conn := testDial(t, svr.Listener.Addr().String())
+	defer conn.Close()
+
+	fmt.Fprint(conn, "GET /test HTTP/1.1\r\nHost: test\r\n\r\n")
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire := string(b)
+
+	if !strings.HasPrefix(wire, "HTTP/1.1 200 OK\r\n") {
+		t.Errorf("have: %q want: the 200 OK status line", wire)
+	}
+	if want := "\r\nx-request-id: abc\r\nX-UPPER: 1\r\ncontent-type: text/x-mock\r\n\r\nraw"; !strings.Contains(wire, want) {
+		t.Errorf("have: %q want: %q", wire, want)
+	}
+	if strings.Contains(wire, "Content-Type:") || strings.Contains(wire, "bad header") {
+		t.Errorf("have: %q want: no canonical Content-Type or bad header", wire)
+	}
+}
+
+func TestServerCloseConnection(t *testing.T) {
+	var tests = []struct {
+		name    string
+		close   bool
+		chunked bool
+		wantErr bool
+	}{
+		{name: "kept alive", close: false},
+		{name: "closed", close: true, wantErr: true},
+		{name: "closed and chunked", close: true, chunked: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{Method: "get", Response: []ResponseHTTP{{Status: "200", CloseConnection: test.close, Chunked: test.chunked, Body: attr("bye")}}}
+
+			hdl := chi.NewRouter()
+			hdl.Use(log.HTTPMiddleware) // the same as the server, which wraps the writer
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+			svr := httptest.NewServer(hdl)
+			defer svr.Close()
+
+			conn := testDial(t, svr.Listener.Addr().String())
+			defer conn.Close()
+			rd := bufio.NewReader(conn)
+
+			fmt.Fprint(conn, "GET /test HTTP/1.1\r\nHost: test\r\n\r\n")
+			res, err := http.ReadResponse(rd, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if res.Close != test.close { // set from the Connection: close header
+				t.Errorf("have: %t want: %t", res.Close, test.close)
+			}
+			if have := len(res.TransferEncoding) > 0; have != test.chunked { // the other options still apply
+				t.Errorf("have: %t want: %t chunked", have, test.chunked)
+			}
+			if have := string(b); have != "bye" {
+				t.Errorf("have: %q want: %q", have, "bye")
+			}
+
+			conn.SetDeadline(time.Now().Add(time.Second))
+			fmt.Fprint(conn, "GET /test HTTP/1.1\r\nHost: test\r\n\r\n")
+			if _, err = http.ReadResponse(rd, nil); (err != nil) != test.wantErr {
+				t.Errorf("have: %v want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestServerNormalizePath(t *testing.T) {
+	addr := freeAddr(t)
+
+	var config Config
+	config.Servers = []ConfigHTTP{{Name: "test", Host: cty.StringVal(addr), NormPath: true}}
+	config.Routes = []Route{
+		{
+			Path: "/users/{id}",
+			Request: []RequestHTTP{
+				{
+					Method:   "get",
+					Response: []ResponseHTTP{{Status: "200", Body: attr("user ${url.id}")}},
+					Plugins:  hcl.EmptyBody(),
+				},
+			},
+		},
+	}
+	defer testServe(t, &config)()
+	testDial(t, addr).Close() // wait for the server to start
+
+	var tests = []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{path: "/users/7", status: http.StatusOK, want: "user 7"},
+		{path: "/Users/7", status: http.StatusOK, want: "user 7"},
+		{path: "/USERS//7", status: http.StatusOK, want: "user 7"},
+		{path: "/accounts/7", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			res, err := http.Get("http://" + addr + test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Errorf("have: %d want: %d", res.StatusCode, test.status)
+			}
+			if have := string(b); test.want != "" && have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	var tests = []struct {
+		name   string
+		header *string
+		want   string
+	}{
+		{name: "none", want: ""},
+		{name: "custom", header: func(s string) *string { return &s }("nginx/1.25.3"), want: "nginx/1.25.3"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := freeAddr(t)
+
+			var config Config
+			config.Servers = []ConfigHTTP{{Name: "test", Host: cty.StringVal(addr), ServerHeader: test.header}}
+			config.Routes = []Route{
+				{
+					Path: "/test",
+					Request: []RequestHTTP{
+						{
+							Method:   "get",
+							Response: []ResponseHTTP{{Status: "200", Body: attr("ok")}},
+							Plugins:  hcl.EmptyBody(),
+						},
+					},
+				},
+			}
+			defer testServe(t, &config)()
+			testDial(t, addr).Close() // wait for the server to start
+
+			res, err := http.Get("http://" + addr + "/test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if have := res.Header.Get("Server"); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestServerReadyAfter(t *testing.T) {
+	addr := freeAddr(t)
+	after := "300ms"
+
+	var config Config
+	config.Servers = []ConfigHTTP{{Name: "test", Host: cty.StringVal(addr), ReadyAfter: &after}}
+	config.Routes = []Route{
+		{
+			Path: "/test",
+			Request: []RequestHTTP{
+				{
+					Method:   "get",
+					Response: []ResponseHTTP{{Status: "200", Body: attr("ok")}},
+					Plugins:  hcl.EmptyBody(),
+				},
+			},
+		},
+	}
+	start := time.Now()
+	defer testServe(t, &config)()
+	testDial(t, addr).Close() // wait for the server to start
+
+	get := func() *http.Response {
+		res, err := http.Get("http://" + addr + "/test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	if res := get(); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("before have: %d want: %d", res.StatusCode, http.StatusServiceUnavailable)
+	} else if res.Header.Get("Retry-After") != "1" {
+		t.Errorf("have: %q want: %q", res.Header.Get("Retry-After"), "1")
+	}
+
+	time.Sleep(delay(after) - time.Since(start) + 50*time.Millisecond)
+
+	if res := get(); res.StatusCode != http.StatusOK {
+		t.Errorf("after have: %d want: %d", res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestServerOptionsResponse(t *testing.T) {
+	var tests = []struct {
+		name    string
+		options bool
+		want    string
+	}{
+		{name: "cors default", want: ""},
+		{name: "configured", options: true, want: `{"methods":["GET","OPTIONS"]}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := freeAddr(t)
+
+			requests := []RequestHTTP{
+				{Method: "get", Response: []ResponseHTTP{{Status: "200", Body: attr("ok")}}, Plugins: hcl.EmptyBody()},
+			}
+			if test.options {
+				requests = append(requests, RequestHTTP{Method: "options", Response: []ResponseHTTP{{Status: "200", Body: attr(test.want)}}, Plugins: hcl.EmptyBody()})
+			}
+
+			var config Config
+			config.Servers = []ConfigHTTP{{Name: "test", Host: cty.StringVal(addr)}}
+			config.Routes = []Route{{Path: "/test", CORS: &routeCORS{AllowOrigin: "*"}, Request: requests}}
+			defer testServe(t, &config)()
+			testDial(t, addr).Close() // wait for the server to start
+
+			r, err := http.NewRequest(http.MethodOptions, "http://"+addr+"/test", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("have: %d want: %d", res.StatusCode, http.StatusOK)
+			}
+			if have := res.Header.Get("Access-Control-Allow-Origin"); have != "*" {
+				t.Errorf("have: %q want: %q", have, "*")
+			}
+			if have := string(body); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestRequestCookie(t *testing.T) {
+	addr := freeAddr(t)
+
+	var config Config
+	src := strings.Replace(`
+http "test" { host = "%s" }
+path "/whoami" {
+	request "get" {
+		cookie { session = "admin-session" }
+		response "200" { body = "admin" }
+	}
+	request "get" {
+		cookie { session = "*" }
+		response "200" { body = "user" }
+	}
+}`, "%s", addr, 1)
+	if err := decode([]string{"test.hcl"}, [][]byte{[]byte(src)}, _context(), &config); err != nil {
+		t.Fatal(err)
+	}
+	defer testServe(t, &config)()
+	testDial(t, addr).Close() // wait for the server to start
+
+	var tests = []struct {
+		name   string
+		cookie string
+		status int
+		want   string
+	}{
+		{name: "admin", cookie: "session=admin-session", status: http.StatusOK, want: "admin"},
+		{name: "user", cookie: "session=other-session", status: http.StatusOK, want: "user"},
+		{name: "duplicate names", cookie: "session=other-session; session=admin-session", status: http.StatusOK, want: "admin"},
+		{name: "no session", cookie: "theme=dark", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/whoami", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Cookie", test.cookie)
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Errorf("have: %d want: %d", res.StatusCode, test.status)
+			}
+			if have := string(b); test.want != "" && have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestRequestExactURI(t *testing.T) {
+	addr := freeAddr(t)
+
+	var config Config
+	src := strings.Replace(`
+http "test" { host = "%s" }
+path "/search" {
+	request "get" {
+		exact_uri = "/search?q=mock&page=1"
+		response "200" { body = "page 1" }
+	}
+	request "get" {
+		exact_uri = "/search?q=mock&page=2"
+		response "200" { body = "page 2" }
+	}
+}`, "%s", addr, 1)
+	if err := decode([]string{"test.hcl"}, [][]byte{[]byte(src)}, _context(), &config); err != nil {
+		t.Fatal(err)
+	}
+	defer testServe(t, &config)()
+	testDial(t, addr).Close() // wait for the server to start
+
+	var tests = []struct {
+		name   string
+		uri    string
+		status int
+		want   string
+	}{
+		{name: "first", uri: "/search?q=mock&page=1", status: http.StatusOK, want: "page 1"},
+		{name: "second", uri: "/search?q=mock&page=2", status: http.StatusOK, want: "page 2"},
+		{name: "query order", uri: "/search?page=1&q=mock", status: http.StatusNotFound},
+		{name: "no query", uri: "/search", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := http.Get("http://" + addr + test.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Errorf("have: %d want: %d", res.StatusCode, test.status)
+			}
+			if have := string(b); test.want != "" && have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
+
+func TestRouteMatrix(t *testing.T) {
+	addr := freeAddr(t)
+
+	var config Config
+	src := strings.Replace(`
+http "test" { host = "%s" }
+path "/things" {
+	matrix {
+		get    = { "200" = "ok", "404" = "missing" }
+		post   = { 201 = "created" }
+		delete = { "204" = "" }
+	}
+}`, "%s", addr, 1)
+	if err := decode([]string{"test.hcl"}, [][]byte{[]byte(src)}, _context(), &config); err != nil {
+		t.Fatal(err)
+	}
+	defer testServe(t, &config)()
+	testDial(t, addr).Close() // wait for the server to start
+
+	var tests = []struct {
+		method string
+		status int
+		want   string
+	}{
+		{method: http.MethodGet, status: http.StatusOK, want: "ok"},
+		{method: http.MethodGet, status: http.StatusNotFound, want: "missing"},
+		{method: http.MethodGet, status: http.StatusOK, want: "ok"},
+		{method: http.MethodPost, status: http.StatusCreated, want: "created"},
+		{method: http.MethodDelete, status: http.StatusNoContent, want: ""},
+		{method: http.MethodPut, status: http.StatusMethodNotAllowed, want: ""},
+	}
+
+	for i, test := range tests {
+		req, err := http.NewRequest(test.method, "http://"+addr+"/things", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != test.status {
+			t.Errorf("[%d] have: %d want: %d", i+1, res.StatusCode, test.status)
+		}
+		if have := string(b); have != test.want {
+			t.Errorf("[%d] have: %q want: %q", i+1, have, test.want)
+		}
+	}
+}
+
+func TestServerChunked(t *testing.T) {
+	var tests = []struct {
+		name    string
+		chunked bool
+		body    string
+		want    []string
+	}{
+		{name: "content length", body: "not chunked", want: nil},
+		{name: "chunked", chunked: true, body: "chunked", want: []string{"chunked"}},
+		{name: "chunked over the chunk size", chunked: true, body: strings.Repeat("x", DefaultChunkSize*3+1), want: []string{"chunked"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := RequestHTTP{
+				Method:   "get",
+				Response: []ResponseHTTP{{Status: "200", Chunked: test.chunked, Body: attr(test.body)}},
+			}
+
+			hdl := chi.NewRouter()
+			hdl.Use(log.HTTPMiddleware) // the same as the server, which wraps the writer
+			hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+			svr := httptest.NewServer(hdl)
+			defer svr.Close()
+
+			res, err := http.Get(svr.URL + "/test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if !reflect.DeepEqual(res.TransferEncoding, test.want) {
+				t.Errorf("have: %v want: %v", res.TransferEncoding, test.want)
+			}
+			if test.chunked && res.ContentLength != -1 {
+				t.Errorf("have: %d want: %d", res.ContentLength, -1)
+			}
+			if have := string(body); have != test.body {
+				t.Errorf("have: %d bytes want: %d bytes", len(have), len(test.body))
+			}
+		})
+	}
+}
+
+func TestServerDelayProfile(t *testing.T) {
+	var connect, ttfb, transfer = "30ms", "50ms", "100ms"
+	var body = strings.Repeat("x", 100)
+
+	req := RequestHTTP{
+		Method: "get",
+		Response: []ResponseHTTP{{
+			Status:        "200",
+			Body:          attr(body),
+			ConnectDelay:  &connect,
+			TTFBDelay:     &ttfb,
+			TransferDelay: &transfer,
+		}},
+	}
+
+	hdl := chi.NewRouter()
+	hdl.Use(log.HTTPMiddleware) // the same as the server, which wraps the writer
+	hdl.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+	svr := httptest.NewServer(hdl)
+	defer svr.Close()
+
+	start := time.Now()
+	res, err := http.Get(svr.URL + "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := time.Since(start)
+
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	transferred := time.Since(start) - headers
+
+	if want := delay(connect) + delay(ttfb); headers < want {
+		t.Errorf("headers have: %v want: at least %v", headers, want)
+	}
+	if want := delay(transfer); transferred < want {
+		t.Errorf("transfer have: %v want: at least %v", transferred, want)
+	}
+	if have := string(b); have != body {
+		t.Errorf("have: %q want: %q", have, body)
+	}
+	if res.ContentLength != int64(len(body)) {
+		t.Errorf("have: %d want: %d", res.ContentLength, len(body))
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	var tests = []struct {
+		name   string
+		valid  bool
+		status int
+		want   string
+	}{
+		{name: "valid config", valid: true, status: http.StatusOK, want: "ok"},
+		{name: "failed reload", valid: false, status: http.StatusServiceUnavailable, want: "stale config"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var config Config
+			config.internal.svrStart = time.Now().Add(-time.Minute)
+			config.internal.svrCfgLoad = time.Now()
+			config.internal.svrCfgLoadValid = test.valid
+
+			w := httptest.NewRecorder()
+			healthHandler(&config).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_internal/health", nil))
+
+			if w.Code != test.status {
+				t.Errorf("have: %d want: %d", w.Code, test.status)
+			}
+
+			var have serverHealth
+			if err := json.NewDecoder(w.Body).Decode(&have); err != nil {
+				t.Fatal(err)
+			}
+			if have.Status != test.want || have.ConfigValid != test.valid {
+				t.Errorf("have: %q %t want: %q %t", have.Status, have.ConfigValid, test.want, test.valid)
+			}
+			if have.Uptime != "1m0s" || !have.Started.Equal(config.internal.svrStart) || !have.ConfigLoad.Equal(config.internal.svrCfgLoad) {
+				t.Errorf("have: %+v want: the uptime and timestamps", have)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultJournalLimit is the number of requests kept in the journal
+var DefaultJournalLimit = 100
+
+// journalRedacted is the value that replaces redacted JSON fields
+const journalRedacted = "[REDACTED]"
+
+// journalUnparsed replaces a body that can't be redacted, because it
+// isn't JSON or it was cut off by the body limit
+const journalUnparsed = "[unparsed body omitted]"
+
+// journalEntry is a single request that is stored in the journal
+type journalEntry struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Query  string    `json:"query,omitempty"`
+	Body   string    `json:"body,omitempty"`
+}
+
+// journal keeps the most recent requests so that
+// they can be checked at /_internal/server/journal
+type journal struct {
+	sync.Mutex
+
+	limit   int
+	capture bool
+	redact  [][]string
+
+	entries []journalEntry
+}
+
+// newJournal returns a journal using the system journal config
+func newJournal(cfg systemJournal) *journal {
+	jr := &journal{limit: DefaultJournalLimit, capture: cfg.CaptureBody}
+	if cfg.Limit != nil {
+		jr.limit = *cfg.Limit
+	}
+	for _, path := range cfg.Redact {
+		jr.redact = append(jr.redact, strings.Split(path, "."))
+	}
+	return jr
+}
+
+// middleware records each request to the journal, the body
+// is put back so it can be read again by the request handler
+func (jr *journal) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/_internal/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entry := journalEntry{
+			Time:   time.Now(),
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.RawQuery,
+		}
+
+		if jr.capture && r.Body != nil {
+			body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20)) // 1MB limit
+			log.OnErr(err).Printf("[journal] reading body: %v", err)
+			r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			entry.Body = jr.redactBody(body)
+		}
+
+		jr.Lock()
+		jr.entries = append(jr.entries, entry)
+		if over := len(jr.entries) - jr.limit; over > 0 {
+			jr.entries = jr.entries[over:]
+		}
+		jr.Unlock()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handler returns all of the requests in the journal as JSON
+func (jr *journal) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jr.Lock()
+		entries := make([]journalEntry, len(jr.entries))
+		copy(entries, jr.entries)
+		jr.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(entries)
+		log.OnErr(err).Printf("[journal] writing entries: %v", err)
+	}
+}
+
+// redactBody replaces the values of the redacted paths in a JSON
+// body. A body that can't be parsed is omitted when there are redacted
+// paths, so the values can't be stored unredacted.
+func (jr *journal) redactBody(body []byte) string {
+	if len(jr.redact) == 0 || len(body) == 0 {
+		return string(body)
+	}
+
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return journalUnparsed
+	}
+
+	for _, path := range jr.redact {
+		redactPath(doc, path)
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return journalUnparsed
+	}
+	return string(b)
+}
+
+// redactPath replaces the value at the path, the path is
+// applied to each item when an array is found along the way
+func redactPath(doc interface{}, path []string) {
+	switch v := doc.(type) {
+	case []interface{}:
+		for _, item := range v {
+			redactPath(item, path)
+		}
+	case map[string]interface{}:
+		val, ok := v[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) == 1 {
+			v[path[0]] = journalRedacted
+			return
+		}
+		redactPath(val, path[1:])
+	}
+}
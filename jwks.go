@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+)
+
+// jwk is a single public JSON Web Key, only the fields for the key
+// type are used, i.e. n and e for RSA keys, crv, x and y for EC keys
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// jwks is the JSON Web Key Set served at /.well-known/jwks.json
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwtKeyID returns the configured kid, or a stable kid for the signing key.
+// It's the SHA-256 of the public key (or the secret bytes) so the kid in a
+// token header matches the kid in the JWKS.
+func jwtKeyID(cfg *configJWT, key interface{}) string {
+	if cfg != nil && cfg.KeyID != "" {
+		return cfg.KeyID
+	}
+
+	var b []byte
+	switch k := key.(type) {
+	case []byte:
+		b = k
+	case *rsa.PrivateKey:
+		b, _ = x509.MarshalPKIXPublicKey(&k.PublicKey)
+	case *ecdsa.PrivateKey:
+		b, _ = x509.MarshalPKIXPublicKey(&k.PublicKey)
+	case ed25519.PrivateKey:
+		b, _ = x509.MarshalPKIXPublicKey(k.Public())
+	default:
+		return ""
+	}
+
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// publicJWK returns the public JWK of a signing key, HS secrets
+// are not public so they return false
+func publicJWK(cfg *configJWT, key interface{}) (jwk, bool) {
+	var b64 = base64.RawURLEncoding.EncodeToString
+	var out = jwk{Use: "sig", Kid: jwtKeyID(cfg, key), Alg: cfg.Alg}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		out.Kty = "RSA"
+		out.N = b64(k.N.Bytes())
+		out.E = b64(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PrivateKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		out.Kty = "EC"
+		out.Crv = k.Curve.Params().Name
+		out.X = b64(k.X.FillBytes(make([]byte, size)))
+		out.Y = b64(k.Y.FillBytes(make([]byte, size)))
+	case ed25519.PrivateKey:
+		out.Kty = "OKP"
+		out.Crv = "Ed25519"
+		out.X = b64(k.Public().(ed25519.PublicKey))
+	default:
+		return out, false
+	}
+	return out, true
+}
+
+// serverJWKS returns the public keys of all of the servers
+// that sign JWT tokens with a private key
+func serverJWKS(servers []ConfigHTTP) jwks {
+	var set = jwks{Keys: []jwk{}}
+	for _, server := range servers {
+		if server.JWT == nil || server.JWT.Key == nil {
+			continue
+		}
+		if key, ok := publicJWK(server.JWT, useJWT(server)); ok {
+			set.Keys = append(set.Keys, key)
+		}
+	}
+	return set
+}
+
+// jwksHandler serves the public keys of the configured JWT
+// signing keys so clients can validate the tokens that are sent
+func jwksHandler(set jwks) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(set)
+		log.OnErr(err).Printf("[jwks] writing keys: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+)
+
+func TestJWTKeyID(t *testing.T) {
+	secret := []byte("the secret string")
+	sum := sha256.Sum256(secret)
+
+	var tests = []struct {
+		name string
+		cfg  *configJWT
+		want string
+	}{
+		{name: "configured", cfg: &configJWT{Name: "auth", Alg: "HS256", KeyID: "key-1"}, want: "key-1"},
+		{name: "derived", cfg: &configJWT{Name: "auth", Alg: "HS256"}, want: base64.RawURLEncoding.EncodeToString(sum[:])},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := marshalJWT(test.cfg, &responseJWT{Name: "auth", Subject: attr("sub 1"), Payload: map[string]string{}}, secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var header map[string]interface{}
+			b, err := jwtgo.DecodeSegment(strings.Split(token, ".")[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(b, &header); err != nil {
+				t.Fatal(err)
+			}
+			if have := header["kid"]; have != test.want {
+				t.Errorf("have: %v want: %v", have, test.want)
+			}
+		})
+	}
+}
+
+func TestServerJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})
+
+	servers := []ConfigHTTP{
+		{Name: "rs", JWT: &configJWT{Name: "rs", Alg: "RS256", Key: attr(string(rsaPEM))}},
+		{Name: "es", JWT: &configJWT{Name: "es", Alg: "ES256", Key: attr(string(ecPEM))}},
+		{Name: "hs", JWT: &configJWT{Name: "hs", Alg: "HS256", Secret: attr("the secret")}},
+		{Name: "none"},
+	}
+
+	w := httptest.NewRecorder()
+	jwksHandler(serverJWKS(servers)).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+
+	var set jwks
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 2 {
+		t.Fatalf("have: %d want: %d", len(set.Keys), 2)
+	}
+
+	var tests = []struct {
+		name string
+		cfg  *configJWT
+		key  interface{}
+		jwk  jwk
+		pub  func(jwk) interface{}
+	}{
+		{
+			name: "rsa",
+			cfg:  servers[0].JWT,
+			key:  rsaKey,
+			jwk:  set.Keys[0],
+			pub: func(k jwk) interface{} {
+				n, _ := base64.RawURLEncoding.DecodeString(k.N)
+				e, _ := base64.RawURLEncoding.DecodeString(k.E)
+				return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			},
+		},
+		{
+			name: "ec",
+			cfg:  servers[1].JWT,
+			key:  ecKey,
+			jwk:  set.Keys[1],
+			pub: func(k jwk) interface{} {
+				x, _ := base64.RawURLEncoding.DecodeString(k.X)
+				y, _ := base64.RawURLEncoding.DecodeString(k.Y)
+				return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.jwk.Alg != test.cfg.Alg || test.jwk.Use != "sig" {
+				t.Errorf("have: %s/%s want: %s/sig", test.jwk.Alg, test.jwk.Use, test.cfg.Alg)
+			}
+
+			token, err := marshalJWT(test.cfg, &responseJWT{Name: test.cfg.Name, Subject: attr("sub 1"), Payload: map[string]string{}}, test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tkn, err := jwtgo.Parse(token, func(*jwtgo.Token) (interface{}, error) { return test.pub(test.jwk), nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have := tkn.Header["kid"]; have != test.jwk.Kid {
+				t.Errorf("have: %v want: %v", have, test.jwk.Kid)
+			}
+		})
+	}
+}
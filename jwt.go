@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/subtle"
 	"crypto/x509"
@@ -16,6 +18,8 @@ import (
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hclsyntax"
 	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
 )
 
 // context keys for JWT token information that's stored
@@ -23,6 +27,8 @@ import (
 const (
 	CtxKeyJWTToken  ctxKey = "_jwt_token_" // the parsed JWT token
 	CtxKeySignature ctxKey = "_sig_"       // the secret bytes (HMAC bytes or RSA bytes)
+
+	CtxKeyOnInvalidJWT ctxKey = "_on_invalid_jwt_" // the server on_invalid_jwt responses
 )
 
 // jwtSigMap a map of supported JWT signature types with the methods
@@ -43,6 +49,72 @@ var jwtSigMap = map[string]jwtgo.SigningMethod{
 	jwtgo.SigningMethodPS256.Name: jwtgo.SigningMethodPS256,
 	jwtgo.SigningMethodPS384.Name: jwtgo.SigningMethodPS384,
 	jwtgo.SigningMethodPS512.Name: jwtgo.SigningMethodPS512,
+
+	SigningMethodEdDSA.Alg(): SigningMethodEdDSA,
+}
+
+// SigningMethodEdDSA signs and validates JWT tokens with an Ed25519
+// key, the version of jwt-go that is used doesn't have EdDSA
+var SigningMethodEdDSA = &signingMethodEd25519{}
+
+func init() {
+	jwtgo.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwtgo.SigningMethod { return SigningMethodEdDSA })
+}
+
+// signingMethodEd25519 is the EdDSA signing method
+type signingMethodEd25519 struct{}
+
+func (m *signingMethodEd25519) Alg() string { return "EdDSA" }
+
+// Verify checks the signature using the public key, or
+// the public key of a private key
+func (m *signingMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	var pub ed25519.PublicKey
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		pub = k
+	case ed25519.PrivateKey:
+		pub = k.Public().(ed25519.PublicKey)
+	default:
+		return jwtgo.ErrInvalidKeyType
+	}
+
+	sig, err := jwtgo.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, []byte(signingString), sig) {
+		return jwtgo.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// Sign returns the encoded signature using the private key
+func (m *signingMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwtgo.ErrInvalidKeyType
+	}
+	return jwtgo.EncodeSegment(ed25519.Sign(k, []byte(signingString))), nil
+}
+
+// parseEdPrivateKeyFromPEM parses a PKCS8 PEM encoded Ed25519 private key
+func parseEdPrivateKeyFromPEM(key []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, jwtgo.ErrKeyMustBePEMEncoded
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	pk, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, jwtgo.ErrInvalidKeyType
+	}
+	return pk, nil
 }
 
 // useJWT sets up a JWT token based off the configuration supplied
@@ -89,7 +161,15 @@ func useJWT(server ConfigHTTP) interface{} {
 			panic(fmt.Errorf("[jwt] getting RS key: %v", dia))
 		}
 	case "ed":
-		panic("[jwt] using a EdDSA key is unsupported")
+		if val, dia := server.JWT.Key.Expr.Value(&bodyEvalCtx); !dia.HasErrors() {
+			signKey, err := parseEdPrivateKeyFromPEM([]byte(val.AsString()))
+			if err != nil {
+				panic(fmt.Errorf("[jwt] parsing EdDSA key: %v", err))
+			}
+			sigKey = signKey
+		} else {
+			panic(fmt.Errorf("[jwt] getting EdDSA key: %v", dia))
+		}
 	}
 
 	return sigKey
@@ -138,6 +218,10 @@ func decodeJWT(w http.ResponseWriter, r *http.Request, reqJWT *requestJWT) (toke
 				return k, nil
 			case *rsa.PrivateKey:
 				return k, nil
+			case ed25519.PrivateKey:
+				return k.Public(), nil
+			case ed25519.PublicKey:
+				return k, nil
 			}
 			return nil, fmt.Errorf("invalid key")
 		})
@@ -168,6 +252,71 @@ func decodeJWT(w http.ResponseWriter, r *http.Request, reqJWT *requestJWT) (toke
 	return token, err
 }
 
+// invalidJWTHandler returns the on_invalid_jwt responses for a request, the
+// request responses are used before the server responses. A nil handler is
+// returned when there are no responses.
+func invalidJWTHandler(r *http.Request, req RequestHTTP) http.Handler {
+	if req.onInvalidJWT != nil {
+		return req.onInvalidJWT
+	}
+	if hdlr, ok := r.Context().Value(CtxKeyOnInvalidJWT).(http.Handler); ok {
+		return hdlr
+	}
+	return nil
+}
+
+// JWTSignToStr takes in the request context and returns a HCL function that
+// signs the claims with the named server JWT config, so a token can be used
+// anywhere in a body, i.e. { token = jwt_sign("auth", { sub = "me" }) }
+func JWTSignToStr(ctx context.Context) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{
+				Name: "name",
+				Type: cty.String,
+			},
+			{
+				Name: "claims",
+				Type: cty.DynamicPseudoType,
+			},
+		},
+		Type: function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+			cfgJWT, ok := ctx.Value(ctxKey(args[0].AsString())).(*configJWT)
+			if !ok {
+				return cty.StringVal(""), ErrJWTConfigurationNotFound
+			}
+
+			algo, ok := jwtSigMap[cfgJWT.Alg]
+			if !ok {
+				return cty.StringVal(""), ErrMarshalJWT.F(fmt.Errorf("no algo found"))
+			}
+
+			b, err := ctyjson.SimpleJSONValue{Value: args[1]}.MarshalJSON()
+			if err != nil {
+				return cty.StringVal(""), ErrMarshalJWT.F(err)
+			}
+
+			claims := jwtgo.MapClaims{}
+			if err := json.Unmarshal(b, &claims); err != nil {
+				return cty.StringVal(""), ErrMarshalJWT.F(err)
+			}
+
+			key := ctx.Value(CtxKeySignature)
+			token := jwtgo.NewWithClaims(algo, claims)
+			if kid := jwtKeyID(cfgJWT, key); kid != "" {
+				token.Header["kid"] = kid
+			}
+
+			signed, err := token.SignedString(key)
+			if err != nil {
+				return cty.StringVal(""), ErrMarshalJWT.F(err)
+			}
+			return cty.StringVal(signed), nil
+		},
+	})
+}
+
 // marshalJWT takes a JWT response struct and returns a JWT string with all
 // of the values passed though HCL contexts
 func marshalJWT(cfgJWT *configJWT, respJWT *responseJWT, key interface{}) (string, error) {
@@ -183,11 +332,26 @@ func marshalJWT(cfgJWT *configJWT, respJWT *responseJWT, key interface{}) (strin
 				},
 			)
 			respJWT.Payload["$._internal."+cfgJWT.Name+".key"] = string(b)
+		case ed25519.PrivateKey:
+			der, err := x509.MarshalPKCS8PrivateKey(k)
+			if err != nil {
+				return "", err
+			}
+			b := pem.EncodeToMemory(
+				&pem.Block{
+					Type:  "PRIVATE KEY",
+					Bytes: der,
+				},
+			)
+			respJWT.Payload["$._internal."+cfgJWT.Name+".key"] = string(b)
 		}
 	}
 
 	if algo, ok := jwtSigMap[cfgJWT.Alg]; ok {
 		token := jwtgo.NewWithClaims(algo, respJWT)
+		if kid := jwtKeyID(cfgJWT, key); kid != "" {
+			token.Header["kid"] = kid
+		}
 		return token.SignedString(key)
 	}
 
@@ -236,6 +400,9 @@ func (r *responseJWT) MarshalJSON() (b []byte, err error) {
 			}
 			name := val.Type().Field(i).Tag.Get("json")
 			val, _ := a.Expr.Value(r._ctx)
+			if a == r.Expiration {
+				val = cty.NumberIntVal(r.expiresAt()) // allows duration strings
+			}
 			b = append(b, fmt.Sprintf("%q:", name)...)
 			switch vt := val.Type(); vt {
 			case cty.String:
@@ -283,9 +450,7 @@ func (r *responseJWT) Valid() error {
 	// The claims below are optional, by default, so if they are set to the
 	// default value in Go, let's not fail the verification for them.
 	if !r.VerifyExpiresAt(now, false) {
-		useImpliedZeroIndex(r.Expiration)
-		num, _ := r.Expiration.Expr.Value(r._ctx)
-		expiresAt, _ := num.AsBigFloat().Int64()
+		expiresAt := r.expiresAt()
 		delta := time.Unix(now, 0).Sub(time.Unix(expiresAt, 0))
 		vErr.Inner = fmt.Errorf("token is expired by %v", delta)
 		vErr.Errors |= jwtgo.ValidationErrorExpired
@@ -318,10 +483,27 @@ func (r *responseJWT) VerifyAudience(cmp string, req bool) bool {
 // Compares the exp claim against cmp.
 // If required is false, this method will return true if the value matches or is unset
 func (r *responseJWT) VerifyExpiresAt(cmp int64, req bool) bool {
+	return verifyExp(r.expiresAt(), cmp, req)
+}
+
+// expiresAt returns the exp claim as a unix time, a duration
+// string, i.e. exp = "15m" is the time from now
+func (r *responseJWT) expiresAt() int64 {
 	useImpliedZeroIndex(r.Expiration)
-	num, _ := r.Expiration.Expr.Value(r._ctx)
-	exp, _ := num.AsBigFloat().Int64()
-	return verifyExp(exp, cmp, req)
+	val, _ := r.Expiration.Expr.Value(r._ctx)
+	if val.Type() == cty.String {
+		dur, err := time.ParseDuration(val.AsString())
+		if err != nil {
+			log.Printf("[jwt] parse exp duration: %v", err)
+			return 0
+		}
+		return jwtgo.TimeFunc().Add(dur).Unix()
+	}
+	if val.Type() != cty.Number {
+		return 0
+	}
+	exp, _ := val.AsBigFloat().Int64()
+	return exp
 }
 
 // Compares the iat claim against cmp.
@@ -21,6 +21,9 @@ import (
 // _runtimePath the name of the path that we use to base file loads on
 var _runtimePath string
 
+// _featureScript allows request script blocks to run, scripts are off by default
+var _featureScript bool
+
 // log is the global logger used to log info
 var log = logger.New(logger.WithTimeFormat("2006/01/02 15:04:05 -"))
 
@@ -53,15 +56,34 @@ func (flgs *cfgFiles) Set(value string) error {
 	return nil
 }
 
+// cfgDirs adds directories to the config files, the .hcl and .json files
+// in them are loaded and files that are added or removed cause a reload
+type cfgDirs struct{ files *cfgFiles }
+
+func (flgs cfgDirs) String() string {
+	return "config directories"
+}
+
+func (flgs cfgDirs) Set(value string) error {
+	if fi, err := os.Stat(value); err != nil || !fi.IsDir() {
+		return fmt.Errorf("%q is not a directory", value)
+	}
+	return flgs.files.Set(value)
+}
+
 var configFiles cfgFiles
 
 // main starts everything
 func main() {
 	var logDir, pluginDir string
+	var noWatch bool
 
-	flag.Var(&configFiles, "config", "the config files to load")
+	flag.Var(&configFiles, "config", "the config files, or directories of config files, to load")
+	flag.Var(cfgDirs{&configFiles}, "config-dir", "a directory of config files to load and watch for added or removed files")
 	flag.StringVar(&logDir, "log-dir", "log", "the path to the log directory")
 	flag.StringVar(&pluginDir, "plugin-dir", "./plugins/obj", "the path to where .so plugins are stored")
+	flag.BoolVar(&_featureScript, "enable-script", false, "allow request script blocks to run")
+	flag.BoolVar(&noWatch, "no-watch", false, "do not reload when the config files change")
 
 	flag.Parse()
 
@@ -71,7 +93,7 @@ func main() {
 	}
 	_runtimePath = dir
 
-	log.Println(run(configFiles, logDir, pluginDir))
+	log.Println(run(configFiles, logDir, pluginDir, func(config *Config) { config.internal.noWatch = noWatch }))
 }
 
 func passedFlag(name string) (found bool) {
@@ -128,7 +150,6 @@ func run(configFiles []string, logDir string, pluginDir string, opts ...RunOptio
 		log.Println("[server] SKIPPING logging of reload and panic errors")
 	}
 
-	config.reload = _reload(config)
 	config.shutdown = _shutdown(config)
 
 	mgr := new(reloadSliceManager)
@@ -139,16 +160,32 @@ func run(configFiles []string, logDir string, pluginDir string, opts ...RunOptio
 		config.Servers, config.Routes = mgr.nil() // send back nil, so these are clean to decode into
 
 		log.Printf("[server] loading the config files: %s ...", config.internal.files)
-		if err := decodeFile(config.internal.files, _context(), &config); err != nil {
+		err := decodeFile(config.internal.files, _context(), &config)
+		if err == nil {
+			if diags := validateConfig(config); diags.HasErrors() {
+				err = diags
+			}
+		}
+		if err != nil {
 			if !mgr.isReload() {
 				log.Fatalf("cannot start server(s): %v", err)
 			}
 			re.save(config, err, "reload")
 			config.internal.svrCfgLoadValid = false
 			config.Servers, config.Routes = mgr.get() // add the old copy back
+		} else if config.System != nil && config.System.FixturesDir != nil {
+			log.Printf("[server] loading the fixtures dir: %s ...", *config.System.FixturesDir)
+			routes, err := loadFixtures(config.internal.os, *config.System.FixturesDir)
+			log.OnErr(err).Printf("[server] fixtures: %v", err)
+			config.Routes = append(config.Routes, routes...)
 		}
 		mgr.del() // remove old copy
 
+		// start watching after the first load, so the system options are known
+		if config.reload == nil {
+			config.reload = _reload(config)
+		}
+
 		// setup any external plugin
 		if runtime.GOOS != "windows" { // we don't support external plugins on "windows"
 			if _, err := os.Stat(pluginDir); !os.IsNotExist(err) {
@@ -205,6 +242,7 @@ func run(configFiles []string, logDir string, pluginDir string, opts ...RunOptio
 		case <-config.reload:
 			config.shutdown <- struct{}{}
 			config.reloadDrain(shutdown)
+			closeProxyTransports() // the reloaded proxy configs get new transports
 			config.internal.svrCfgLoad = time.Now()
 			config.internal.svrCfgLoadValid = true
 			if len(shutdownPlugins) > 0 {
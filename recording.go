@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// the proxy modes, passthrough is used when there is no mode
+const (
+	ProxyModePassthrough = "passthrough"
+	ProxyModeRecord      = "record"
+	ProxyModeReplay      = "replay"
+)
+
+// DefaultProxyFixturesDir is the directory, in the runtime path,
+// where the proxy recordings are saved when there is no fixtures_dir
+var DefaultProxyFixturesDir = "proxy_fixtures"
+
+// proxyRecording is a proxied response that is saved to disk
+type proxyRecording struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// proxyRecordingFile returns the recording filename for the request, keyed
+// by the method, the path with the query and the hash of the body. The
+// request body is restored so it can still be proxied.
+func proxyRecordingFile(r *http.Request, proxy *configProxy) (string, error) {
+	body, err := readBody(r)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	h.Write(body)
+
+	dir := DefaultProxyFixturesDir
+	if proxy.FixturesDir != nil {
+		dir = *proxy.FixturesDir
+	}
+	return filepath.Join(runtimeFilePath(dir), r.Method+"_"+hex.EncodeToString(h.Sum(nil))[:32]+".rec"), nil
+}
+
+// recordProxy returns a ReverseProxy ModifyResponse func that saves the
+// upstream response to the file, the body is kept for the client
+func recordProxy(filename string) func(*http.Response) error {
+	return func(res *http.Response) error {
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		b, err := json.MarshalIndent(proxyRecording{Status: res.StatusCode, Header: res.Header, Body: body}, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		err = os.MkdirAll(filepath.Dir(filename), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(filename, b, 0644)
+		}
+		if !log.OnErr(err).Printf("[http] [proxy] saving the recording %s: %v", filename, err).HasErr() {
+			log.Printf("[http] [proxy] recorded %d to %s ...", res.StatusCode, filename)
+		}
+		return nil // the client still gets the response
+	}
+}
+
+// replayProxy writes the saved response from the file, a missing
+// recording is a 502 as there isn't an upstream to send it to
+func replayProxy(w http.ResponseWriter, filename string) {
+	b, err := ioutil.ReadFile(filename)
+	if log.OnErr(err).Printf("[http] [proxy] reading the recording %s: %v", filename, err).HasErr() {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	var rec proxyRecording
+	if err := json.Unmarshal(b, &rec); err != nil {
+		log.Printf("[http] [proxy] parsing the recording %s: %v", filename, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	log.Printf("[http] [proxy] replaying %d from %s ...", rec.Status, filename)
+	for k, vals := range rec.Header {
+		for _, val := range vals {
+			w.Header().Add(k, val)
+		}
+	}
+	w.WriteHeader(rec.Status)
+	w.Write(rec.Body)
+}
@@ -8,18 +8,36 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/afero"
 )
 
+// DefaultReloadDebounce is how long the watcher waits after the last
+// write event before reloading, editors can write a file many times
+var DefaultReloadDebounce = "100ms"
+
 // _reload stats a watcher that will collect file access
 // requests and gracefully shutdown the server and restart
-// it after file access is deteremined
+// it after file access is deteremined. A config directory is
+// watched for .hcl and .json files being added or removed. The
+// watcher is skipped when using the -no-watch flag or the system
+// no_watch option.
 func _reload(config Config) chan struct{} {
 	reload := make(chan struct{}, 1)
 
+	if config.internal.noWatch || (config.System != nil && config.System.NoWatch) {
+		log.Println("[server] SKIPPING the config file watcher")
+		return reload
+	}
+
+	window := DefaultReloadDebounce
+	if config.System != nil && config.System.ReloadDebounce != nil {
+		window = *config.System.ReloadDebounce
+	}
+
 	go func() {
 		watcher, err := fsnotify.NewWatcher()
 		if log.OnErr(err).Printf("[server] setting up watcher: %v", err).HasErr() {
@@ -32,15 +50,23 @@ func _reload(config Config) chan struct{} {
 			log.OnErr(err).Printf("[server] adding watcher: %v", err)
 		}
 
+		var debounce <-chan time.Time // only reload once writes have stopped
 		for {
 			select {
 			case event, ok := <-watcher.Events:
 				if !ok {
 					return
 				}
-				if event.Op&fsnotify.Write == fsnotify.Write {
-					reload <- struct{}{}
+				if !isConfigFile(event.Name) {
+					continue // i.e. editor swap files in a watched directory
+				}
+				// files added to or removed from a watched directory are included
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+					debounce = time.After(delay(window))
 				}
+			case <-debounce:
+				debounce = nil
+				reload <- struct{}{}
 			case err, ok := <-watcher.Errors:
 				if !ok {
 					return
@@ -111,6 +137,26 @@ func (re reloadError) save(config Config, save error, kind string) {
 	fmt.Fprintf(f, reloadErrorSaveOut, time.Now().Format(time.RFC1123Z), kind, save)
 }
 
+// violationCount makes the contract violation file names unique
+var violationCount uint64
+
+// saveViolation saves a proxy contract violation, violations can happen many
+// times a second so the file names are unique and a file error isn't fatal
+func (re reloadError) saveViolation(config Config, save error) {
+	if config.System == nil || config.System.LogDir == nil {
+		return // skip logging...
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("%d.%09d.%d-contract.txt", now.Unix(), now.Nanosecond(), atomic.AddUint64(&violationCount, 1))
+	f, err := re.os.OpenFile(filepath.Join(*config.System.LogDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if log.OnErr(err).Printf("[proxy] [contract] cannot open file to save the violation: %v", err).HasErr() {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, reloadErrorSaveOut, now.Format(time.RFC1123Z), "contract", save)
+}
+
 // zeroOrGreater return a number that is 0 or greater, and negative
 // rnumbers are ounded up to zero
 func (re reloadError) zeroOrGreater(i int) int {
@@ -181,7 +227,7 @@ func (re reloadError) handler(config *Config) http.HandlerFunc {
 		// TODO(njones): sanitize the logDir path
 		var files []string
 		afero.Walk(re.os, *config.System.LogDir, func(path string, info os.FileInfo, err error) error {
-			if strings.HasSuffix(path, "-reload.txt") || strings.HasSuffix(path, "-panix.txt") {
+			if strings.HasSuffix(path, "-reload.txt") || strings.HasSuffix(path, "-panix.txt") || strings.HasSuffix(path, "-contract.txt") {
 				files = append(files, path) // just save the file path, because we're gonna sort them...
 			}
 			return nil
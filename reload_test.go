@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestReloadNoWatch(t *testing.T) {
+	var tests = []struct {
+		name    string
+		noWatch bool
+		system  *system
+		want    bool
+	}{
+		{name: "watch", want: true},
+		{name: "no-watch flag", noWatch: true, want: false},
+		{name: "no_watch option", system: &system{NoWatch: true}, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "test.hcl")
+			if err := ioutil.WriteFile(filename, []byte(`version = "0.0.1"`), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var config Config
+			config.System = test.system
+			config.internal.files = []string{filename}
+			config.internal.noWatch = test.noWatch
+
+			reload := _reload(config)
+			time.Sleep(50 * time.Millisecond) // let the watcher start
+
+			if err := ioutil.WriteFile(filename, []byte(`version = "0.0.2"`), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var have bool
+			select {
+			case <-reload:
+				have = true
+			case <-time.After(500 * time.Millisecond):
+			}
+
+			if have != test.want {
+				t.Errorf("have: %t want: %t", have, test.want)
+			}
+		})
+	}
+}
+
+func TestReloadDebounce(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.hcl")
+	if err := ioutil.WriteFile(filename, []byte(`version = "0.0.1"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	window := "200ms"
+
+	var config Config
+	config.System = &system{ReloadDebounce: &window}
+	config.internal.files = []string{filename}
+
+	reload := _reload(config)
+	time.Sleep(50 * time.Millisecond) // let the watcher start
+
+	// write the same way an editor would, many times quickly
+	for i := 0; i < 5; i++ {
+		if err := ioutil.WriteFile(filename, []byte(`version = "0.0.2"`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	var have int
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case <-reload:
+			have++
+		case <-timeout:
+			done = true
+		}
+	}
+
+	if have != 1 {
+		t.Errorf("have: %d want: %d", have, 1)
+	}
+}
+
+func TestReloadDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.hcl"), []byte(`path "/a" {}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var config Config
+	config.internal.files = []string{dir}
+
+	reload := _reload(config)
+	time.Sleep(50 * time.Millisecond) // let the watcher start
+
+	// not a config file, so it should not reload
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.hcl.swp"), []byte(`swap`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.hcl"), []byte(`path "/b" {}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-reload:
+	case <-time.After(time.Second):
+		t.Fatal("have: no reload want: a reload")
+	}
+
+	var loaded Config
+	if err := decodeFile(config.internal.files, _context(), &loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	var have []string
+	for _, route := range loaded.Routes {
+		have = append(have, route.Path)
+	}
+	if len(have) != 2 || have[0] != "/a" || have[1] != "/b" {
+		t.Errorf("have: %q want: %q", have, []string{"/a", "/b"})
+	}
+}
+
+func TestReloadConfigDirFlag(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.hcl")
+	if err := ioutil.WriteFile(file, []byte(`path "/a" {}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{name: "directory", value: dir},
+		{name: "file", value: file, wantErr: true},
+		{name: "missing", value: filepath.Join(dir, "missing"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var files cfgFiles
+			err := cfgDirs{&files}.Set(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("have: %v want error: %t", err, test.wantErr)
+			}
+			if !test.wantErr && (len(files) != 1 || files[0] != test.value) {
+				t.Errorf("have: %q want: %q", files, []string{test.value})
+			}
+		})
+	}
+}
+
+func TestReloadErrorSaveViolation(t *testing.T) {
+	logDir := "/logs"
+	config := Config{System: &system{LogDir: &logDir}}
+
+	fs := afero.NewMemMapFs()
+	re := reloadError{os: fs}
+	for i := 0; i < 3; i++ {
+		re.saveViolation(config, fmt.Errorf("violation %d", i))
+	}
+
+	files, err := afero.ReadDir(fs, logDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("have: %d files want: %d", len(files), 3)
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), "-contract.txt") {
+			t.Errorf("have: %q want: a -contract.txt file", file.Name())
+		}
+	}
+
+	re = reloadError{os: afero.NewReadOnlyFs(fs)}
+	re.saveViolation(config, fmt.Errorf("violation")) // logs the error instead of exiting
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultStatsSamples is the number of the most recent response
+// durations of each route that are kept for the latency percentiles
+var DefaultStatsSamples = 1000
+
+// routeStat holds the request metrics of a single route
+type routeStat struct {
+	count     uint64
+	statuses  map[int]uint64
+	durations []time.Duration // a ring of the most recent durations
+	next      int
+}
+
+// routeStatJSON is the route metrics that are sent from /_internal/server/stats
+type routeStatJSON struct {
+	Count     uint64             `json:"count"`
+	Statuses  map[int]uint64     `json:"statuses"`
+	LatencyMS map[string]float64 `json:"latency_ms"`
+}
+
+// routeStats keeps the metrics of each route, keyed by the method and path
+type routeStats struct {
+	sync.Mutex
+
+	routes map[string]*routeStat
+}
+
+// newRouteStats returns an empty route stats registry
+func newRouteStats() *routeStats {
+	return &routeStats{routes: make(map[string]*routeStat)}
+}
+
+// record adds a request with the status and how long it took to the route
+func (rs *routeStats) record(key string, status int, took time.Duration) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	stat, ok := rs.routes[key]
+	if !ok {
+		stat = &routeStat{statuses: make(map[int]uint64)}
+		rs.routes[key] = stat
+	}
+
+	stat.count++
+	stat.statuses[status]++
+	if len(stat.durations) < DefaultStatsSamples {
+		stat.durations = append(stat.durations, took)
+		return
+	}
+	stat.durations[stat.next] = took
+	stat.next = (stat.next + 1) % len(stat.durations)
+}
+
+// middleware records the status and duration of each request to the route
+func (rs *routeStats) middleware(key string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sw := &statusWriter{ResponseWriter: w}
+			start := time.Now()
+			next.ServeHTTP(sw, r)
+
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			rs.record(key, status, time.Since(start))
+		})
+	}
+}
+
+// snapshot returns the metrics of all of the routes
+func (rs *routeStats) snapshot() map[string]routeStatJSON {
+	rs.Lock()
+	defer rs.Unlock()
+
+	var stats = make(map[string]routeStatJSON, len(rs.routes))
+	for key, stat := range rs.routes {
+		statuses := make(map[int]uint64, len(stat.statuses))
+		for k, v := range stat.statuses {
+			statuses[k] = v
+		}
+
+		durations := make([]time.Duration, len(stat.durations))
+		copy(durations, stat.durations)
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+		stats[key] = routeStatJSON{
+			Count:    stat.count,
+			Statuses: statuses,
+			LatencyMS: map[string]float64{
+				"p50": percentile(durations, 50).Seconds() * 1000,
+				"p90": percentile(durations, 90).Seconds() * 1000,
+				"p99": percentile(durations, 99).Seconds() * 1000,
+			},
+		}
+	}
+	return stats
+}
+
+// percentile returns the nearest-rank percentile of the sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100 // the ceiling of p/100 * n
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// statusWriter captures the status that is sent, it's looked
+// through by the hijacker and flusher like the logger writer
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+
+	var tests = []struct {
+		name   string
+		sorted []time.Duration
+		p      int
+		want   time.Duration
+	}{
+		{name: "empty", p: 50, want: 0},
+		{name: "single", sorted: sorted[:1], p: 99, want: time.Millisecond},
+		{name: "p50", sorted: sorted, p: 50, want: 50 * time.Millisecond},
+		{name: "p90", sorted: sorted, p: 90, want: 90 * time.Millisecond},
+		{name: "p99", sorted: sorted, p: 99, want: 99 * time.Millisecond},
+		{name: "p99 of ten", sorted: sorted[:10], p: 99, want: 10 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if have := percentile(test.sorted, test.p); have != test.want {
+				t.Errorf("have: %v want: %v", have, test.want)
+			}
+		})
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	addr := freeAddr(t)
+
+	var config Config
+	config.Servers = []ConfigHTTP{{Name: "test", Host: cty.StringVal(addr)}}
+	config.Routes = []Route{
+		{
+			Path: "/test/{id}",
+			Request: []RequestHTTP{
+				{
+					Method: "get",
+					Response: []ResponseHTTP{
+						{Status: "200", Body: attr("ok")},
+						{Status: "503", Body: attr("busy")},
+					},
+					Plugins: hcl.EmptyBody(),
+				},
+			},
+		},
+	}
+	defer testServe(t, &config)()
+	testDial(t, addr).Close() // wait for the server to start
+
+	for i := 0; i < 4; i++ {
+		res, err := http.Get("http://" + addr + "/test/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	res, err := http.Get("http://" + addr + "/_internal/server/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var have map[string]routeStatJSON
+	if err := json.NewDecoder(res.Body).Decode(&have); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, ok := have["GET /test/{id}"]
+	if !ok {
+		t.Fatalf("have: %v want: the GET /test/{id} route", have)
+	}
+	if stat.Count != 4 {
+		t.Errorf("have: %d want: %d", stat.Count, 4)
+	}
+	if want := map[int]uint64{200: 2, 503: 2}; !reflect.DeepEqual(stat.Statuses, want) {
+		t.Errorf("have: %v want: %v", stat.Statuses, want)
+	}
+	for _, p := range []string{"p50", "p90", "p99"} {
+		if v, ok := stat.LatencyMS[p]; !ok || v <= 0 {
+			t.Errorf("[%s] have: %v want: a latency", p, v)
+		}
+	}
+}
@@ -13,10 +13,12 @@ import (
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"math/big"
 	mrand "math/rand"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/caddyserver/certmagic"
@@ -89,9 +91,79 @@ func useTLS(mw *chi.Mux, server ConfigHTTP) *tls.Config {
 		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cer}}
 	}
 
+	if err := tlsOptions(tlsConfig, server.SSL); err != nil {
+		panic(fmt.Errorf("%q SSL options: %v", server.Name, err)) // will stop the startup sequence...
+	}
+
+	if err := tlsClientAuth(tlsConfig, server.SSL.MTLS); err != nil {
+		panic(fmt.Errorf("%q SSL mtls: %v", server.Name, err)) // will stop the startup sequence...
+	}
+
 	return tlsConfig
 }
 
+// tlsClientAuth verifies the client certificates against the client_ca
+// bundle, clients must send a certificate when it's required
+func tlsClientAuth(tlsConfig *tls.Config, mtls *configMTLS) error {
+	if mtls == nil {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(mtls.ClientCA)
+	if err != nil {
+		return ErrLoadClientCA.F(mtls.ClientCA, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return ErrLoadClientCA.F(mtls.ClientCA, "no PEM certificates found")
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if mtls.Require {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
+// tlsVersions are the names that can be used for min_tls_version
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsOptions sets the minimum TLS version and the cipher suites,
+// the cipher suite names are checked against the crypto/tls names
+func tlsOptions(tlsConfig *tls.Config, ssl *configSSL) error {
+	if ssl.MinVersion != nil {
+		version, ok := tlsVersions[strings.TrimSpace(strings.TrimPrefix(strings.ToUpper(*ssl.MinVersion), "TLS"))]
+		if !ok {
+			return fmt.Errorf("unknown min_tls_version %q", *ssl.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if len(ssl.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			suites[suite.Name] = suite.ID
+		}
+
+		tlsConfig.CipherSuites = tlsConfig.CipherSuites[:0]
+		for _, name := range ssl.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return fmt.Errorf("unknown cipher suite %q", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+
+	return nil
+}
+
 // cert builds a x509 cert to use in HTTPS services.
 func cert(caCrtFile, caKeyFile string) (serverTLSConf *tls.Config, pin []byte, err error) {
 	var caCrt *x509.Certificate
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func TestTLSMinVersion(t *testing.T) {
+	minVersion := "1.3"
+	server := ConfigHTTP{Name: "test", SSL: &configSSL{MinVersion: &minVersion}}
+
+	tlsConfig := useTLS(chi.NewRouter(), server)
+	if tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("have: %x want: %x", tlsConfig.MinVersion, tls.VersionTLS13)
+	}
+
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	var tests = []struct {
+		name    string
+		max     uint16
+		wantErr bool
+	}{
+		{name: "below the min version", max: tls.VersionTLS12, wantErr: true},
+		{name: "at the min version", max: tls.VersionTLS13},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: test.max})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("have: %v want error: %t", err, test.wantErr)
+			}
+			if err == nil {
+				conn.Close()
+			}
+		})
+	}
+}
+
+func TestTLSOptionsNames(t *testing.T) {
+	var tests = []struct {
+		name    string
+		ssl     configSSL
+		wantErr bool
+	}{
+		{name: "cipher suite", ssl: configSSL{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}},
+		{name: "unknown cipher suite", ssl: configSSL{CipherSuites: []string{"TLS_NOT_A_SUITE"}}, wantErr: true},
+		{name: "unknown version", ssl: configSSL{MinVersion: func(s string) *string { return &s }("2.0")}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := tlsOptions(&tls.Config{}, &test.ssl)
+			if (err != nil) != test.wantErr {
+				t.Errorf("have: %v want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// testCert returns a cert for the common name signed by the parent, or
+// a self-signed CA cert when there isn't a parent
+func testCert(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	ca, otherCA := testCert(t, "ca.test", nil), testCert(t, "other-ca.test", nil)
+	client, otherClient := testCert(t, "client.test", &ca), testCert(t, "client.test", &otherCA)
+
+	caFile := filepath.Join(t.TempDir(), "client-ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name    string
+		require bool
+		certs   []tls.Certificate
+		want    string
+		wantErr bool
+	}{
+		{name: "required verified", require: true, certs: []tls.Certificate{client}, want: "client.test true"},
+		{name: "required missing", require: true, wantErr: true},
+		{name: "required unknown ca", require: true, certs: []tls.Certificate{otherClient}, wantErr: true},
+		{name: "optional missing", want: " false"},
+		{name: "optional verified", certs: []tls.Certificate{client}, want: "client.test true"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := ConfigHTTP{Name: "test", SSL: &configSSL{MTLS: &configMTLS{ClientCA: caFile, Require: test.require}}}
+			req := RequestHTTP{Method: "get", Response: []ResponseHTTP{{Status: "200", Body: attr("${tls.client_cn} ${tls.client_verified}")}}}
+
+			mux := chi.NewRouter()
+			tlsConfig := useTLS(mux, server)
+			if tlsConfig.ClientCAs == nil {
+				t.Fatal("have: no client CAs want: the client_ca pool")
+			}
+			mux.Method(req.Method, "/test", httpHandler(req, []TextBlock{}))
+
+			svr := httptest.NewUnstartedServer(mux)
+			svr.TLS = tlsConfig
+			svr.StartTLS()
+			defer svr.Close()
+
+			cl := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: test.certs}}}
+			res, err := cl.Get(svr.URL + "/test")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("have: %v want error: %t", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer res.Body.Close()
+
+			b, _ := ioutil.ReadAll(res.Body)
+			if have := string(b); have != test.want {
+				t.Errorf("have: %q want: %q", have, test.want)
+			}
+		})
+	}
+}
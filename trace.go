@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// the W3C trace context headers
+const (
+	HeaderTraceParent = "traceparent"
+	HeaderTraceState  = "tracestate"
+)
+
+// traceParentRe matches a traceparent header, i.e.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+var traceParentRe = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// parseTraceParent returns the trace ID and parent ID of a traceparent
+// header, the ff version and all zero IDs are not valid
+func parseTraceParent(traceParent string) (traceID, parentID string, ok bool) {
+	m := traceParentRe.FindStringSubmatch(strings.TrimSpace(traceParent))
+	if m == nil || m[1] == "ff" || strings.Trim(m[2], "0") == "" || strings.Trim(m[3], "0") == "" {
+		return "", "", false
+	}
+	return m[2], m[3], true
+}
+
+// newTraceParent returns a sampled traceparent header with a random
+// trace ID and parent ID
+func newTraceParent() string {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	log.OnErr(err).Printf("[http] creating a traceparent: %v", err)
+	return "00-" + hex.EncodeToString(b[:16]) + "-" + hex.EncodeToString(b[16:]) + "-01"
+}
+
+// traceContext is middleware that sets a traceparent request header when
+// there isn't a valid one, so it's in templates and proxied upstream. A
+// tracestate without a valid traceparent is dropped. The traceparent is
+// sent back so clients can find the trace.
+func traceContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := parseTraceParent(r.Header.Get(HeaderTraceParent)); !ok {
+			r.Header.Set(HeaderTraceParent, newTraceParent())
+			r.Header.Del(HeaderTraceState)
+		}
+		w.Header().Set(HeaderTraceParent, r.Header.Get(HeaderTraceParent))
+		next.ServeHTTP(w, r)
+	})
+}
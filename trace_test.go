@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+func TestTraceContext(t *testing.T) {
+	var upstreamParent, upstreamState string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamParent, upstreamState = r.Header.Get(HeaderTraceParent), r.Header.Get(HeaderTraceState)
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const given = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	var tests = []struct {
+		name      string
+		parent    string
+		state     string
+		want      string // the trace ID, empty when it's generated
+		wantState string
+	}{
+		{name: "generated when absent"},
+		{name: "propagated when present", parent: given, state: "vendor=abc", want: "4bf92f3577b34da6a3ce929d0e0e4736", wantState: "vendor=abc"},
+		{name: "generated when invalid", parent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", state: "vendor=abc"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := configProxy{Name: "upstream", _url: u}
+			templ := RequestHTTP{Method: "get", Response: []ResponseHTTP{{Status: "200", Body: attr("${request.trace_id}")}}}
+			proxied := RequestHTTP{Method: "get", Response: []ResponseHTTP{{Status: "upstream"}}}
+
+			hdl := chi.NewRouter()
+			hdl.Use(traceContext)
+			hdl.Method(templ.Method, "/trace", httpHandler(templ, []TextBlock{}))
+			hdl.Method(proxied.Method, "/proxy", httpHandler(proxied, []TextBlock{}))
+
+			for _, path := range []string{"/trace", "/proxy"} {
+				r := httptest.NewRequest(http.MethodGet, path, nil)
+				if test.parent != "" {
+					r.Header.Set(HeaderTraceParent, test.parent)
+					r.Header.Set(HeaderTraceState, test.state)
+				}
+				ctx := context.WithValue(r.Context(), ctxKey(proxy.Name), &proxy)
+
+				rec := httptest.NewRecorder()
+				hdl.ServeHTTP(rec, r.WithContext(ctx))
+
+				traceID, _, ok := parseTraceParent(rec.Header().Get(HeaderTraceParent))
+				if !ok || (test.want != "" && traceID != test.want) {
+					t.Fatalf("[%s] have: %q want: a traceparent for %q", path, rec.Header().Get(HeaderTraceParent), test.want)
+				}
+
+				switch path {
+				case "/trace":
+					if have := rec.Body.String(); have != traceID {
+						t.Errorf("have: %q want: %q", have, traceID)
+					}
+				case "/proxy":
+					if upstreamParent != rec.Header().Get(HeaderTraceParent) || upstreamState != test.wantState {
+						t.Errorf("have: %q %q want: %q %q", upstreamParent, upstreamState, rec.Header().Get(HeaderTraceParent), test.wantState)
+					}
+				}
+			}
+		})
+	}
+}